@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	conf "go-configmanager"
+	"io"
+	"os"
+)
+
+// the configs are written to stdout as JSON, one per line, whatever -json is
+func runExport(store *store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	from := flags.Uint64("from", 0, "the first log index")
+	to := flags.Uint64("to", conf.UINT64_MAX, "the last log index")
+	flags.Parse(args)
+
+	cm, err := store.open(true)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	return cm.ExportJSON(os.Stdout, *from, *to)
+}
+
+// the configs written by export are read from the file, or stdin if it is not given
+func runImport(store *store, args []string) error {
+	var r io.Reader = os.Stdin
+	if len(args) > 0 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	cm, err := store.open(false)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	return cm.ImportJSON(r)
+}
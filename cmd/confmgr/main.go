@@ -0,0 +1,121 @@
+/*
+confmgr works on the directory of a ConfManager from the command line, e.g. to fix a store a crash has broken.
+
+Usage:
+
+	confmgr [-dir dir] [-header header] [-json] [-v] <command> [arguments]
+
+the commands are listed by confmgr -h. the ones reading the store open it read only, so they can run next to the
+process writing it. what they read is printed as a table, or as JSON with -json.
+the warnings and errors of the store are logged to stderr, and what it does as well with -v.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	conf "go-configmanager"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type command struct {
+	args string // usage of the arguments
+	help string
+	run  func(store *store, args []string) error
+}
+
+var commands = map[string]command{
+	"segments":        {"", "list the data files with the log indexes they cover", runSegments},
+	"get":             {"<index>", "print the config covering the log index", runGet},
+	"last":            {"", "print the last config", runLast},
+	"list":            {"[-from index] [-to index]", "print the configs covering the log indexes in [from, to]", runList},
+	"dump-raw":        {"<file>", "print the framing of each record in a data file", runDumpRaw},
+	"export":          {"[-from index] [-to index]", "write the configs covering the log indexes in [from, to] as JSON", runExport},
+	"import":          {"[file]", "load the configs written by export to an empty store, read from stdin without file", runImport},
+	"verify":          {"", "check the files of the store, it exits with 1 if any problem is found", runVerify},
+	"truncate-before": {"<index>", "remove the configs before the one covering the log index", runTruncateBefore},
+	"truncate-after":  {"<index>", "remove the configs after the one covering the log index", runTruncateAfter},
+	"repair":          {"[-dry-run]", "rebuild the indexes, cut the broken data files and quarantine what can't be used", runRepair},
+}
+
+// the store the command works on
+type store struct {
+	dir    string
+	header string
+	json   bool // print JSON instead of a table
+}
+
+// open the store with the default options, read only unless it is to be written
+func (this *store) open(readOnly bool) (*conf.ConfManager, error) {
+	opts := conf.DefaultOptions()
+	opts.ReadOnly = readOnly
+	return conf.GetConfManagerWithOptions(this.dir, this.header, opts)
+}
+
+// print value as JSON, or the rows as a table under the columns
+func (this *store) print(value interface{}, columns []string, rows [][]string) error {
+	if this.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(columns, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: confmgr [-dir dir] [-header header] [-json] [-v] <command> [arguments]\n\nOptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s %s\n    \t%s\n", name, commands[name].args, commands[name].help)
+	}
+}
+
+func main() {
+	dir := flag.String("dir", ".", "directory of the store")
+	header := flag.String("header", "CONFIG", "header of the files of the store")
+	asJson := flag.Bool("json", false, "print JSON instead of a table")
+	verbose := flag.Bool("v", false, "log what the store does to stderr")
+	flag.Usage = usage
+	flag.Parse()
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	conf.LOGGER = conf.SlogLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "confmgr: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(&store{dir: *dir, header: *header, json: *asJson}, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "confmgr %s: %s\n", flag.Arg(0), err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	conf "go-configmanager"
+	"rafted/persist"
+	"strconv"
+)
+
+// a config as it is printed
+type configView struct {
+	FromLogIndex uint64
+	ToLogIndex   uint64
+	Term         uint64 // 0 if it was pushed without a term
+	Conf         *persist.Config
+}
+
+var configColumns = []string{"FROM", "TO", "TERM", "SERVERS", "NEW SERVERS"}
+
+func (this *configView) row() []string {
+	servers, newServers := "-", "-"
+	if this.Conf != nil && this.Conf.Servers != nil {
+		servers = this.Conf.Servers.String()
+	}
+	if this.Conf != nil && this.Conf.NewServers != nil {
+		newServers = this.Conf.NewServers.String()
+	}
+	return []string{formatIndex(this.FromLogIndex), formatIndex(this.ToLogIndex), strconv.FormatUint(this.Term, 10), servers, newServers}
+}
+
+func printConfigs(store *store, configs []*configView) error {
+	rows := make([][]string, 0, len(configs))
+	for _, config := range configs {
+		rows = append(rows, config.row())
+	}
+	return store.print(configs, configColumns, rows)
+}
+
+// UINT64_MAX is the end of the log
+func formatIndex(index uint64) string {
+	if index == conf.UINT64_MAX {
+		return "-"
+	}
+	return strconv.FormatUint(index, 10)
+}
+
+// the only argument of a command, as a log index
+func parseIndex(args []string) (uint64, error) {
+	if len(args) != 1 {
+		return 0, errors.New("expected a log index")
+	}
+	index, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("illegal log index %q", args[0]))
+	}
+	return index, nil
+}
+
+func runSegments(store *store, args []string) error {
+	cm, err := store.open(true)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	segments, err := cm.Segments()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(segments))
+	for _, segment := range segments {
+		rows = append(rows, []string{
+			segment.File,
+			formatIndex(segment.FromLogIndex),
+			formatIndex(segment.ToLogIndex),
+			strconv.FormatUint(segment.Size, 10),
+			strconv.FormatUint(segment.Records, 10),
+			strconv.Itoa(segment.Sections),
+		})
+	}
+
+	return store.print(segments, []string{"FILE", "FROM", "TO", "SIZE", "RECORDS", "SECTIONS"}, rows)
+}
+
+func runGet(store *store, args []string) error {
+	index, err := parseIndex(args)
+	if err != nil {
+		return err
+	}
+	cm, err := store.open(true)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	meta, err := cm.GetConfig(index)
+	if err != nil {
+		return err
+	}
+	term, err := cm.GetConfigTerm(index)
+	if err != nil {
+		return err
+	}
+
+	return printConfigs(store, []*configView{{meta.FromLogIndex, meta.ToLogIndex, term, meta.Conf}})
+}
+
+func runLast(store *store, args []string) error {
+	cm, err := store.open(true)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	meta, err := cm.LastConfig()
+	if err != nil {
+		return err
+	}
+	term, err := cm.GetConfigTerm(meta.FromLogIndex)
+	if err != nil {
+		return err
+	}
+
+	return printConfigs(store, []*configView{{meta.FromLogIndex, meta.ToLogIndex, term, meta.Conf}})
+}
+
+func runList(store *store, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	from := flags.Uint64("from", 0, "the first log index")
+	to := flags.Uint64("to", conf.UINT64_MAX, "the last log index")
+	flags.Parse(args)
+
+	cm, err := store.open(true)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	configs := make([]*configView, 0)
+	it := cm.Iterator(*from, *to)
+	defer it.Close()
+	for it.Next() {
+		meta := it.Meta()
+		configs = append(configs, &configView{meta.FromLogIndex, meta.ToLogIndex, it.Term(), meta.Conf})
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+
+	return printConfigs(store, configs)
+}
+
+// the records before a broken one are printed with the error
+func runDumpRaw(store *store, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected a data file")
+	}
+
+	records, err := conf.DumpRaw(store.dir, store.header, args[0])
+	if records == nil {
+		return err
+	}
+	rows := make([][]string, 0, len(records))
+	for _, record := range records {
+		rows = append(rows, []string{
+			strconv.FormatUint(record.Offset, 10),
+			strconv.FormatUint(record.StartId, 10),
+			strconv.FormatUint(record.EndId, 10),
+			strconv.FormatUint(record.Term, 10),
+			strconv.FormatUint(record.BuffLen, 10),
+			fmt.Sprintf("%08x", record.Crc),
+			strconv.FormatUint(record.Padding, 10),
+			strconv.FormatUint(record.Size, 10),
+		})
+	}
+	if printErr := store.print(records, []string{"OFFSET", "START", "END", "TERM", "LEN", "CRC", "PADDING", "SIZE"}, rows); printErr != nil {
+		return printErr
+	}
+
+	return err
+}
+
+func runVerify(store *store, args []string) error {
+	report, err := conf.VerifyDir(store.dir, store.header)
+	if err != nil {
+		return err
+	}
+
+	if store.json {
+		err = store.print(report, nil, nil)
+	} else {
+		fmt.Println(report.String())
+	}
+	if err == nil && !report.OK() {
+		err = errors.New(fmt.Sprintf("%d problems found", len(report.Problems)))
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	conf "go-configmanager"
+)
+
+// print the plan, and apply it unless -dry-run
+func runRepair(store *store, args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the plan only, nothing is changed")
+	flags.Parse(args)
+
+	opts := conf.DefaultOptions()
+	opts.ReadOnly = *dryRun
+	plan, err := conf.Repair(store.dir, store.header, opts)
+	if plan != nil {
+		fmt.Println(plan.String())
+	}
+
+	return err
+}
@@ -0,0 +1,27 @@
+package main
+
+// the store is opened to write, it fails with ErrLocked if another process has opened it to write
+func truncate(store *store, args []string, after bool) error {
+	index, err := parseIndex(args)
+	if err != nil {
+		return err
+	}
+	cm, err := store.open(false)
+	if err != nil {
+		return err
+	}
+	defer cm.Close()
+
+	if after {
+		return cm.TruncateAfter(index)
+	}
+	return cm.TruncateBefore(index)
+}
+
+func runTruncateBefore(store *store, args []string) error {
+	return truncate(store, args, false)
+}
+
+func runTruncateAfter(store *store, args []string) error {
+	return truncate(store, args, true)
+}
@@ -0,0 +1,122 @@
+package conf
+
+/*
+	codec converts a config to the bytes stored in a record and back.
+
+	the ID of the codec is persisted in the meta file of the store ( path/header.meta ) when the store is created, and
+	the store is always decoded by it: a store written by JSONCodec opened with the default options is still decoded
+	by JSONCodec. a store written by a codec which is not built in can only be opened with that codec in Options.Codec,
+	or it is rejected.
+
+	stores created before the codec was recorded are msgpack.
+ */
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"modules/msgpack"
+)
+
+const (
+	CODEC_ID_MSGPACK uint64 = 1
+	CODEC_ID_JSON    uint64 = 2
+	CODEC_ID_GOB     uint64 = 3
+)
+
+type Codec interface {
+	// stable ID persisted in the store, 0 is reserved, so are the ones of the built-in codecs
+	ID() uint64
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	MsgpackCodec Codec = msgpackCodec{}
+	JSONCodec    Codec = jsonCodec{}
+	GobCodec     Codec = gobCodec{}
+
+	CODEC = MsgpackCodec // default of Options.Codec
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() uint64   { return CODEC_ID_MSGPACK }
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() uint64   { return CODEC_ID_JSON }
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// each record is a standalone gob stream, so that it can be decoded without the ones before it
+type gobCodec struct{}
+
+func (gobCodec) ID() uint64   { return CODEC_ID_GOB }
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+/*
+	the codec to decode a store written by the codec of id
+	@param optCodec: Options.Codec, used if it has the id
+ */
+func getCodecById(id uint64, optCodec Codec) (Codec, error) {
+	if optCodec != nil && optCodec.ID() == id {
+		return optCodec, nil
+	}
+
+	for _, codec := range []Codec{MsgpackCodec, JSONCodec, GobCodec} {
+		if codec.ID() == id {
+			return codec, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("unknown codec %d, the store must be opened with the codec it was written by", id))
+}
+
+func validateCodec(codec Codec) error {
+	if codec == nil {
+		return errors.New("invalid options: Codec must be set")
+	}
+	if codec.ID() == 0 {
+		return errors.New(fmt.Sprintf("invalid options: ID of Codec %s must not be 0", codec.Name()))
+	}
+
+	// a custom codec must not take the ID of a built-in one
+	builtin, err := getCodecById(codec.ID(), nil)
+	if err == nil && builtin != codec {
+		return errors.New(fmt.Sprintf("invalid options: Codec %s takes the ID %d of %s", codec.Name(), codec.ID(), builtin.Name()))
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	. "rafted/persist"
+)
+
+var (
+	CODEC_DATA_PATH = "./codec_data"
+	CODEC_DATA_HEADER = "codec"
+)
+
+// a codec not built in
+type customCodec struct {
+	jsonCodec
+	id uint64
+}
+
+func (this customCodec) ID() uint64   { return this.id }
+func (this customCodec) Name() string { return "custom" }
+
+func codecOptions(codec Codec) Options {
+	opts := DefaultOptions()
+	opts.Codec = codec
+	return opts
+}
+
+// a store is decoded by the codec it was created with, whatever the options say
+func Test_codecs(t *testing.T) {
+	for _, codec := range []Codec{MsgpackCodec, JSONCodec, GobCodec} {
+		path := filepath.Join(CODEC_DATA_PATH, codec.Name())
+		removeAll(path)
+		cm, err := GetConfManagerWithOptions(path, CODEC_DATA_HEADER, codecOptions(codec))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = pushConf(cm, START_ID, ID_RANGE, 10); err != nil {
+			cm.Close()
+			t.Error(codec.Name(), err)
+			return
+		}
+		cm.Close()
+
+		cm, err = GetConfManager(path, CODEC_DATA_HEADER)
+		if err != nil {
+			t.Error(codec.Name(), err)
+			return
+		}
+		if cm.codec.ID() != codec.ID() {
+			t.Errorf("store must be decoded by %s, but get %s\n", codec.Name(), cm.codec.Name())
+		}
+		metas, err := cm.ListAfter(uint64(START_ID))
+		if err != nil {
+			cm.Close()
+			t.Error(codec.Name(), err)
+			return
+		}
+		if len(metas) != 10 {
+			t.Errorf("%s: expected 10 configs, but get %d\n", codec.Name(), len(metas))
+		}
+		for i, meta := range metas {
+			id := START_ID + i * ID_RANGE
+			if !MultiAddrSliceEqual(meta.Conf.Servers, getConf(id).Servers) {
+				t.Errorf("%s: config %d is %v, expected %v\n", codec.Name(), id, meta.Conf.Servers, getConf(id).Servers)
+			}
+		}
+		cm.Close()
+	}
+}
+
+// a store written by a codec not built in can only be opened with it
+func Test_codecUnknown(t *testing.T) {
+	removeAll(CODEC_DATA_PATH)
+	custom := customCodec{id: 100}
+	cm, err := GetConfManagerWithOptions(CODEC_DATA_PATH, CODEC_DATA_HEADER, codecOptions(custom))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cm, START_ID, ID_RANGE, 3); err != nil {
+		t.Error(err)
+	}
+	cm.Close()
+
+	if _, err = GetConfManager(CODEC_DATA_PATH, CODEC_DATA_HEADER); err == nil {
+		t.Error("open with another codec must fail")
+		return
+	}
+
+	cm, err = GetConfManagerWithOptions(CODEC_DATA_PATH, CODEC_DATA_HEADER, codecOptions(custom))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if _, err = cm.GetConfig(uint64(START_ID)); err != nil {
+		t.Error(err)
+	}
+}
+
+// the meta files written before the codec was recorded are msgpack, and upgraded when opening
+func Test_codecOldMeta(t *testing.T) {
+	removeAll(CODEC_DATA_PATH)
+	cm, err := GetConfManager(CODEC_DATA_PATH, CODEC_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cm, START_ID, ID_RANGE, 3); err != nil {
+		t.Error(err)
+	}
+	metaFileName := cm.store.disk.getMetaFileName()
+	cm.Close()
+
+	if err = os.Truncate(metaFileName, int64(META_CODEC_POS)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cm, err = GetConfManagerWithOptions(CODEC_DATA_PATH, CODEC_DATA_HEADER, codecOptions(GobCodec))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if cm.codec.ID() != CODEC_ID_MSGPACK {
+		t.Errorf("store must be decoded by msgpack, but get %s\n", cm.codec.Name())
+	}
+	if _, err = cm.GetConfig(uint64(START_ID)); err != nil {
+		t.Error(err)
+	}
+	fileInfo, err := os.Stat(metaFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if uint64(fileInfo.Size()) != META_SIZE {
+		t.Errorf("meta file must be upgraded to %d bytes, but get %d\n", META_SIZE, fileInfo.Size())
+	}
+}
+
+// without a meta file, only the records without crc are taken as a legacy store of msgpack
+func Test_codecMetaMissing(t *testing.T) {
+	removeAll(CODEC_DATA_PATH)
+	cm, err := GetConfManagerWithOptions(CODEC_DATA_PATH, CODEC_DATA_HEADER, codecOptions(JSONCodec))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cm, START_ID, ID_RANGE, 3); err != nil {
+		t.Error(err)
+	}
+	metaFileName := cm.store.disk.getMetaFileName()
+	cm.Close()
+
+	if err = os.Remove(metaFileName); err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = GetConfManagerWithOptions(CODEC_DATA_PATH, CODEC_DATA_HEADER, codecOptions(JSONCodec))
+	var corrupt *CorruptError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.File != metaFileName {
+		t.Errorf("open a store of crc records without its meta file must return ErrCorrupt of it, but get %v\n", err)
+	}
+
+	// a legacy store
+	removeAll(CODEC_DATA_PATH)
+	if err = os.MkdirAll(CODEC_DATA_PATH, 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	format := getRecordFormat(LEGACY_FORMAT_VERSION, LEGACY_BLOCK_SIZE)
+	data := make([]byte, 0)
+	for i := 0; i < 3; i++ {
+		buff, err := MsgpackCodec.Marshal(getConf(START_ID + i * ID_RANGE))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		endId := uint64(START_ID + (i + 1) * ID_RANGE - 1)
+		if i == 2 {
+			endId = 0
+		}
+		data = append(data, format.encode(uint64(START_ID + i * ID_RANGE), endId, 0, buff)...)
+	}
+	opts := codecOptions(JSONCodec)
+	opts.DataBlockSize = LEGACY_BLOCK_SIZE
+	opts.FileNameNumLen = LEGACY_FILE_NAME_NUMLEN
+	dataFileName := filepath.Join(CODEC_DATA_PATH, fmt.Sprintf("%s_%0*d.data", CODEC_DATA_HEADER, LEGACY_FILE_NAME_NUMLEN, START_ID))
+	if err = ioutil.WriteFile(dataFileName, data, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cm, err = GetConfManagerWithOptions(CODEC_DATA_PATH, CODEC_DATA_HEADER, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if cm.codec.ID() != CODEC_ID_MSGPACK {
+		t.Errorf("legacy store must be decoded by msgpack, but get %s\n", cm.codec.Name())
+	}
+	if metas, err := cm.ListAfter(0); err != nil || len(metas) != 3 {
+		t.Errorf("legacy store must have 3 configs, but get %d, %v\n", len(metas), err)
+	}
+}
+
+func Test_codecValidate(t *testing.T) {
+	for _, codec := range []Codec{nil, customCodec{id: 0}, customCodec{id: CODEC_ID_GOB}} {
+		opts := codecOptions(codec)
+		if err := opts.validate(); err == nil {
+			t.Errorf("codec %v must be rejected\n", codec)
+		}
+	}
+
+	opts := codecOptions(customCodec{id: 100})
+	if err := opts.validate(); err != nil {
+		t.Error(err)
+	}
+}
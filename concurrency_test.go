@@ -0,0 +1,156 @@
+package conf
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	CONCURRENCY_DATA_PATH = "./concurrency_data"
+	CONCURRENCY_DATA_HEADER = "concurrency"
+)
+
+/*
+	one writer pushes and truncates, while readers keep reading. run with -race.
+	readers check that each result is a consistent view: the config covers the index asked, and the configs
+	listed are continuous.
+ */
+func Test_concurrentReadWrite(t *testing.T) {
+	cm, err := getTestStore(CONCURRENCY_DATA_PATH, CONCURRENCY_DATA_HEADER, 0, func(opts *Options) {
+		opts.MaxRecordNum = 50 // read from disk as well
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// ids in [minId, lastId] are readable
+	var minId, lastId uint64
+	if err = cm.PushConfig(uint64(START_ID), getConf(START_ID)); err != nil {
+		t.Error(err)
+		return
+	}
+	atomic.StoreUint64(&minId, uint64(START_ID))
+	atomic.StoreUint64(&lastId, uint64(START_ID))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	// writer
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(stop)
+
+		id := uint64(START_ID)
+		for i := 1; i <= 600; i++ {
+			id += uint64(ID_RANGE)
+			if err := cm.PushConfig(id, getConf(int(id))); err != nil {
+				report(err)
+				return
+			}
+			atomic.StoreUint64(&lastId, id)
+
+			switch {
+			case i % 200 == 0:
+				// forget the early ones
+				newMin := id - uint64(100 * ID_RANGE)
+				atomic.StoreUint64(&minId, newMin)
+				if err := cm.TruncateBefore(newMin); err != nil {
+					report(err)
+					return
+				}
+			case i % 45 == 0:
+				// overwrite the last few ones
+				id -= uint64(3 * ID_RANGE)
+				if err := cm.TruncateAfter(id); err != nil {
+					report(err)
+					return
+				}
+				atomic.StoreUint64(&lastId, id)
+			}
+		}
+	}()
+
+	// readers
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				low := atomic.LoadUint64(&minId) + uint64(100 * ID_RANGE) // TruncateBefore may run before the reader reads it
+				high := atomic.LoadUint64(&lastId) - uint64(10 * ID_RANGE) // TruncateAfter may drop the last ones
+				if high <= low {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				id := low + uint64(n * 37 + r) % (high - low)
+
+				switch n % 3 {
+				case 0:
+					meta, err := cm.GetConfig(id)
+					if err != nil {
+						if !errors.Is(err, ErrNotFound) {
+							report(err)
+						}
+						continue
+					}
+					if meta.FromLogIndex > id || meta.ToLogIndex < id {
+						t.Errorf("GetConfig(%d) returns [%d, %d]\n", id, meta.FromLogIndex, meta.ToLogIndex)
+					}
+				case 1:
+					metas, err := cm.ListAfter(id)
+					if err != nil {
+						if !errors.Is(err, ErrNotFound) {
+							report(err)
+						}
+						continue
+					}
+					for i := 1; i < len(metas); i++ {
+						if metas[i-1].ToLogIndex + 1 != metas[i].FromLogIndex {
+							t.Errorf("ListAfter(%d) is not continuous at %d: [%d, %d] [%d, %d]\n", id, i,
+								metas[i-1].FromLogIndex, metas[i-1].ToLogIndex, metas[i].FromLogIndex, metas[i].ToLogIndex)
+							break
+						}
+					}
+					if len(metas) > 0 && metas[len(metas)-1].ToLogIndex != math.MaxUint64 {
+						t.Errorf("ListAfter(%d) doesn't end with the last config\n", id)
+					}
+				case 2:
+					last, err := cm.LastConfig()
+					if err != nil {
+						report(err)
+						continue
+					}
+					if last.ToLogIndex != math.MaxUint64 {
+						t.Errorf("LastConfig returns [%d, %d]\n", last.FromLogIndex, last.ToLogIndex)
+					}
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -1,254 +1,273 @@
 package conf
 
 /*
-	confmanager keeps the recent data in memory, and persist all records to disk. Read requests will be fast return with the memory data,
-	and write will be first applied to disk for safety.
+	confmanager keeps the configs of raft, it is a RangeStore (see rangestore.go) of the configs encoded by the codec
+	the store was created with. the writes, the locking and the recovery are all done by the RangeStore, confmanager
+	turns the configs to records and back, and tells the watchers about the changes (see watch.go).
 */
 
 import (
 	. "rafted/persist"
-	"modules/msgpack"
-	//"fmt"
-	//"errors"
-	"modules/glog"
+	"fmt"
+	"sync"
 )
 
 var (
-	CM_NOTFOUND_ERR =ErrorConfigNotExist
+	// the errors are in errors.go now, this is kept for the callers before, compare it by errors.Is
+	CM_NOTFOUND_ERR = ErrNotFound
 )
 
+/*
+	ConfigManager is the interface for durable config management.
+	It provides functions to store and restrieve config.
+
+	each config covers a range of log index: [FromLogIndex, ToLogIndex], ToLogIndex is the index right before the
+	next config, and UINT64_MAX for the last one. if no config covers the index, the error returned is
+	ErrorConfigNotExist, or one wrapping it, test it by errors.Is.
+	the suite in conftest checks an implementation against this contract.
+ */
+type ConfigManager interface {
+	// Store a new config at the log entry with specified index,
+	// which must be larger than the one of the last config.
+	// Pushing the config stored at the index again is a no-op.
+	PushConfig(logIndex uint64, conf *Config) error
+
+	// Return the config which covers the specified log index
+	GetConfig(logIndex uint64) (*ConfigMeta, error)
+
+	// Return the last config
+	LastConfig() (*ConfigMeta, error)
+
+	// Return the config which covers the given index and all the configs after it
+	ListAfter(logIndex uint64) ([]*ConfigMeta, error)
+
+	// Delete the config metadata before the given index, the config
+	// which covers the given index is kept and starts from it.
+	TruncateBefore(logIndex uint64) error
+
+	// Delete the config metadata after the given index, the config
+	// which covers the given index becomes the last one.
+	TruncateAfter(logIndex uint64) error
+
+	// Release the files, the ConfigManager can't be used after it
+	Close()
+}
+
+// ConfManager must implement ConfigManager
+var _ ConfigManager = (*ConfManager)(nil)
+
 type ConfManager struct {
-	dir    string // dir path of data files
-	header string // header of data files
-	mem    *myList
-	disk   *diskIo
+	store *RangeStore // the records of the configs, only read and written as configs
+
+	codec Codec // the one the store was created with, see codec.go
+
+	watchMutex sync.Mutex
+	watchers   map[*watcher]struct{} // see watch.go, nil when closed
 }
 
 /******************** public functions ************************/
 func GetConfManager(dir, header string) (*ConfManager, error) {
-	cm := &ConfManager {
-		dir: dir,
-		header: header,
-		mem: nil,
-		disk: nil,
-	}
-
-	cm.mem = getMyList()
+	return GetConfManagerWithOptions(dir, header, DefaultOptions())
+}
 
-	disk, err := getDiskIO(dir, header)
+/*
+	get a ConfManager tuned by opts, start from DefaultOptions() and change what you need.
+	DataBlockSize and FileNameNumLen can't be changed once the store is created.
+	only one process can open a store to write, the others get an ErrLocked, see lock.go. with opts.ReadOnly, the store
+	is opened next to the writer, and PushConfig, TruncateBefore, TruncateAfter and RestoreSnapshot return ErrReadOnly.
+ */
+func GetConfManagerWithOptions(dir, header string, opts Options) (*ConfManager, error) {
+	store, err := GetRangeStoreWithOptions(dir, header, opts)
 	if err != nil {
 		return nil, err
 	}
-	cm.disk = disk
 
-	err = cm.initList()
-	if err != nil {
-		return nil, err
+	cm := &ConfManager {
+		store: store,
+		codec: store.disk.codec,
+		watchers: make(map[*watcher]struct{}),
 	}
+	store.observer = cm
 
 	return cm, nil
 }
 
+// it can be called more than once, only the first one does the work
 func (this *ConfManager) Close() {
-	this.mem.close()
-	this.disk.close()
+	this.store.Close()
 }
 
+/*
+	tells what was dropped from the latest data file because of a crash while opening the store, or a write failed in
+	the middle, returns nil if nothing was dropped.
+ */
+func (this *ConfManager) RecoveryReport() *RecoveryReport {
+	return this.store.RecoveryReport()
+}
+
+/*
+	push conf at logIndex, which must be after the last config. a log replayed after restarting pushes the configs
+	again: the same config at the log index of one stored is a no-op, and the others return ErrConflict, unless
+	Options.RaftOverwrite is set, with which the configs from logIndex on are truncated and conf is pushed, as raft
+	drops the entries conflicting with the leader's.
+ */
 func (this *ConfManager) PushConfig(logIndex uint64, conf *Config) error {
-	buff, err := msgpack.Marshal(conf)
-	if err != nil {
-		return err
-	}
+	return this.PushConfigWithTerm(logIndex, 0, conf)
+}
 
-	// push disk
-	err = this.disk.append(logIndex, buff)
+/*
+	PushConfig with the raft term of the log entry, read it back by GetConfigTerm. a replayed config is a no-op only if
+	the term is the same as well. term 0 is unknown, it matches any term, as the configs stored before terms were
+	recorded are read with term 0.
+ */
+func (this *ConfManager) PushConfigWithTerm(logIndex uint64, term uint64, conf *Config) error {
+	buff, err := this.codec.Marshal(conf)
 	if err != nil {
 		return err
 	}
 
-	// push mem
-	listElem := getElem(logIndex, buff)
-	err = this.mem.push(listElem)
-	if err != nil {
-		return nil
-	}
-
-	return nil
+	return this.store.PushRaw(logIndex, term, buff)
 }
 
 func (this *ConfManager) GetConfig(logIndex uint64) (*ConfigMeta, error) {
-	conf := &Config{}
-
-	// get from memory
-	memFound := true
-	memElem, err := this.mem.get(logIndex)
-	if err != nil {
-		if err == MEM_NOTFOUND_ERR {
-			memFound = false
-		} else {
-			return nil, err
-		}
-	}
-	if memFound {
-		err = msgpack.Unmarshal(memElem.data, conf)
-		if err != nil {
-			return nil, err
-		}
-
-		configMeta := &ConfigMeta {
-			FromLogIndex: memElem.startId,
-			ToLogIndex: memElem.endId,
-			Conf: conf,
-		}
-
-		return configMeta, nil
-	}
-
-	// if not found in memory, try to read from disk
-	startId, endId, buff, err := this.disk.get(logIndex)
-	if err != nil {
-		if err == DISK_NOTFOUND_ERR {
-			return nil, CM_NOTFOUND_ERR
-		}
-		return nil, err
-	}
-	err = msgpack.Unmarshal(buff, conf)
+	record, err := this.store.GetRaw(logIndex)
 	if err != nil {
 		return nil, err
 	}
 
-	configMeta := &ConfigMeta {
-		FromLogIndex: startId,
-		ToLogIndex: endId,
-		Conf: conf,
-	}
-
-	return configMeta, nil
+	return rangeRecordToConfigMeta(this.codec, record)
 }
 
 func (this *ConfManager) LastConfig() (*ConfigMeta, error) {
-	lastElem, err := this.mem.last()
+	record, err := this.store.LastRaw()
 	if err != nil {
-		if err == MEM_NOTFOUND_ERR {
-			return nil, CM_NOTFOUND_ERR
-		}
 		return nil, err
 	}
 
-	conf := &Config {}
-	err = msgpack.Unmarshal(lastElem.data, conf)
-	if err != nil {
-		return nil, err
-	}
+	return rangeRecordToConfigMeta(this.codec, record)
+}
 
-	configMeta := &ConfigMeta {
-		FromLogIndex: lastElem.startId,
-		ToLogIndex: lastElem.endId,
-		Conf: conf,
-	}
+/*
+	return the raft term of the config covering logIndex, 0 if it was pushed without a term.
+ */
+func (this *ConfManager) GetConfigTerm(logIndex uint64) (uint64, error) {
+	return this.store.GetTerm(logIndex)
+}
 
-	return configMeta, nil
+/*
+	truncate the configs from logIndex on if the one starting from logIndex is of a term other than term, as raft does
+	when an entry of the follower conflicts with the leader's. nothing is done if no config starts from logIndex, or
+	either term is 0, which is unknown.
+	@return bool: the configs are truncated
+ */
+func (this *ConfManager) TruncateAfterTermMismatch(logIndex uint64, term uint64) (bool, error) {
+	return this.store.TruncateAfterTermMismatch(logIndex, term)
 }
 
-func (this *ConfManager) ListAfter(logIndex uint64) ([]*ConfigMeta, error) {
-	result := make([]*ConfigMeta, 0)
+func (this *ConfManager) TruncateBefore(logIndex uint64) error {
+	return this.store.TruncateBefore(logIndex)
+}
 
-	// read mem
-	memElems, err := this.mem.listAfter(logIndex)
-	if err != nil && err != MEM_NOTFOUND_ERR {
-		return nil, err
-	}
-	memCMs, err := memElemsToConfigMetas(memElems)
+func (this *ConfManager) TruncateAfter(logIndex uint64) error {
+	return this.store.TruncateAfter(logIndex)
+}
+
+func (this *ConfManager) ListAfter(logIndex uint64) ([]*ConfigMeta, error) {
+	records, err := this.store.ListRaw(logIndex, UINT64_MAX, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	// read others from disk
-	if memElems[0].startId > logIndex {
-		// need read [logIndex, memElems[0].startId] from disk
-		//fmt.Printf("need [%d, %d] from disk\n", logIndex, memElems[0].startId - 1)
-		diskElems, err := this.disk.listBetween(logIndex, memElems[0].startId - 1)
-		if err != nil {
-			if err == DISK_NOTFOUND_ERR {
-				return nil, CM_NOTFOUND_ERR
-			}
-			return nil, err
-		}
+	return rangeRecordsToConfigMetas(this.codec, records)
+}
 
-		diskCMs, err := diskElemsToConfigMetas(diskElems)
-		if err != nil {
-			return nil, err
+/*
+	return the configs covering the log indexes in [from, to], read from memory if they are there, or from disk.
+	ErrTooLarge is returned if there are more than Options.MaxResultNum configs, page them with ListPage.
+ */
+func (this *ConfManager) ListBetween(from, to uint64) ([]*ConfigMeta, error) {
+	max := this.store.opts.MaxResultNum
+	records, err := this.store.ListRaw(from, to, max + 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > max {
+		return nil, &TooLargeError{
+			What: fmt.Sprintf("configs in [%d, %d]", from, to),
+			Limit: uint64(max),
 		}
-		result = append(result, diskCMs...)
-		//fmt.Println("diskElemsNum:", len(diskCMs))
 	}
 
-	result = append(result, memCMs...)
-	//fmt.Println("memElemsNum:", len(memCMs))
-
-	return result, nil
+	return rangeRecordsToConfigMetas(this.codec, records)
 }
 
+/*
+	return at most limit configs from the one covering from, limit is cut to Options.MaxResultNum.
+	@return uint64: the log index to get the next page from, 0 if this is the last page
+ */
+func (this *ConfManager) ListPage(from uint64, limit int) ([]*ConfigMeta, uint64, error) {
+	if limit <= 0 || limit > this.store.opts.MaxResultNum {
+		limit = this.store.opts.MaxResultNum
+	}
 
-func (this *ConfManager) TruncateBefore(logIndex uint64) error {
-	// truncate from disk
-	err := this.disk.truncateBefore(logIndex)
+	records, err := this.store.ListRaw(from, UINT64_MAX, limit)
 	if err != nil {
-		glog.Errorf("truncateBefore %d faild:%s\n", logIndex, err.Error())
-		return err
+		return nil, 0, err
 	}
-
-	// truncate from mem
-	err = this.mem.truncateBefore(logIndex)
+	result, err := rangeRecordsToConfigMetas(this.codec, records)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
-	return nil
+	// the last config covers all after it
+	last := result[len(result)-1]
+	if last.ToLogIndex == UINT64_MAX {
+		return result, 0, nil
+	}
+
+	return result, last.ToLogIndex + 1, nil
 }
 
-func (this *ConfManager) TruncateAfter(logIndex uint64) error {
-	// truncate from disk
-	err := this.disk.truncateAfter(logIndex)
-	if err != nil {
-		return err
+/*
+	return at most n configs from the one covering logIndex backwards, newest first, n is cut to Options.MaxResultNum.
+	e.g. ListBefore(UINT64_MAX, 10) returns the last 10 configs.
+ */
+func (this *ConfManager) ListBefore(logIndex uint64, n int) ([]*ConfigMeta, error) {
+	if n <= 0 || n > this.store.opts.MaxResultNum {
+		n = this.store.opts.MaxResultNum
 	}
 
-	// truncate from mem
-	_, err = this.mem.truncateAfter(logIndex)
+	records, err := this.store.ListRawBefore(logIndex, n)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return rangeRecordsToConfigMetas(this.codec, records)
 }
 
 /**************** internal functions ***********************************/
 
-func memElemsToConfigMetas(memElems []*myElem) ([]*ConfigMeta, error) {
-	count := len(memElems)
-	result := make([]*ConfigMeta, count)
-
-	for i, e := range memElems {
-		meta, err := memElemToConfigMeta(e)
-		//result[i], err := memElemToConfigMeta(e)
-		result[i] = meta
+func rangeRecordsToConfigMetas(codec Codec, records []*RangeRecord) ([]*ConfigMeta, error) {
+	result := make([]*ConfigMeta, len(records))
+	for i, record := range records {
+		meta, err := rangeRecordToConfigMeta(codec, record)
 		if err != nil {
 			return nil, err
 		}
+		result[i] = meta
 	}
 
 	return result, nil
 }
 
-func memElemToConfigMeta(memElem *myElem) (*ConfigMeta, error) {
+func rangeRecordToConfigMeta(codec Codec, record *RangeRecord) (*ConfigMeta, error) {
 	cm := &ConfigMeta{
-		FromLogIndex: memElem.startId,
-		ToLogIndex: memElem.endId,
+		FromLogIndex: record.FromLogIndex,
+		ToLogIndex: record.ToLogIndex,
 		Conf: &Config{},
 	}
 
-	err := msgpack.Unmarshal(memElem.data, cm.Conf)
+	err := codec.Unmarshal(record.Data, cm.Conf)
 	if err != nil {
 		return nil, err
 	}
@@ -256,30 +275,14 @@ func memElemToConfigMeta(memElem *myElem) (*ConfigMeta, error) {
 	return cm, nil
 }
 
-func diskElemsToConfigMetas(diskElems []*diskElem) ([]*ConfigMeta, error) {
-	count := len(diskElems)
-	result := make([]*ConfigMeta, count)
-
-	for i, e := range diskElems {
-		meta, err := diskElemToConfigMeta(e)
-		//result[i], err := memElemToConfigMeta(e)
-		result[i] = meta
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return result, nil
-}
-
-func diskElemToConfigMeta(diskElem *diskElem) (*ConfigMeta, error) {
+func memElemToConfigMeta(codec Codec, memElem *myElem) (*ConfigMeta, error) {
 	cm := &ConfigMeta{
-		FromLogIndex: diskElem.startId,
-		ToLogIndex: diskElem.endId,
+		FromLogIndex: memElem.startId,
+		ToLogIndex: memElem.endId,
 		Conf: &Config{},
 	}
 
-	err := msgpack.Unmarshal(diskElem.buff, cm.Conf)
+	err := codec.Unmarshal(memElem.data, cm.Conf)
 	if err != nil {
 		return nil, err
 	}
@@ -287,57 +290,12 @@ func diskElemToConfigMeta(diskElem *diskElem) (*ConfigMeta, error) {
 	return cm, nil
 }
 
-func diskElemToConfig(diskElem *diskElem) (*Config, error) {
+func diskElemToConfig(codec Codec, diskElem *diskElem) (*Config, error) {
 	conf := &Config{}
-	err := msgpack.Unmarshal(diskElem.buff, conf)
+	err := codec.Unmarshal(diskElem.buff, conf)
 	if err != nil {
 		return nil, err
 	}
 
 	return conf, nil
 }
-
-/*
-	read data of the latest file from disk and push them into list
- */
-func (this *ConfManager) initList() error {
-	elems, err := this.disk.listOfLatestFile()
-	if err != nil {
-		return err
-	}
-
-	for _, e := range elems {
-		listElem := getElem(e.startId, e.buff)
-		err = this.mem.push(listElem)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-/*
-// ConfigManager is the interface for durable config management.
-// It provides functions to store and restrieve config.
-type ConfigManager interface {
-	// Store a new config at the log entry with specified index
-	PushConfig(logIndex uint64, conf *Config) error
-
-	// Return the config for specified log index
-	GetConfig(logIndex uint64) (*ConfigMeta, error)
-
-	// Return the last config
-	LastConfig() (*ConfigMeta, error)
-
-	// Delete the config metadata before and up to the given index,
-	// including the given index.
-	TruncateBefore(logIndex uint64) error
-
-	// Delete the config metadata after the given index,
-	// including the given index. And returns the config
-	// at the log entry right before the given index.
-	TruncateAfter(logIndex uint64) error
-}
-*/
-
@@ -1,6 +1,8 @@
 package conf
 
 import (
+	"context"
+	"errors"
 	"testing"
 	. "rafted/persist"
 	"modules/msgpack"
@@ -53,6 +55,35 @@ func pushConf(cm *ConfManager, startId int, idRange int, count int) error {
 	return nil
 }
 
+// options of the test stores: a few hundred configs go to several data files and most of them are only on disk
+func getTestOptions(tweak func(opts *Options)) Options {
+	opts := DefaultOptions()
+	opts.MaxRecordNum = 30
+	opts.NumPerTruncate = 10
+	opts.DataMaxFileSize = 16 * 1024
+	opts.SyncPolicy = SyncNever
+	if tweak != nil {
+		tweak(&opts)
+	}
+	return opts
+}
+
+// a new store at path of count configs, opened by the test options changed by tweak
+func getTestStore(path string, header string, count int, tweak func(opts *Options)) (*ConfManager, error) {
+	removeAll(path)
+	cm, err := GetConfManagerWithOptions(path, header, getTestOptions(tweak))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		cm.Close()
+		return nil, err
+	}
+
+	return cm, nil
+}
+
 func Test_GetConfManager(t *testing.T) {
 	cm, err := GetConfManager(DATAFILE_PATH, DATAFILE_HEADER)
 	if err != nil {
@@ -78,7 +109,7 @@ func Test_PushConfig(t *testing.T) {
 		return
 	}
 
-	elems, err := cm.mem.list()
+	elems, err := cm.store.mem.list()
 	if err != nil {
 		t.Error(err)
 		return
@@ -118,7 +149,7 @@ func Test_LastConfig(t *testing.T) {
 
 	confmeta, err := cm.LastConfig()
 	if err != nil {
-		if err != CM_NOTFOUND_ERR {
+		if !errors.Is(err, ErrNotFound) {
 			t.Fatal(err)
 			return
 		}
@@ -218,7 +249,7 @@ func Test_ListAfter(t *testing.T) {
 	// try to delete some elems in the range of [0, 57800] from memory ,pretend that memory space is not enough to keep them
 	// then call for elems in the range of [42164, ...]
 	// confmanager will read them from disk when find some elems are not exist in the memory, so we'll still get the right results
-	cm.mem.truncateBefore(57800)
+	cm.store.mem.truncateBefore(57800)
 	testIdxNew := 42164
 	metas1, err := cm.ListAfter(uint64(testIdxNew))
 	if err != nil {
@@ -241,6 +272,250 @@ func Test_ListAfter(t *testing.T) {
 }
 
 //TruncateBefore
+func Test_ListBetween(t *testing.T) {
+	count := 300
+	cm, err := getIteratorStore(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// [START_ID+10*ID_RANGE, START_ID+250*ID_RANGE], from disk and memory
+	from := uint64(START_ID + 10 * ID_RANGE + 7)
+	to := uint64(START_ID + 250 * ID_RANGE)
+	metas, err := cm.ListBetween(from, to)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(metas) != 241 {
+		t.Errorf("expected 241 configs, but get %d\n", len(metas))
+		return
+	}
+	for i, m := range metas {
+		startId := uint64(START_ID + (10 + i) * ID_RANGE)
+		if m.FromLogIndex != startId || m.ToLogIndex != startId + uint64(ID_RANGE) - 1 {
+			t.Errorf("ListBetween error, expected[%d, %d] but get [%d, %d]\n", startId, startId + uint64(ID_RANGE) - 1, m.FromLogIndex, m.ToLogIndex)
+			return
+		}
+	}
+
+	cm.store.opts.MaxResultNum = 100
+	if _, err = cm.ListBetween(from, to); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, but get %v\n", err)
+	}
+}
+
+func Test_ListPage(t *testing.T) {
+	count := 300
+	cm, err := getIteratorStore(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// page through all, 7 per page
+	next := uint64(0)
+	startIds := make([]uint64, 0)
+	for pages := 0; ; pages++ {
+		if pages > count {
+			t.Error("too many pages")
+			return
+		}
+		metas, nextIdx, err := cm.ListPage(next, 7)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(metas) > 7 {
+			t.Errorf("expected 7 configs at most, but get %d\n", len(metas))
+			return
+		}
+		for _, m := range metas {
+			startIds = append(startIds, m.FromLogIndex)
+		}
+		if nextIdx == 0 {
+			break
+		}
+		if nextIdx != metas[len(metas)-1].ToLogIndex + 1 {
+			t.Errorf("next page must be from %d, but get %d\n", metas[len(metas)-1].ToLogIndex + 1, nextIdx)
+			return
+		}
+		next = nextIdx
+	}
+	if len(startIds) != count {
+		t.Errorf("expected %d configs, but get %d\n", count, len(startIds))
+		return
+	}
+	for i, startId := range startIds {
+		if startId != uint64(START_ID + i * ID_RANGE) {
+			t.Errorf("config %d must be from %d, but get %d\n", i, START_ID + i * ID_RANGE, startId)
+			return
+		}
+	}
+
+	// limit is cut to MaxResultNum
+	cm.store.opts.MaxResultNum = 20
+	metas, _, err := cm.ListPage(0, 1000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(metas) != 20 {
+		t.Errorf("expected 20 configs, but get %d\n", len(metas))
+	}
+}
+
+func Test_ListBefore(t *testing.T) {
+	count := 300
+	cm, err := getIteratorStore(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// the last 10
+	metas, err := cm.ListBefore(UINT64_MAX, 10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(metas) != 10 || metas[0].ToLogIndex != UINT64_MAX {
+		t.Errorf("expected the last 10 configs, but get %d\n", len(metas))
+		return
+	}
+	for i, m := range metas {
+		startId := uint64(START_ID + (count - 1 - i) * ID_RANGE)
+		if m.FromLogIndex != startId {
+			t.Errorf("ListBefore error, config %d must be from %d, but get %d\n", i, startId, m.FromLogIndex)
+			return
+		}
+	}
+
+	// from disk, till the first one
+	metas, err = cm.ListBefore(uint64(START_ID + 20 * ID_RANGE + 1), 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(metas) != 21 || metas[20].FromLogIndex != uint64(START_ID) {
+		t.Errorf("expected 21 configs till the first one, but get %d\n", len(metas))
+	}
+
+	if _, err = cm.ListBefore(uint64(START_ID - 1), 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, but get %v\n", err)
+	}
+}
+
+// a log replayed pushes the configs again
+func Test_PushConfigReplay(t *testing.T) {
+	count := 100
+	cm, err := getIteratorStore(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// the old ones are on disk only
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error("replay must be a no-op:", err)
+		return
+	}
+	metas, err := cm.ListAfter(0)
+	if err != nil || len(metas) != count {
+		t.Errorf("expected %d configs after replaying, but get %d, %v\n", count, len(metas), err)
+		return
+	}
+
+	var conflict *ConflictError
+	id := START_ID + 5 * ID_RANGE
+	if err = cm.PushConfig(uint64(id), getConf(id + 1)); !errors.As(err, &conflict) || conflict.StartId != uint64(id) {
+		t.Errorf("another config at %d must conflict, but get %v\n", id, err)
+	}
+	if err = cm.PushConfig(uint64(id + 1), getConf(id + 1)); !errors.As(err, &conflict) || conflict.StartId != uint64(id) {
+		t.Errorf("a config inside the one from %d must conflict, but get %v\n", id, err)
+	}
+
+	// the ones truncated can't be told
+	first := uint64(START_ID + 10 * ID_RANGE)
+	if err = cm.TruncateBefore(first); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = cm.PushConfig(uint64(START_ID), getConf(START_ID)); !errors.As(err, &conflict) || conflict.StartId != first {
+		t.Errorf("a config before the first one must conflict, but get %v\n", err)
+	}
+
+	last, err := cm.LastConfig()
+	if err != nil || last.FromLogIndex != uint64(START_ID + (count - 1) * ID_RANGE) {
+		t.Errorf("the last config must not be changed, but get %v, %v\n", last, err)
+	}
+}
+
+// with Options.RaftOverwrite, a conflicting config truncates the ones from its log index on
+func Test_PushConfigOverwrite(t *testing.T) {
+	count := 100
+	overwrite := func(opts *Options) {
+		opts.RaftOverwrite = true
+	}
+	cm, err := getTestStore(DATAFILE_PATH, DATAFILE_HEADER, count, overwrite)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	events := cm.Watch(context.Background())
+
+	cases := []struct {
+		id   int
+		left int // configs left after pushing
+	}{
+		{START_ID + 50 * ID_RANGE, 51},     // from disk
+		{START_ID + 50 * ID_RANGE, 51},     // the last one
+		{START_ID + 20 * ID_RANGE + 5, 22}, // inside a config
+		{START_ID, 1},                      // the first one
+	}
+	for i, c := range cases {
+		// a config differs from the one of getConf
+		conf := getConf(c.id + i + 1)
+		if err = cm.PushConfig(uint64(c.id), conf); err != nil {
+			t.Error(err)
+			cm.Close()
+			return
+		}
+		metas, err := cm.ListAfter(0)
+		if err != nil || len(metas) != c.left {
+			t.Errorf("push at %d: expected %d configs, but get %d, %v\n", c.id, c.left, len(metas), err)
+			continue
+		}
+		last := metas[len(metas)-1]
+		if last.FromLogIndex != uint64(c.id) || !MultiAddrSliceEqual(last.Conf.Servers, conf.Servers) {
+			t.Errorf("push at %d: the last config is from %d\n", c.id, last.FromLogIndex)
+		}
+
+		if event, ok := receive(t, events).(TruncatedAfter); !ok || event.LogIndex != uint64(c.id - 1) {
+			t.Errorf("push at %d: expected TruncatedAfter %d, but get %#v\n", c.id, c.id - 1, event)
+		}
+		if event, ok := receive(t, events).(Pushed); !ok || event.Meta.FromLogIndex != uint64(c.id) {
+			t.Errorf("push at %d: expected Pushed, but get %#v\n", c.id, event)
+		}
+	}
+	cm.Close()
+
+	cm, err = GetConfManagerWithOptions(DATAFILE_PATH, DATAFILE_HEADER, getTestOptions(overwrite))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if metas, err := cm.ListAfter(0); err != nil || len(metas) != 1 || metas[0].FromLogIndex != uint64(START_ID) {
+		t.Errorf("expected the config from %d only after reopening, but get %d, %v\n", START_ID, len(metas), err)
+	}
+}
+
 func Test_TruncateBefore(t *testing.T) {
 	removeAll(DATAFILE_PATH)
 	cm, err := GetConfManager(DATAFILE_PATH, DATAFILE_HEADER)
@@ -271,7 +546,7 @@ func Test_TruncateBefore(t *testing.T) {
 	smallerIdx := 27384
 	_, err = cm.GetConfig(uint64(smallerIdx))
 	if err != nil {
-		if err != CM_NOTFOUND_ERR {
+		if !errors.Is(err, ErrNotFound) {
 			t.Error(err)
 			return
 		}
@@ -300,7 +575,7 @@ func Test_TruncateBefore(t *testing.T) {
 	anyIdx := 53290
 	_, err = cm.GetConfig(uint64(anyIdx))
 	if err != nil {
-		if err != CM_NOTFOUND_ERR {
+		if !errors.Is(err, ErrNotFound) {
 			t.Error(err)
 			return
 		}
@@ -310,7 +585,7 @@ func Test_TruncateBefore(t *testing.T) {
 	}
 
 //	// check mem
-//	_, err = cm.mem.get(27384)
+//	_, err = cm.store.mem.get(27384)
 //	if err != nil {
 //		if err != MEM_NOTFOUND_ERR {
 //			t.Error(err)
@@ -322,7 +597,7 @@ func Test_TruncateBefore(t *testing.T) {
 //	}
 //
 //	// check disk
-//	_, err = cm.disk.get(27384)
+//	_, err = cm.store.disk.get(27384)
 //	if err != nil {
 //		if err != DISK_NOTFOUND_ERR {
 //			t.Error(err)
@@ -334,6 +609,64 @@ func Test_TruncateBefore(t *testing.T) {
 //	}
 }
 
+// the record truncated before is across multiple blocks, it must be kept once and the records after it kept as well
+func Test_TruncateBeforeLargeRecord(t *testing.T) {
+	removeAll(DATAFILE_PATH)
+	opts := DefaultOptions()
+	opts.DataBlockSize = 64
+	opts.DataMaxFileSize = 64 * 1024
+	cm, err := GetConfManagerWithOptions(DATAFILE_PATH, DATAFILE_HEADER, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	count := 20
+	err = pushConf(cm, START_ID, ID_RANGE, count)
+	if err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+
+	// inside the record of START_ID + 5 * ID_RANGE
+	testIdx := uint64(START_ID + 5 * ID_RANGE + ID_RANGE / 2)
+	err = cm.TruncateBefore(testIdx)
+	cm.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// read from disk
+	cm, err = GetConfManagerWithOptions(DATAFILE_PATH, DATAFILE_HEADER, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	metas, err := cm.ListAfter(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(metas) != count - 5 {
+		t.Errorf("Test_TruncateBeforeLargeRecord: expected %d configs, but get %d\n", count - 5, len(metas))
+		return
+	}
+	for i, meta := range metas {
+		expected := uint64(START_ID + (i + 5) * ID_RANGE)
+		if i == 0 {
+			expected = testIdx
+		}
+		if meta.FromLogIndex != expected {
+			t.Errorf("Test_TruncateBeforeLargeRecord: config %d must be from %d, but get %d\n", i, expected, meta.FromLogIndex)
+			return
+		}
+	}
+}
+
 func Test_TruncateAfter(t *testing.T) {
 	removeAll(DATAFILE_PATH)
 	cm, err := GetConfManager(DATAFILE_PATH, DATAFILE_HEADER)
@@ -0,0 +1,26 @@
+package conf_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	conf "go-configmanager"
+	"go-configmanager/conftest"
+)
+
+var (
+	CONFORMANCE_DATA_PATH = "./conformance_data"
+)
+
+func Test_conformance(t *testing.T) {
+	conftest.Run(t, func(t *testing.T) conf.ConfigManager {
+		dir := filepath.Join(CONFORMANCE_DATA_PATH, t.Name())
+		os.RemoveAll(dir)
+
+		cm, err := conf.GetConfManager(dir, "conformance")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cm
+	})
+}
@@ -0,0 +1,303 @@
+/*
+	conftest is the conformance suite of conf.ConfigManager, it checks an implementation against the contract
+	described by the interface: the range each config covers, the boundaries of truncation and what is returned
+	when nothing is found.
+
+	Usage:
+	func Test_conformance(t *testing.T) {
+		conftest.Run(t, func(t *testing.T) conf.ConfigManager {
+			// return a new and empty ConfigManager, it is closed by the suite
+		})
+	}
+ */
+package conftest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	conf "go-configmanager"
+	. "rafted/persist"
+)
+
+// returns a new and empty ConfigManager for each case
+type Factory func(t *testing.T) conf.ConfigManager
+
+type testCase struct {
+	name string
+	fn   func(t *testing.T, cm conf.ConfigManager)
+}
+
+var cases = []testCase{
+	{"EmptyStore", testEmptyStore},
+	{"Ranges", testRanges},
+	{"OutOfOrder", testOutOfOrder},
+	{"ListAfter", testListAfter},
+	{"TruncateBefore", testTruncateBefore},
+	{"TruncateAfter", testTruncateAfter},
+	{"PushAfterTruncateAfter", testPushAfterTruncateAfter},
+	{"ManyConfigs", testManyConfigs},
+}
+
+// run all cases, each with a ConfigManager from factory
+func Run(t *testing.T, factory Factory) {
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			cm := factory(t)
+			if cm == nil {
+				t.Fatal("factory returns nil")
+			}
+			defer cm.Close()
+
+			c.fn(t, cm)
+		})
+	}
+}
+
+/********************* cases *************************************/
+
+func testEmptyStore(t *testing.T, cm conf.ConfigManager) {
+	if _, err := cm.LastConfig(); !errors.Is(err, ErrorConfigNotExist) {
+		t.Errorf("LastConfig of an empty store must return ErrorConfigNotExist, but get %v\n", err)
+	}
+	if _, err := cm.GetConfig(100); !errors.Is(err, ErrorConfigNotExist) {
+		t.Errorf("GetConfig of an empty store must return ErrorConfigNotExist, but get %v\n", err)
+	}
+	if _, err := cm.ListAfter(100); !errors.Is(err, ErrorConfigNotExist) {
+		t.Errorf("ListAfter of an empty store must return ErrorConfigNotExist, but get %v\n", err)
+	}
+}
+
+func testRanges(t *testing.T, cm conf.ConfigManager) {
+	if !push(t, cm, 10, 20, 30) {
+		return
+	}
+
+	expectConfig(t, cm, 10, 10, 19)
+	expectConfig(t, cm, 15, 10, 19)
+	expectConfig(t, cm, 19, 10, 19)
+	expectConfig(t, cm, 20, 20, 29)
+	expectConfig(t, cm, 30, 30, math.MaxUint64)
+	expectConfig(t, cm, 1000, 30, math.MaxUint64)
+	expectNotExist(t, cm, 9)
+	expectNotExist(t, cm, 0)
+	expectLast(t, cm, 30)
+}
+
+func testOutOfOrder(t *testing.T, cm conf.ConfigManager) {
+	if !push(t, cm, 10, 20) {
+		return
+	}
+
+	// replayed
+	if err := cm.PushConfig(20, NewConfig(20)); err != nil {
+		t.Errorf("push the same config at the same index again must be a no-op, but get %v\n", err)
+	}
+	if err := cm.PushConfig(20, NewConfig(21)); err == nil {
+		t.Error("push another config at the same index must fail")
+	}
+	if err := cm.PushConfig(15, NewConfig(15)); err == nil {
+		t.Error("push an index less than the last one must fail")
+	}
+
+	expectLast(t, cm, 20)
+	expectConfig(t, cm, 15, 10, 19)
+}
+
+func testListAfter(t *testing.T, cm conf.ConfigManager) {
+	if !push(t, cm, 10, 20, 30, 40) {
+		return
+	}
+
+	expectList(t, cm, 25, 20, 30, 40)
+	expectList(t, cm, 10, 10, 20, 30, 40)
+	expectList(t, cm, 40, 40)
+	expectList(t, cm, 1000, 40)
+}
+
+func testTruncateBefore(t *testing.T, cm conf.ConfigManager) {
+	if !push(t, cm, 10, 20, 30) {
+		return
+	}
+
+	if err := cm.TruncateBefore(15); err != nil {
+		t.Error(err)
+		return
+	}
+	expectNotExist(t, cm, 14)
+	expectConfigPushedAt(t, cm, 15, 15, 19, 10)
+	expectConfig(t, cm, 20, 20, 29)
+	expectLast(t, cm, 30)
+
+	// at the start of a config
+	if err := cm.TruncateBefore(20); err != nil {
+		t.Error(err)
+		return
+	}
+	expectNotExist(t, cm, 19)
+	expectConfig(t, cm, 20, 20, 29)
+	expectList(t, cm, 20, 20, 30)
+}
+
+func testTruncateAfter(t *testing.T, cm conf.ConfigManager) {
+	if !push(t, cm, 10, 20, 30, 40) {
+		return
+	}
+
+	if err := cm.TruncateAfter(25); err != nil {
+		t.Error(err)
+		return
+	}
+	expectLast(t, cm, 20)
+	expectConfig(t, cm, 10, 10, 19)
+	expectConfig(t, cm, 25, 20, math.MaxUint64)
+	expectConfig(t, cm, 35, 20, math.MaxUint64)
+	expectList(t, cm, 10, 10, 20)
+
+	// at the start of a config
+	if err := cm.TruncateAfter(10); err != nil {
+		t.Error(err)
+		return
+	}
+	expectLast(t, cm, 10)
+	expectConfig(t, cm, 20, 10, math.MaxUint64)
+}
+
+func testPushAfterTruncateAfter(t *testing.T, cm conf.ConfigManager) {
+	if !push(t, cm, 10, 20, 30) {
+		return
+	}
+	if err := cm.TruncateAfter(25); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the log is overwritten from 26
+	if !push(t, cm, 26) {
+		return
+	}
+	expectConfig(t, cm, 25, 20, 25)
+	expectConfig(t, cm, 30, 26, math.MaxUint64)
+	expectLast(t, cm, 26)
+}
+
+// more configs than an implementation may keep in memory
+func testManyConfigs(t *testing.T, cm conf.ConfigManager) {
+	count := uint64(3000)
+	for i := uint64(1); i <= count; i++ {
+		if err := cm.PushConfig(i * 10, NewConfig(i * 10)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for _, i := range []uint64{1, 2, count / 2, count - 1} {
+		expectConfig(t, cm, i * 10 + 5, i * 10, i * 10 + 9)
+	}
+	expectConfig(t, cm, count * 10 + 5, count * 10, math.MaxUint64)
+
+	list, err := cm.ListAfter(10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if uint64(len(list)) != count {
+		t.Errorf("ListAfter(10) returns %d configs, expected %d\n", len(list), count)
+	}
+}
+
+/********************* helpers *************************************/
+
+// a config distinguished by id
+func NewConfig(id uint64) *Config {
+	return &Config{
+		Servers: &ServerAddressSlice{
+			Addresses: []*ServerAddress{
+				{Addresses: []*Address{{Isp: "isp", Protocol: "tcp", IP: "127.0.0.1", Port: uint16(id)}}},
+			},
+		},
+		NewServers: &ServerAddressSlice{
+			Addresses: []*ServerAddress{
+				{Addresses: []*Address{{Isp: "isp", Protocol: "tcp", IP: fmt.Sprintf("10.0.%d.%d", id / 256 % 256, id % 256), Port: uint16(id + 1)}}},
+			},
+		},
+	}
+}
+
+func configEqual(a, b *Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return MultiAddrSliceEqual(a.Servers, b.Servers) && MultiAddrSliceEqual(a.NewServers, b.NewServers)
+}
+
+func push(t *testing.T, cm conf.ConfigManager, ids ...uint64) bool {
+	for _, id := range ids {
+		if err := cm.PushConfig(id, NewConfig(id)); err != nil {
+			t.Errorf("push %d failed:%s\n", id, err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// the config covers id must be [from, to], and it is the one pushed at from
+func expectConfig(t *testing.T, cm conf.ConfigManager, id uint64, from uint64, to uint64) {
+	expectConfigPushedAt(t, cm, id, from, to, from)
+}
+
+// same as expectConfig, but the config was pushed at pushed, it starts from somewhere else after TruncateBefore
+func expectConfigPushedAt(t *testing.T, cm conf.ConfigManager, id uint64, from uint64, to uint64, pushed uint64) {
+	meta, err := cm.GetConfig(id)
+	if err != nil {
+		t.Errorf("GetConfig(%d) failed:%v\n", id, err)
+		return
+	}
+	if meta.FromLogIndex != from || meta.ToLogIndex != to {
+		t.Errorf("GetConfig(%d) returns [%d, %d], expected [%d, %d]\n", id, meta.FromLogIndex, meta.ToLogIndex, from, to)
+	}
+	if !configEqual(meta.Conf, NewConfig(pushed)) {
+		t.Errorf("GetConfig(%d) returns a config different from the one pushed\n", id)
+	}
+}
+
+func expectNotExist(t *testing.T, cm conf.ConfigManager, id uint64) {
+	if meta, err := cm.GetConfig(id); !errors.Is(err, ErrorConfigNotExist) {
+		t.Errorf("GetConfig(%d) must return ErrorConfigNotExist, but get %v, %v\n", id, meta, err)
+	}
+}
+
+func expectLast(t *testing.T, cm conf.ConfigManager, from uint64) {
+	meta, err := cm.LastConfig()
+	if err != nil {
+		t.Errorf("LastConfig failed:%v\n", err)
+		return
+	}
+	if meta.FromLogIndex != from || meta.ToLogIndex != math.MaxUint64 {
+		t.Errorf("LastConfig returns [%d, %d], expected [%d, %d]\n", meta.FromLogIndex, meta.ToLogIndex, from, uint64(math.MaxUint64))
+	}
+}
+
+// ListAfter(id) must return the configs start from froms
+func expectList(t *testing.T, cm conf.ConfigManager, id uint64, froms ...uint64) {
+	list, err := cm.ListAfter(id)
+	if err != nil {
+		t.Errorf("ListAfter(%d) failed:%v\n", id, err)
+		return
+	}
+	if len(list) != len(froms) {
+		t.Errorf("ListAfter(%d) returns %d configs, expected %d\n", id, len(list), len(froms))
+		return
+	}
+	for i, meta := range list {
+		to := uint64(math.MaxUint64)
+		if i + 1 < len(froms) {
+			to = froms[i + 1] - 1
+		}
+		if meta.FromLogIndex != froms[i] || meta.ToLogIndex != to {
+			t.Errorf("ListAfter(%d)[%d] is [%d, %d], expected [%d, %d]\n", id, i, meta.FromLogIndex, meta.ToLogIndex, froms[i], to)
+		}
+	}
+}
@@ -7,14 +7,19 @@ index filename:
 	path/header_startId.idx
 
 file content fmt: [record][record]...EOF
-	[record] = start_id(8 byte)end_id(8byte)buff_len(8 byte)buff(buff_len byte) 0 0 0 0 0 (expand to 512 bytes or n * 512 bytes)
+	[record] = start_id(8 byte)end_id(8byte)buff_len(8 byte)crc(4 byte)term(8 byte)buff(buff_len byte) 0 0 0 0 0 (expand to 512 bytes or n * 512 bytes)
+	see record.go for details
 
-index file content fmt: [file_meta][section_index][section_index]...EOF
-	[file_meta] = [data_file_size(8 byte)][record_num(8 byte)]
+index file content fmt: [meta_slot A][meta_slot B][section_index][section_index]...EOF
+	[meta_slot] = [magic(8 byte)][generation(8 byte)]
+	              [data_file_size(8 byte)][record_num(8 byte)]
 	              [last_record_pos(8 byte)][minId(8 byte)]
-	              [maxId(8 byte)][record_num_level(4 byte)]
-	              [size_level(8 byte)]
+	              [maxId(8 byte)][record_num_level(8 byte)]
+	              [size_level(8 byte)][crc(4 byte)][0(4 byte)]
 	[section_index] = start_id(8 byte)pos(8 byte) // save the start position of the first record in each section
+	ps: the meta is written after each change, to slot A and slot B in turn (generation % 2), so a torn write only
+		breaks one of them. the valid slot (magic and crc checked) with the larger generation wins. when opening, the
+		index is checked against its data file, and rebuilt from the data file if it is broken or stale.
 	ps: size of the index file will be header + record_num * (8 + 8) = 16 (record_num + 1) . Data file size must be less than 1GB,
 		so record_num <= 1GB / 512byte (2097152B), then index file size must be less than (32M + header)
 
@@ -59,10 +64,12 @@ import (
 	"encoding/binary"
 	"io"
 	"sort"
-	"modules/glog"
+	"io/ioutil"
+	"hash/crc32"
 )
 
 /****************** constants *******************************/
+// FILE_NAME_NUMLEN, DATA_MAX_FILE_SIZE, DATA_BLOCK_SIZE and IDX_MAX_RECORD_PER_SECTION are the defaults of Options, see options.go
 var (
 	// FILENAME
 	FILE_NAME_NUMLEN = 10
@@ -79,29 +86,65 @@ var (
 	DATA_STARTID_POS  uint64   = 0
 	DATA_ENDID_POS  uint64     = DATA_STARTID_POS + ID_LEN
 	DATA_BUFFLEN_POS  uint64   = DATA_ENDID_POS + ID_LEN
-	DATA_BUFF_POS  uint64      = DATA_BUFFLEN_POS + SIZE_LEN
-	DATA_HEAD_SIZE  uint64     = DATA_BUFF_POS
+	DATA_CRC_POS  uint64       = DATA_BUFFLEN_POS + SIZE_LEN
+	CRC_LEN  uint64            = 4 // uint32
+	DATA_TERM_POS  uint64      = DATA_CRC_POS + CRC_LEN
+	TERM_LEN  uint64           = 8 // uint64
+	DATA_HEAD_SIZE_V1  uint64  = DATA_CRC_POS // header of stores created before crc was introduced
+	DATA_HEAD_SIZE_V2  uint64  = DATA_TERM_POS // header of stores created before term was introduced
+	DATA_HEAD_SIZE  uint64     = DATA_TERM_POS + TERM_LEN
 
 	// for index
 	IDX_MAX_SECTION_SIZE  uint64        = 1024 * 1024 // 1MB, each section must less than or equal to this size
 	IDX_MAX_RECORD_PER_SECTION   uint64 = 1000        // each section must have no more than MAX_RECORD_PER_SECTION recordsfileMeta
-	IDX_DATAFILESIZE_POS  uint64        = 0
+	IDX_SLOT_MAGIC  uint64              = 0x434f4e46494458 // "CONFIDX"
+	IDX_MAGIC_POS  uint64               = 0 // positions in a meta slot
+	IDX_GENERATION_POS  uint64          = IDX_MAGIC_POS + NUM_LEN
+	IDX_DATAFILESIZE_POS  uint64        = IDX_GENERATION_POS + NUM_LEN
 	IDX_RECORDNUM_POS  uint64           = IDX_DATAFILESIZE_POS + SIZE_LEN
 	IDX_LASTRECORDPOS_POS  uint64       = IDX_RECORDNUM_POS + NUM_LEN
 	IDX_MINID_POS  uint64               = IDX_LASTRECORDPOS_POS + POS_LEN
 	IDX_MAXID_POS  uint64               = IDX_MINID_POS + ID_LEN
 	IDX_RECORDLEVEL_POS  uint64         = IDX_MAXID_POS + ID_LEN
 	IDX_SIZELEVEL_POS  uint64           = IDX_RECORDLEVEL_POS + NUM_LEN
-	IDX_HEADER_SIZE  uint64             = IDX_SIZELEVEL_POS + SIZE_LEN
+	IDX_SLOT_CRC_POS  uint64            = IDX_SIZELEVEL_POS + SIZE_LEN
+	IDX_SLOT_SIZE  uint64               = IDX_SLOT_CRC_POS + CRC_LEN + 4 // padded to 8 bytes
+	IDX_SLOT_NUM  uint64                = 2 // slot A and slot B
+	IDX_HEADER_SIZE  uint64             = IDX_SLOT_SIZE * IDX_SLOT_NUM
 
 	// for each section_index of index file
 	SI_STARTID_POS  uint64 = 0
 	SI_POS_POS  uint64     = 0 + POS_LEN
 	SI_SIZE  uint64        = ID_LEN + POS_LEN
+
+	// for the meta file of a store, which keeps the options that decide the layout of the files
+	META_MAGIC  uint64             = 0x434f4e464d455441 // "CONFMETA"
+	META_FORMAT_VERSION  uint64    = 3 // 1: no crc in records, 2: crc in records, 3: crc and term in records
+	META_MAGIC_POS  uint64         = 0
+	META_VERSION_POS  uint64       = META_MAGIC_POS + NUM_LEN
+	META_BLOCKSIZE_POS  uint64     = META_VERSION_POS + NUM_LEN
+	META_NAMENUMLEN_POS  uint64    = META_BLOCKSIZE_POS + SIZE_LEN
+	META_CODEC_POS  uint64         = META_NAMENUMLEN_POS + NUM_LEN // the meta files written before have no codec
+	META_OLDVERSION_POS  uint64    = META_CODEC_POS + NUM_LEN // the ones written before the upgrade have no old format
+	META_UPGRADEFROM_POS  uint64   = META_OLDVERSION_POS + NUM_LEN
+	META_SIZE  uint64              = META_UPGRADEFROM_POS + ID_LEN
+
+	// layout of the stores created before the meta file was introduced
+	LEGACY_FORMAT_VERSION  uint64 = 1
+	LEGACY_BLOCK_SIZE  uint64 = 512
+	LEGACY_FILE_NAME_NUMLEN   = 10
+	LEGACY_CODEC_ID  uint64   = CODEC_ID_MSGPACK // also for the meta files without codec
 )
 
 var (
-	DISK_NOTFOUND_ERR = errors.New("diskio.go:NOT FOUND IN DISK")
+	// kept for the comparisons inside, errors.Is(DISK_NOTFOUND_ERR, ErrNotFound) is true
+	DISK_NOTFOUND_ERR = fmt.Errorf("diskio.go:NOT FOUND IN DISK: %w", ErrNotFound)
+
+	// the tail of the buff is not a complete record, read more
+	errNeedMoreBlocks = errors.New("need more blocks")
+
+	// a file not opened is passed in, a bug of the caller
+	errNilFile = errors.New("file ptr is nil")
 )
 
 /***********************  struct define **********************/
@@ -109,9 +152,17 @@ var (
 type diskIo struct {
 	path           string
 	header         string
+	opts           *Options
+	format         *recordFormat // decided by the meta file of the store, the new segments are written by it
+	oldFormat      *recordFormat // of the segments starting before upgradeFrom, nil if none
+	upgradeFrom    uint64
+	codec          Codec         // decided by the meta file of the store
 	latestFileName string // last file
 	latestFilePtr *os.File
 	idxMgr *indexMgr
+	recovery *RecoveryReport // what was dropped by init, nil if nothing
+	lockFile *os.File // see lock.go
+	validSizes map[string]uint64 // read-only: a data file is read till here, the writer may be appending after it
 }
 
 type indexMgr struct {
@@ -119,10 +170,12 @@ type indexMgr struct {
 }
 
 type indexInfo struct {
+	opts       *Options
 	filePtr    *os.File
 	meta       fileMeta
 	indexs     []*indexElem
 	waterLevel waterLevelInfo
+	generation uint64 // generation of the last meta written, see writeMetaToDisk
 }
 
 type fileMeta struct {
@@ -141,6 +194,7 @@ type indexElem struct {
 type diskElem struct {
 	startId uint64
 	endId   uint64
+	term    uint64 // raft term it was pushed in, 0 if not told or the store has no term
 	buff    []byte
 }
 
@@ -163,6 +217,20 @@ type item struct {
 /*************** public funtions for use *******************/
 
 func getDiskIO(path, header string) (*diskIo, error) {
+	opts := DefaultOptions()
+	return getDiskIOWithOptions(path, header, &opts)
+}
+
+// Options.Logger with the header of the store
+func (this *diskIo) log() *storeLogger {
+	return getStoreLogger(this.opts, this.header)
+}
+
+func getDiskIOWithOptions(path, header string, opts *Options) (*diskIo, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
@@ -172,15 +240,18 @@ func getDiskIO(path, header string) (*diskIo, error) {
 	disk := &diskIo{
 		path: absPath,
 		header: header,
+		opts: opts,
 		latestFileName: "",
 		latestFilePtr: nil,
 		idxMgr: &indexMgr {
 			mapIndex: make(map[string]*indexInfo),
 		},
+		validSizes: make(map[string]uint64),
 	}
 
 	err = disk.init()
 	if err != nil {
+		disk.close()
 		return nil, err
 	}
 
@@ -197,17 +268,65 @@ func (this *diskIo) close() {
 		// write meta
 		indexInfo.writeMetaToDisk()
 
-		indexInfo.filePtr.Close()
+		if indexInfo.filePtr != nil {
+			indexInfo.filePtr.Close()
+		}
 	}
 
 	// close file
 	if this.latestFilePtr != nil {
 		this.latestFilePtr.Close()
 	}
+
+	this.unlock()
+}
+
+// flush the latest data file and its index to disk
+func (this *diskIo) sync() error {
+	if !this.needSync() || this.latestFilePtr == nil {
+		return nil
+	}
+
+	if err := this.opts.injectFault(FAULT_SYNC); err != nil {
+		return err
+	}
+	if err := this.latestFilePtr.Sync(); err != nil {
+		this.log().error("sync", "sync data file failed", LOG_KEY_FILE, this.latestFileName, LOG_KEY_ERROR, err)
+		return err
+	}
+
+	if indexInfo := this.idxMgr.mapIndex[this.latestFileName]; indexInfo != nil {
+		if err := indexInfo.filePtr.Sync(); err != nil {
+			this.log().error("sync", "sync index file failed", LOG_KEY_FILE, dataFileNameToIdxFileName(this.latestFileName), LOG_KEY_ERROR, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *diskIo) needSync() bool {
+	return this.opts.SyncPolicy.mode != syncModeNever
 }
 
 // append an element to file
 func (this *diskIo) append(logIndex uint64, buff []byte) error {
+	return this.appendWithTerm(logIndex, 0, buff)
+}
+
+// append an element of the raft term to file
+func (this *diskIo) appendWithTerm(logIndex uint64, term uint64, buff []byte) error {
+	if this.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	// a record never spans two data files
+	if recordSize := this.format.recordSize(uint64(len(buff))); recordSize > this.opts.DataMaxFileSize {
+		return &TooLargeError{
+			What: fmt.Sprintf("record of log index %d is %d bytes", logIndex, recordSize),
+			Limit: this.opts.DataMaxFileSize,
+		}
+	}
+
 	// compared with last startId
 	err := this.checkIdValid(logIndex)
 	if err != nil {
@@ -226,11 +345,17 @@ func (this *diskIo) append(logIndex uint64, buff []byte) error {
 	}
 
 	//append the the new one
-	if err := this.appendElem(logIndex, buff); err != nil {
+	if err := this.opts.injectFault(FAULT_APPEND_DATA); err != nil {
+		return err
+	}
+	if err := this.appendElem(logIndex, term, buff); err != nil {
 		return err
 	}
 
 	//update index file
+	if err := this.opts.injectFault(FAULT_APPEND_INDEX); err != nil {
+		return err
+	}
 	if err := this.updateLastIndex(uint64(1), logIndex, uint64(dataLen)); err != nil {
 		return err
 	}
@@ -240,22 +365,40 @@ func (this *diskIo) append(logIndex uint64, buff []byte) error {
 
 // get the last elem
 func (this *diskIo) last() (uint64, []byte, error) {
+	elem, err := this.lastElem()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return elem.startId, elem.buff, nil
+}
+
+func (this *diskIo) lastElem() (*diskElem, error) {
 	lastFileName := this.getLatestFileName()
 	// if no data in the disk
 	if lastFileName == "" {
-		return uint64(0), nil, DISK_NOTFOUND_ERR
+		return nil, DISK_NOTFOUND_ERR
 	}
 
 	indexInfo := this.idxMgr.mapIndex[lastFileName]
 	lastElemPos := indexInfo.meta.lastRecordPos
 	lastFile := this.latestFilePtr
 
-	startId, _, buff, err := getElemByPos(lastFile, lastElemPos)
-	return startId, buff, err
+	return getElemByPos(lastFile, lastElemPos, this.formatOf(lastFileName))
 }
 
 // return startId, endId, buff
 func (this *diskIo) get(id uint64) (uint64, uint64, []byte, error) {
+	elem, err := this.getElem(id)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return elem.startId, elem.endId, elem.buff, nil
+}
+
+// the elem covering id, endId of the last one is 0
+func (this *diskIo) getElem(id uint64) (*diskElem, error) {
 	// find target file
 	fileName := ""
 	var indexInfo *indexInfo = nil
@@ -267,29 +410,25 @@ func (this *diskIo) get(id uint64) (uint64, uint64, []byte, error) {
 		}
 	}
 	if fileName == "" || indexInfo == nil {
-		return 0, 0, nil, DISK_NOTFOUND_ERR
+		return nil, DISK_NOTFOUND_ERR
 	}
 
 	// find the index pos
 	startPos, endPos, err := indexInfo.findIndexPosById(id)
 	if err != nil {
-		return 0, 0, nil, err
+		return nil, err
 	}
 	//fmt.Println("find pos: id, start, end:", id, startPos, endPos)
 
 	// get file pointer
-	dataFile, err := os.OpenFile(fileName, os.O_RDONLY, 0)
+	dataFile, err := openDataFile(fileName, id)
 	if err != nil {
-		return 0, 0, nil, err
+		return nil, err
 	}
+	defer dataFile.Close()
 
 	// read from disk
-	startId, endId, buff, err := getElemByIdAndIndex(dataFile, id, startPos, endPos)
-	if err != nil {
-		return 0, 0, nil, err
-	}
-
-	return startId, endId, buff, nil
+	return getElemByIdAndIndex(dataFile, id, startPos, endPos, this.formatOf(fileName))
 }
 
 func (this *diskIo) listAfter(id uint64) ([]*diskElem, error) {
@@ -312,13 +451,13 @@ func (this *diskIo) listAfter(id uint64) ([]*diskElem, error) {
 				}
 
 				// open the data file
-				file, err := os.OpenFile(filename, os.O_RDONLY, 0)
+				file, err := openDataFile(filename, id)
 				if err != nil {
-					return nil, errors.New("OpenFile failed in listAfter:"+err.Error())
+					return nil, err
 				}
 				defer file.Close()
 				//fmt.Println("test!! startPos, filename:", startPos, filename)
-				elems, err := getElemsAfterIdByIndex(file, id, startPos)
+				elems, err := getElemsAfterIdByIndex(file, id, startPos, indexInfo.meta.dataFileSize, this.formatOf(filename))
 				if err != nil {
 					return nil, err
 				}
@@ -330,13 +469,13 @@ func (this *diskIo) listAfter(id uint64) ([]*diskElem, error) {
 			//fmt.Println("total!!!!:", filename)
 
 			// open the data file
-			file, err := os.OpenFile(filename, os.O_RDONLY, 0)
+			file, err := openDataFile(filename, id)
 			if err != nil {
-				return nil, errors.New("OpenFile failed in listAfter:"+err.Error())
+				return nil, err
 			}
 			defer file.Close()
 			//fmt.Println("test!! startPos, filename:", startPos, filename)
-			elems, err := getElemsFromFile(file)
+			elems, err := getElemsFromFile(file, indexInfo.meta.dataFileSize, this.formatOf(filename))
 			if err != nil {
 				return nil, err
 			}
@@ -356,6 +495,7 @@ func (this *diskIo) listBetween(startId uint64, endId uint64) ([]*diskElem, erro
 	sorter := newIdxMgrSorter(this)
 	sort.Sort(sorter)
 
+	var err error
 	for _, it := range sorter.items {
 		filename := it.fileName
 		indexInfo := it.indexInfo
@@ -368,13 +508,13 @@ func (this *diskIo) listBetween(startId uint64, endId uint64) ([]*diskElem, erro
 				//fmt.Println("total!!!", filename)
 
 				// open the data file
-				file, err := os.OpenFile(filename, os.O_RDONLY, 0)
+				file, err := openDataFile(filename, startId)
 				if err != nil {
-					return nil, errors.New("OpenFile failed in listAfter:"+err.Error())
+					return nil, err
 				}
 				defer file.Close()
 				//fmt.Println("test!! startPos, filename:", startPos, filename)
-				elems, err := getElemsFromFile(file)
+				elems, err := getElemsFromFile(file, indexInfo.meta.dataFileSize, this.formatOf(filename))
 				if err != nil {
 					return nil, err
 				}
@@ -383,26 +523,33 @@ func (this *diskIo) listBetween(startId uint64, endId uint64) ([]*diskElem, erro
 				//fmt.Println("len is now:", len(result))
 			} else {
 				//fmt.Println("part!!!", filename)
-				// find the index pos
-				startIdStartPos, startIdEndPos, err := indexInfo.findIndexPosById(startId)
-				if err != nil && err != DISK_NOTFOUND_ERR {
-					return nil, err
+				// find the index pos, read from the section of startId to the end of the section of endId
+				startPos := uint64(0)
+				if startId > indexInfo.meta.minId {
+					startPos, _, err = indexInfo.findIndexPosById(startId)
+					if err != nil && err != DISK_NOTFOUND_ERR {
+						return nil, err
+					}
 				}
 
-				endIdStartPos, endIdEndPos, err := indexInfo.findIndexPosById(endId)
-				if err != nil && err != DISK_NOTFOUND_ERR {
-					return nil, err
+				endPos := indexInfo.meta.dataFileSize
+				if endId < indexInfo.meta.maxId {
+					_, endPos, err = indexInfo.findIndexPosById(endId)
+					if err != nil {
+						if err != DISK_NOTFOUND_ERR {
+							return nil, err
+						}
+						endPos = indexInfo.meta.dataFileSize
+					}
 				}
 
-				//fmt.Println(startIdStartPos, startIdEndPos, endIdStartPos, endIdEndPos)
 				// open the data file
-				file, err := os.OpenFile(filename, os.O_RDONLY, 0)
+				file, err := openDataFile(filename, startId)
 				if err != nil {
-					return nil, errors.New("OpenFile failed in listAfter:"+err.Error())
+					return nil, err
 				}
 				defer file.Close()
-				//fmt.Println("test!! startPos, filename:", startPos, filename)
-				elems, err := getElemsBetweenIdByIndex(file, startId, endId, startIdStartPos, startIdEndPos, endIdStartPos, endIdEndPos)
+				elems, err := getElemsBetweenIdByIndex(file, startId, endId, startPos, endPos, this.formatOf(filename))
 				if err != nil {
 					return nil, err
 				}
@@ -416,6 +563,112 @@ func (this *diskIo) listBetween(startId uint64, endId uint64) ([]*diskElem, erro
 	return result, nil
 }
 
+/*
+	read the section of the index which has the record covering id, or the first record after id if no one covers it,
+	so that at most a section is read at a time
+	@return []*diskElem: that record and the ones after it in the section
+ */
+func (this *diskIo) listSection(id uint64) ([]*diskElem, error) {
+	// sort files by startId
+	sorter := newIdxMgrSorter(this)
+	sort.Sort(sorter)
+
+	for _, it := range sorter.items {
+		fileName := it.fileName
+		indexInfo := it.indexInfo
+
+		// the last record of the latest file covers all after it
+		if indexInfo.meta.recordNum == 0 || (indexInfo.meta.maxId < id && fileName != this.latestFileName) {
+			continue
+		}
+		if indexInfo.meta.minId > id {
+			id = indexInfo.meta.minId
+		}
+
+		elems, err := this.readSectionById(fileName, indexInfo, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// skip the ones before the hit
+		result := make([]*diskElem, 0, len(elems))
+		for _, elem := range elems {
+			if elem.endId >= id || elem.endId == 0 {
+				result = append(result, elem)
+			}
+		}
+
+		return result, nil
+	}
+
+	return nil, DISK_NOTFOUND_ERR
+}
+
+/*
+	same as listSection, but backwards
+	@return []*diskElem: the record covering id and the ones before it in the section, from large to small
+ */
+func (this *diskIo) listSectionBefore(id uint64) ([]*diskElem, error) {
+	// sort files by startId
+	sorter := newIdxMgrSorter(this)
+	sort.Sort(sorter)
+
+	for i := len(sorter.items) - 1; i >= 0; i-- {
+		fileName := sorter.items[i].fileName
+		indexInfo := sorter.items[i].indexInfo
+		if indexInfo.meta.recordNum == 0 || indexInfo.meta.minId > id {
+			continue
+		}
+
+		elems, err := this.readSectionById(fileName, indexInfo, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// skip the ones after the hit
+		result := make([]*diskElem, 0, len(elems))
+		for j := len(elems) - 1; j >= 0; j-- {
+			if elems[j].startId <= id {
+				result = append(result, elems[j])
+			}
+		}
+
+		return result, nil
+	}
+
+	return nil, DISK_NOTFOUND_ERR
+}
+
+// read all the records of the section which has the record covering id
+func (this *diskIo) readSectionById(fileName string, indexInfo *indexInfo, id uint64) ([]*diskElem, error) {
+	startPos, endPos, err := indexInfo.findIndexPosById(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := openDataFile(fileName, id)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buff, err := readSection(file, startPos, endPos)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*diskElem, 0)
+	err = this.formatOf(fileName).scanRecords(buff, fileName, startPos, func(elem *diskElem, pos uint64) bool {
+		result = append(result, elem)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 /*
 	list all elems int the latest file
  */
@@ -424,7 +677,8 @@ func (this *diskIo) listOfLatestFile() ([]*diskElem, error) {
 		return nil, nil
 	}
 
-	elems, err := getElemsAfterIdByIndex(this.latestFilePtr, 0, 0)
+	dataFileSize := this.idxMgr.mapIndex[this.latestFileName].meta.dataFileSize
+	elems, err := getElemsAfterIdByIndex(this.latestFilePtr, 0, 0, dataFileSize, this.formatOf(this.latestFileName))
 	if err != nil {
 		return nil, err
 	}
@@ -434,19 +688,14 @@ func (this *diskIo) listOfLatestFile() ([]*diskElem, error) {
 
 // truncateBefore id, result: [id, maxId]
 func (this *diskIo) truncateBefore(id uint64) error {
+	if this.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	journal := &truncateJournal{op: JOURNAL_OP_BEFORE, id: id}
 	for fileName, indexInfo := range this.idxMgr.mapIndex {
 		if indexInfo.meta.maxId < id && indexInfo.meta.maxId != 0 { // maxId < id, delete all records
-			err := os.Remove(fileName)
-			if err != nil {
-				glog.Errorf("Remove %s failed:%s\n", fileName, err.Error())
-				return err
-			}
-
-			// delete index file
-			err = this.deleteIndexByFile(fileName)
-			if err != nil {
-				return err
-			}
+			journal.removes = append(journal.removes, filepath.Base(fileName))
 		} else if indexInfo.meta.minId >= id { // minId > id, keep all records
 			continue
 		} else { // delete front part, keeps [id, maxId]
@@ -460,37 +709,28 @@ func (this *diskIo) truncateBefore(id uint64) error {
 			// update the elem(it bacame the minimum elem)
 			elem.startId = id
 
-			newFileName, err := this.truncateFileBeforeId(fileName, id, elem, pos)
-			if err != nil {
-				return err
-			}
-
-			// delete old file
-			err = os.Remove(fileName)
-			if err != nil {
-				return err
-			}
-
-			// delete old index
-			err = this.deleteIndexByFile(fileName)
-			if err != nil {
-				return err
-			}
-
-			// build new index
-			err = this.buildIndexByFile(newFileName)
+			// the new file is written to a temp file, and replaces the old one when committing
+			tmpFileName, err := this.truncateFileBeforeId(fileName, id, elem, pos)
 			if err != nil {
 				return err
 			}
+			journal.renames = append(journal.renames, journalRename{
+				from: filepath.Base(tmpFileName),
+				to: filepath.Base(this.getFileNameByStartId(id)),
+			})
+			journal.removes = append(journal.removes, filepath.Base(fileName))
 		}
 	}
 
-	err := this.updateLastFile()
-	if err != nil {
+	if len(journal.renames) == 0 && len(journal.removes) == 0 {
+		return nil
+	}
+
+	if err := this.commitTruncate(journal); err != nil {
 		return err
 	}
 
-	return nil
+	return this.updateLastFile()
 }
 
 /*
@@ -498,67 +738,54 @@ func (this *diskIo) truncateBefore(id uint64) error {
 	@return *diskElem: the latest elem after truncate
  */
 func (this *diskIo) truncateAfter(id uint64) error {
-	//var resultElem *diskElem = nil
+	if this.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	journal := &truncateJournal{op: JOURNAL_OP_AFTER, id: id}
 	for fileName, indexInfo := range this.idxMgr.mapIndex {
 		if indexInfo.meta.minId > id { // minId > id, delete all records
-			err := os.Remove(fileName)
-			if err != nil {
-				//return nil, err
-				return err
-			}
-
-			// delete index file
-			err = this.deleteIndexByFile(fileName)
-			if err != nil {
-				//return nil, err
-				return err
-			}
+			journal.removes = append(journal.removes, filepath.Base(fileName))
 		} else if indexInfo.meta.maxId < id && indexInfo.meta.maxId != 0 { // maxId < id && maxId != 0, keep all records
 			continue
 		} else { // delete tail part, keeps [minId, id]
 			// get exactly pos
 			elem, pos, err := this.getStartPosById(fileName, id)
 			if err != nil {
-				//return nil, err
 				return err
 			}
-			//resultElem = elem
 			//fmt.Printf("getStartPosById, pos:%x\n", pos)
 			//fmt.Println("elem is :", elem.startId, elem.endId, string(elem.buff))
 
-			// update the elem's endId
-			elem.endId = id
-
-			err = this.truncateFileAfterElem(fileName, elem, pos)
-			if err != nil {
-				//return nil, err
-				return err
+			// nothing to truncate if it is the last elem already
+			if elem.endId == 0 && pos + this.formatOf(fileName).recordSize(uint64(len(elem.buff))) == indexInfo.meta.dataFileSize {
+				continue
 			}
 
-			// delete old index
-			err = this.deleteIndexByFile(fileName)
-			if err != nil {
-				//return nil, err
-				return err
-			}
+			// the elem becomes the last one
+			elem.endId = 0
 
-			// build new index
-			err = this.buildIndexByFile(fileName)
+			// the truncated file is written to a temp file, and replaces the old one when committing
+			tmpFileName, err := this.truncateFileAfterElem(fileName, elem, pos)
 			if err != nil {
-				//return nil, err
 				return err
 			}
+			journal.renames = append(journal.renames, journalRename{
+				from: filepath.Base(tmpFileName),
+				to: filepath.Base(fileName),
+			})
 		}
 	}
 
-	err := this.updateLastFile()
-	if err != nil {
-		//return nil, err
+	if len(journal.renames) == 0 && len(journal.removes) == 0 {
+		return nil
+	}
+
+	if err := this.commitTruncate(journal); err != nil {
 		return err
 	}
 
-	//return resultElem, nil
-	return nil
+	return this.updateLastFile()
 }
 
 /********************* internal functions *************************************/
@@ -588,26 +815,35 @@ func (this *diskIo) updateLastFile() error {
 			return err
 		}
 		this.latestFilePtr = file
+	} else if this.latestFilePtr != nil {
+		// all data files are removed
+		this.latestFilePtr.Close()
+		this.latestFileName = ""
+		this.latestFilePtr = nil
 	}
 
 	return nil
 }
 
 /*
-	truncate before pos
-	@return string: new filename
+	truncate before pos, the result is written to a temp file of the new data file
+	@return string: temp filename
  */
 func (this *diskIo) truncateFileBeforeId(fileName string, id uint64, elem *diskElem, pos uint64) (string, error) {
-	newFileName := this.getFileNameByStartId(id)
+	newFileName := this.getFileNameByStartId(id) + TMP_FILE_SUFFIX
 	//fmt.Println("old filename, newfilename:", fileName, newFileName)
 
-	oldFile, err := os.OpenFile(fileName, os.O_RDONLY, 0)
+	// the start elem may across multiple blocks
+	elemSize := this.formatOf(fileName).recordSize(uint64(len(elem.buff)))
+
+	oldFile, err := openDataFile(fileName, id)
 	if err != nil {
 		return "", err
 	}
 	defer oldFile.Close()
 
-	_, err = oldFile.Seek(int64(pos), 0)
+	// skip the start elem, it will be rewritten with the new startId
+	_, err = oldFile.Seek(int64(pos + elemSize), 0)
 	if err != nil {
 		return "", err
 	}
@@ -618,19 +854,15 @@ func (this *diskIo) truncateFileBeforeId(fileName string, id uint64, elem *diskE
 	}
 	defer newFile.Close()
 
-	//convert start elem to buffer
-	elemBuff := make([]byte, DATA_BLOCK_SIZE)
-	binary.BigEndian.PutUint64(elemBuff[DATA_STARTID_POS : DATA_STARTID_POS+ID_LEN], elem.startId)
-	binary.BigEndian.PutUint64(elemBuff[DATA_ENDID_POS : DATA_ENDID_POS+ID_LEN], elem.endId)
-	binary.BigEndian.PutUint64(elemBuff[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS+SIZE_LEN], uint64(len(elem.buff)))
-	copy(elemBuff[DATA_BUFF_POS : DATA_BUFF_POS+uint64(len(elem.buff))], elem.buff)
+	//convert start elem to buffer, startId changed so the crc is computed again
+	elemBuff := this.formatOf(fileName).encode(elem.startId, elem.endId, elem.term, elem.buff)
 
 	// write to new file
 	n, err := newFile.Write(elemBuff)
 	if err != nil {
 		return "", err
-	} else if uint64(n) != DATA_BLOCK_SIZE {
-		return "", errors.New("write elem failed")
+	} else if uint64(n) != elemSize {
+		return "", fmt.Errorf("write the start record of log index %d to %s: %w", id, newFileName, io.ErrShortWrite)
 	}
 
 	// loop copy
@@ -647,7 +879,7 @@ func (this *diskIo) truncateFileBeforeId(fileName string, id uint64, elem *diskE
 		if wrErr != nil {
 			return "", wrErr
 		} else if nWrite != nRead {
-			return "", errors.New(fmt.Sprintf("write file error, need to write %d, but actually write %d\n", nRead, nWrite))
+			return "", fmt.Errorf("write %s, %d of %d bytes written: %w", newFileName, nWrite, nRead, io.ErrShortWrite)
 		}
 
 		// break if EOF
@@ -656,34 +888,66 @@ func (this *diskIo) truncateFileBeforeId(fileName string, id uint64, elem *diskE
 		}
 	}
 
+	// the old file is removed after this, the new one must be on disk first
+	if this.needSync() {
+		if err := newFile.Sync(); err != nil {
+			return "", err
+		}
+	}
+
 	return newFileName, nil
 }
 
-func (this *diskIo) truncateFileAfterElem(fileName string, elem *diskElem, pos uint64) error {
-	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+/*
+	truncate after the elem at pos, the result is written to a temp file
+	@return string: temp filename
+ */
+func (this *diskIo) truncateFileAfterElem(fileName string, elem *diskElem, pos uint64) (string, error) {
+	oldFile, err := openDataFile(fileName, elem.startId)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer oldFile.Close()
 
-	elemBuffLen := uint64(len(elem.buff))
-	paddedSize := getPaddedSize(elemBuffLen)
-	elemSize := DATA_HEAD_SIZE + elemBuffLen + paddedSize
-
-	newSize := int64(pos + elemSize)
-	err = file.Truncate(newSize)
+	tmpFileName := fileName + TMP_FILE_SUFFIX
+	newFile, err := os.Create(tmpFileName)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer newFile.Close()
 
-	return nil
+	// copy the elems before it
+	if _, err := io.CopyN(newFile, oldFile, int64(pos)); err != nil {
+		return "", err
+	}
+
+	// endId of the elem is changed, crc doesn't cover it
+	elemBuff := this.formatOf(fileName).encode(elem.startId, elem.endId, elem.term, elem.buff)
+	if _, err := newFile.Write(elemBuff); err != nil {
+		return "", err
+	}
+
+	// the old file is replaced after this, the new one must be on disk first
+	if this.needSync() {
+		if err := newFile.Sync(); err != nil {
+			return "", err
+		}
+	}
+
+	return tmpFileName, nil
 }
 
 func (this *diskIo) deleteIndexByFile(fileName string) error {
 	indexInfo := this.idxMgr.mapIndex[fileName]
-	indexInfo.filePtr.Close()
+	if indexInfo.filePtr != nil {
+		indexInfo.filePtr.Close()
+	}
 
-	indexFileName := dataFileNameToIdxFileName(fileName)
-	os.Remove(indexFileName)
+	// a reader only drops it from memory
+	if !this.opts.ReadOnly {
+		indexFileName := dataFileNameToIdxFileName(fileName)
+		os.Remove(indexFileName)
+	}
 
 	delete(this.idxMgr.mapIndex, fileName)
 
@@ -696,52 +960,46 @@ func (this *diskIo) deleteIndexByFile(fileName string) error {
 	@return uint64: startPos of the elem
  */
 func (this *diskIo) getStartPosById(filename string, id uint64) (*diskElem, uint64, error) {
-	resultElem := &diskElem{}
+	var resultElem *diskElem = nil
 
 	// get index pos
 	indexInfo := this.idxMgr.mapIndex[filename]
-	startPos, _, err := indexInfo.findIndexPosById(id)
+	startPos, endPos, err := indexInfo.findIndexPosById(id)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	// open data file
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0)
+	file, err := openDataFile(filename, id)
 	if err != nil {
-		glog.Errorf("Remove %s failed:%s\n", filename, err.Error())
+		this.log().error("get", "open data file failed", LOG_KEY_FILE, filename, LOG_KEY_INDEX, id, LOG_KEY_ERROR, err)
 		return nil, 0, err
 	}
+	defer file.Close()
 
-	// search for the exactly pos of id
-	exactlyPos := uint64(0)
-	buff := make([]byte, IDX_MAX_SECTION_SIZE)
-	n, err := file.ReadAt(buff, int64(startPos))
-	if err != nil && err != io.EOF {
+	// search for the exactly pos of id in the section
+	buff, err := readSection(file, startPos, endPos)
+	if err != nil {
 		return nil, 0, err
 	}
 
-	for readSize := uint64(0); readSize < uint64(n); {
-		// read header
-		startId := binary.BigEndian.Uint64(buff[readSize + DATA_STARTID_POS : readSize + DATA_STARTID_POS + ID_LEN])
-		endID := binary.BigEndian.Uint64(buff[readSize + DATA_ENDID_POS : readSize + DATA_ENDID_POS + ID_LEN])
-		buffLen := binary.BigEndian.Uint64(buff[readSize + DATA_BUFFLEN_POS : readSize + DATA_BUFFLEN_POS + SIZE_LEN])
-		//fmt.Println("pos, startId, endId, bufflen:", readSize, startId, endID, buffLen)
-
-		if startId <= id {
-			if id <= endID || endID == 0 {
-				// hit
-				exactlyPos = readSize
-				resultElem.startId = startId
-				resultElem.endId = endID
-				resultElem.buff = make([]byte, buffLen)
-				copy(resultElem.buff, buff[readSize+DATA_BUFF_POS : readSize+DATA_BUFF_POS+buffLen])
-
-				break
-			}
+	exactlyPos := uint64(0)
+	err = this.formatOf(filename).scanRecords(buff, filename, startPos, func(elem *diskElem, pos uint64) bool {
+		//fmt.Println("pos, startId, endId, bufflen:", pos, elem.startId, elem.endId, len(elem.buff))
+		if elem.startId <= id && (id <= elem.endId || elem.endId == 0) {
+			// hit
+			exactlyPos = pos
+			resultElem = elem
+			return false
 		}
 
-		paddedSize := getPaddedSize(buffLen)
-		readSize += DATA_HEAD_SIZE+buffLen+paddedSize
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if resultElem == nil {
+		return nil, 0, DISK_NOTFOUND_ERR
 	}
 
 	return resultElem, startPos + exactlyPos, nil
@@ -750,170 +1008,111 @@ func (this *diskIo) getStartPosById(filename string, id uint64) (*diskElem, uint
 /*
 	when search elems between id[5, 10], the elem[3, 6] is included
  */
-func getElemsBetweenIdByIndex(file *os.File, startId uint64, endId, startIdStartPos uint64, startIdEndPos uint64, endIdStartPos uint64, endIdEndPos uint64) ([]*diskElem, error) {
+func getElemsBetweenIdByIndex(file *os.File, startId uint64, endId uint64, startPos uint64, endPos uint64, format *recordFormat) ([]*diskElem, error) {
 	if file == nil {
-		return nil, errors.New("file ptr is nil in getElemsAfterIdByIndex")
+		return nil, fmt.Errorf("getElemsBetweenIdByIndex: %w", errNilFile)
 	}
 
-	// search for the exactly pos of startId
-	startIdRangeSize := startIdEndPos - startIdStartPos
-	startIdRangeBuff := make([]byte, startIdRangeSize)
-	nStartBuffRead, err := file.ReadAt(startIdRangeBuff, int64(startIdStartPos))
-	if err != nil && err != io.EOF {
-		return nil, errors.New("file.ReadAt error in getElemsAfterIdByIndex:" + err.Error())
+	buff, err := readSection(file, startPos, endPos)
+	if err != nil {
+		return nil, err
 	}
 
-	readSize := uint64(0)
-	for ; readSize < uint64(nStartBuffRead); {
-		// read header
-		//elemStartId := binary.BigEndian.Uint64(startIdRangeBuff[readSize + DATA_STARTID_POS : readSize + DATA_STARTID_POS + ID_LEN])
-		elemEndId := binary.BigEndian.Uint64(startIdRangeBuff[readSize + DATA_ENDID_POS : readSize + DATA_ENDID_POS + ID_LEN])
-		buffLen := binary.BigEndian.Uint64(startIdRangeBuff[readSize + DATA_BUFFLEN_POS : readSize + DATA_BUFFLEN_POS + SIZE_LEN])
-		//fmt.Println("pos, startId, endId, bufflen:", readSize, startId, endID, buffLen)
-
-		if elemEndId >= startId || elemEndId == 0 {
-			//fmt.Println("hit!!!!!!!!!!:", elemStartId, elemEndId, startId)
-			// hit
-			//startIdHitPos = readSize
-			break
+	result := make([]*diskElem, 0)
+	err = format.scanRecords(buff, file.Name(), startPos, func(elem *diskElem, pos uint64) bool {
+		if elem.startId > endId {
+			return false
 		}
 
-		paddedSize := getPaddedSize(buffLen)
-		readSize += DATA_HEAD_SIZE + buffLen+paddedSize
-	}
-	exactlyStartPos := startIdStartPos + readSize
-
-	// search for the exactly pos of endId
-	endIdRangeSize := endIdEndPos - endIdStartPos
-	endIdRangeBuff := make([]byte, endIdRangeSize)
-	nEndBuffRead, err := file.ReadAt(endIdRangeBuff, int64(endIdStartPos))
-	if err != nil && err != io.EOF {
-		return nil, errors.New("file.ReadAt error in getElemsAfterIdByIndex:" + err.Error())
-	}
-
-	readSize = uint64(0)
-	for ; readSize < uint64(nEndBuffRead); {
-		// read header
-		elemStartId := binary.BigEndian.Uint64(endIdRangeBuff[readSize + DATA_STARTID_POS : readSize + DATA_STARTID_POS + ID_LEN])
-		//elemEndId := binary.BigEndian.Uint64(endIdRangeBuff[readSize + DATA_ENDID_POS : readSize + DATA_ENDID_POS + ID_LEN])
-		buffLen := binary.BigEndian.Uint64(endIdRangeBuff[readSize + DATA_BUFFLEN_POS : readSize + DATA_BUFFLEN_POS + SIZE_LEN])
-		//fmt.Println("pos, startId, endId, bufflen:", readSize, startId, endID, buffLen)
-
-		if elemStartId > endId {
-			//fmt.Println("hit!!!!!!!!!!:", startId, endId, id)
-			// hit
-			//endIdHitPos = readSize
-			break
+		if elem.endId >= startId || elem.endId == 0 {
+			result = append(result, elem)
 		}
 
-		paddedSize := getPaddedSize(buffLen)
-		readSize += DATA_HEAD_SIZE + buffLen + paddedSize
-	}
-	exactlyEndPos := endIdStartPos + readSize
-
-	// count the total size
-	totalSize := exactlyEndPos - exactlyStartPos
-
-	if totalSize == 0 {
-		return make([]*diskElem, 0), nil
-	}
-
-	// make a big enough buff to load all needed data from disk
-	allBuff := make([]byte, totalSize)
-	nReadAll, err := file.ReadAt(allBuff, int64(exactlyStartPos))
+		return true
+	})
 	if err != nil {
-		return nil, errors.New("file.ReadAt error:" + err.Error())
+		return nil, err
 	}
 
-	// parse to elements
-	return getElemsFromBuff(allBuff[0 : nReadAll])
+	return result, nil
 }
 
 /*
 	get elements bigger than the id provided, with the help of an index pos 
  */
-func getElemsAfterIdByIndex(file *os.File, id uint64, startPos uint64) ([]*diskElem, error) {
+// @param dataFileSize: size of the data file known by its index, a reader may find more appended by the writer
+func getElemsAfterIdByIndex(file *os.File, id uint64, startPos uint64, dataFileSize uint64, format *recordFormat) ([]*diskElem, error) {
 	if file == nil {
-		return nil, errors.New("file ptr is nil in getElemsAfterIdByIndex")
-	}
-
-	// search for the exactly pos of id
-	hitPos := uint64(0)
-	buff := make([]byte, IDX_MAX_SECTION_SIZE)
-	n, err := file.ReadAt(buff, int64(startPos))
-	if err != nil && err != io.EOF {
-		return nil, errors.New("file.ReadAt error in getElemsAfterIdByIndex:"+err.Error())
-	}
-
-	for readSize := uint64(0); readSize < uint64(n); {
-		// read header
-		startId := binary.BigEndian.Uint64(buff[readSize + DATA_STARTID_POS : readSize + DATA_STARTID_POS + ID_LEN])
-		endId := binary.BigEndian.Uint64(buff[readSize + DATA_ENDID_POS : readSize + DATA_ENDID_POS + ID_LEN])
-		buffLen := binary.BigEndian.Uint64(buff[readSize + DATA_BUFFLEN_POS : readSize + DATA_BUFFLEN_POS + SIZE_LEN])
-		//fmt.Println("pos, startId, endId, bufflen:", readSize, startId, endID, buffLen)
-
-		if startId <= id {
-			if id <= endId || endId == 0 {
-				//fmt.Println("hit!!!!!!!!!!:", startId, endId, id)
-				// hit
-				hitPos = readSize
-				break
-			}
-		}
-
-		paddedSize := getPaddedSize(buffLen)
-		readSize += DATA_HEAD_SIZE+buffLen+paddedSize
+		return nil, fmt.Errorf("getElemsAfterIdByIndex: %w", errNilFile)
 	}
-	exactlyPos := startPos + hitPos
-	//fmt.Println("exactlypos:", exactlyPos)
 
-	// make a big enough buff to load all needed data from disk
 	// todo (if the buff is too big to make, consider to batches read from disk)
-	info, err := file.Stat()
+	buff, err := readSection(file, startPos, dataFileSize)
 	if err != nil {
-		return nil, errors.New("file.Stat error:"+err.Error())
+		return nil, err
 	}
-	allBuffSize := uint64(info.Size()) - exactlyPos
-	var allBuff []byte
-	if allBuffSize <= uint64(n) {
-		allBuff = buff[hitPos : n]
-	} else {
-		allBuff = make([]byte, allBuffSize)
 
-		// in order to avoid from read the same data from disk twice, reuse them
-		reuseSize := uint64(n) - exactlyPos
-		//fmt.Println("exactlypos, reusesize, buffsize", exactlyPos, reuseSize, allBuffSize)
-		copy(allBuff[0 : reuseSize], buff[hitPos : n])
-		_, err = file.ReadAt(allBuff[reuseSize : allBuffSize], int64(n))
-		if err != nil {
-			return nil, err
+	result := make([]*diskElem, 0)
+	err = format.scanRecords(buff, file.Name(), startPos, func(elem *diskElem, pos uint64) bool {
+		// skip the ones before the hit
+		if elem.endId >= id || elem.endId == 0 {
+			result = append(result, elem)
 		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// parse to elements
-	return getElemsFromBuff(allBuff)
+	return result, nil
 }
 
-func getElemsFromBuff(buff []byte) ([]*diskElem, error) {
-	buffLen := uint64(len(buff))
-	result := make([]*diskElem, 0)
-	for readSize := uint64(0); readSize < uint64(buffLen); {
-		// read header
-		startId := binary.BigEndian.Uint64(buff[readSize + DATA_STARTID_POS : readSize + DATA_STARTID_POS + ID_LEN])
-		endID := binary.BigEndian.Uint64(buff[readSize + DATA_ENDID_POS : readSize + DATA_ENDID_POS + ID_LEN])
-		elemBuffLen := binary.BigEndian.Uint64(buff[readSize + DATA_BUFFLEN_POS : readSize + DATA_BUFFLEN_POS + SIZE_LEN])
-		//fmt.Println("pos, startId, endId, elemBuffLen, buffLen:", readSize, startId, endID, elemBuffLen, buffLen)
-
-		elem := &diskElem {
-			startId: startId,
-			endId: endID,
-			buff: make([]byte, elemBuffLen),
+/*
+	open a data file to read the records from log index id.
+	the file is known by the index manager, if it's gone the store is broken, the error of the OS is kept in both cases.
+ */
+func openDataFile(fileName string, id uint64) (*os.File, error) {
+	file, err := os.OpenFile(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, &CorruptError{File: fileName,
+				Reason: fmt.Sprintf("data file of log index %d is gone", id), Err: err}
 		}
-		copy(elem.buff, buff[readSize + DATA_BUFF_POS : readSize + DATA_BUFF_POS + elemBuffLen])
-		result = append(result, elem)
+		return nil, fmt.Errorf("open data file %s for log index %d: %w", fileName, id, err)
+	}
+
+	return file, nil
+}
+
+// read [startPos, endPos) of the file, which must be made up of complete records
+func readSection(file *os.File, startPos uint64, endPos uint64) ([]byte, error) {
+	if endPos < startPos {
+		return nil, &CorruptError{File: file.Name(), Offset: startPos,
+			Reason: fmt.Sprintf("illegal section [%d, %d)", startPos, endPos)}
+	}
+
+	buff := make([]byte, endPos - startPos)
+	n, err := file.ReadAt(buff, int64(startPos))
+	if err != nil {
+		if err == io.EOF {
+			return nil, &CorruptError{File: file.Name(), Offset: startPos + uint64(n),
+				Reason: fmt.Sprintf("data file ends before the section end %d", endPos)}
+		}
+		return nil, fmt.Errorf("read %s at offset %d: %w", file.Name(), startPos, err)
+	}
+
+	return buff, nil
+}
 
-		paddedSize := getPaddedSize(elemBuffLen)
-		readSize += DATA_HEAD_SIZE + elemBuffLen + paddedSize
+func getElemsFromBuff(buff []byte, format *recordFormat, fileName string, fileOffset uint64) ([]*diskElem, error) {
+	result := make([]*diskElem, 0)
+	err := format.scanRecords(buff, fileName, fileOffset, func(elem *diskElem, pos uint64) bool {
+		result = append(result, elem)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	//fmt.Printf("get %d elems\n", len(result))
@@ -925,6 +1124,10 @@ func getElemsFromBuff(buff []byte) ([]*diskElem, error) {
 	@return startPos, endPos, error
  */
 func (this *indexInfo) findIndexPosById(id uint64) (uint64, uint64, error) {
+	if len(this.indexs) == 0 {
+		return 0, 0, DISK_NOTFOUND_ERR
+	}
+
 	// if id is between minId and the first index
 	if this.meta.minId <= id && this.indexs[0].startId > id {
 		return 0, this.indexs[0].pos, nil
@@ -950,7 +1153,7 @@ func (this *indexInfo) findIndexPosById(id uint64) (uint64, uint64, error) {
 		if this.indexs[i].startId < id && this.indexs[i + 1].startId > id {
 			return this.indexs[i].pos, this.indexs[i + 1].pos, nil
 		} else if this.indexs[i].startId == id {
-			return this.indexs[i].pos, this.indexs[i].pos, nil
+			return this.indexs[i].pos, this.indexs[i + 1].pos, nil
 		}
 	}
 
@@ -960,27 +1163,23 @@ func (this *indexInfo) findIndexPosById(id uint64) (uint64, uint64, error) {
 /*
 	get all elems from the data file specified
  */
-func getElemsFromFile(file *os.File) ([]*diskElem, error) {
+func getElemsFromFile(file *os.File, dataFileSize uint64, format *recordFormat) ([]*diskElem, error) {
 	if file == nil {
-		return nil, errors.New("file ptr is nil in getElemByPos")
-	}
-
-	info, err := file.Stat()
-	if err != nil {
-		return nil, errors.New("file.Stat failed in getElemsFromFile:" + err.Error())
+		return nil, fmt.Errorf("getElemsFromFile: %w", errNilFile)
 	}
 
-	buffSize := info.Size()
+	buffSize := int64(dataFileSize)
 	buff := make([]byte, buffSize)
 	n, err := file.ReadAt(buff, 0)
-	if err != nil {
-		return nil, errors.New("file.ReadAt failed in getElemsFromFile:" + err.Error())
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read %s: %w", file.Name(), err)
 	} else if n != int(buffSize) {
-		return nil, errors.New("file.ReadAt failed in getElemsFromFile:not read enough bytes\n")
+		return nil, &CorruptError{File: file.Name(), Offset: uint64(n),
+			Reason: fmt.Sprintf("data file ends before its size %d", dataFileSize)}
 	}
 
 	// parse to elements
-	return getElemsFromBuff(buff[0 : n])
+	return getElemsFromBuff(buff[0 : n], format, file.Name(), 0)
 }
 
 
@@ -988,94 +1187,183 @@ func getElemsFromFile(file *os.File) ([]*diskElem, error) {
  get an elem by pos
  @param file: pointer to the file
  @param pos: position of the elem
- @return startId, endId, buff, error: nothing to tell
+ @return *diskElem, error: nothing to tell
   */
-func getElemByPos(file *os.File, pos uint64) (uint64, uint64, []byte, error) {
+func getElemByPos(file *os.File, pos uint64, format *recordFormat) (*diskElem, error) {
 	if file == nil {
-		return 0, 0, nil, errors.New("file ptr is nil in getElemByPos")
+		return nil, fmt.Errorf("getElemByPos: %w", errNilFile)
 	}
 
-	// read a block
-	buff := make([]byte, DATA_BLOCK_SIZE)
-	_, err := file.ReadAt(buff, int64(pos))
+	info, err := file.Stat()
 	if err != nil {
-		return uint64(0), uint64(0), nil, err
+		return nil, fmt.Errorf("stat %s: %w", file.Name(), err)
+	}
+	fileSize := uint64(info.Size())
+	if pos + format.headSize > fileSize {
+		return nil, &CorruptError{File: file.Name(), Offset: pos, Reason: "record header exceeds the end of file"}
 	}
 
-	// get meta
-	startId := binary.BigEndian.Uint64(buff[DATA_STARTID_POS : DATA_STARTID_POS + ID_LEN])
-	endID := binary.BigEndian.Uint64(buff[DATA_ENDID_POS : DATA_ENDID_POS + ID_LEN])
-	buffLen := binary.BigEndian.Uint64(buff[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS + SIZE_LEN])
+	// read the header to get buff_len
+	head := make([]byte, format.headSize)
+	_, err = file.ReadAt(head, int64(pos))
+	if err != nil {
+		return nil, fmt.Errorf("read the record header of %s at offset %d: %w", file.Name(), pos, err)
+	}
+	buffLen := binary.BigEndian.Uint64(head[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS + SIZE_LEN])
+	if buffLen > fileSize - pos - format.headSize {
+		return nil, &CorruptError{File: file.Name(), Offset: pos,
+			Reason: fmt.Sprintf("buff_len %d exceeds the end of file", buffLen)}
+	}
 
-	// read rest parts when the elem is more than one block
-	if buffLen+DATA_HEAD_SIZE > DATA_BLOCK_SIZE {
-		moreSize := buffLen + DATA_HEAD_SIZE - DATA_BLOCK_SIZE
-		moreBuff := make([]byte, moreSize)
-		_, err := file.ReadAt(moreBuff, int64(pos + DATA_BLOCK_SIZE))
-		if err != nil {
-			return uint64(0), uint64(0), nil, err
-		}
+	// read the whole record, it may across multiple blocks
+	recordSize := format.recordSize(buffLen)
+	if pos + recordSize > fileSize {
+		recordSize = fileSize - pos // let parseRecord tell it's incomplete
+	}
+	buff := make([]byte, recordSize)
+	_, err = file.ReadAt(buff, int64(pos))
+	if err != nil {
+		return nil, fmt.Errorf("read the record of %s at offset %d: %w", file.Name(), pos, err)
+	}
 
-		buff = append(buff, moreBuff...)
+	elem, _, err := format.parseRecord(buff, 0, file.Name(), pos)
+	if err != nil {
+		return nil, err
 	}
-	return startId, endID, buff[DATA_HEAD_SIZE : DATA_HEAD_SIZE+buffLen], nil
+
+	return elem, nil
 }
 
 /*
  get an elem by pos range
  @param file: pointer to the file
  @param pos: position of the elem
- @return startId, endId, buff, error: nothing to tell
+ @return *diskElem, error: nothing to tell
   */
-func getElemByIdAndIndex(file *os.File, id uint64, startPos uint64, endPos uint64) (uint64, uint64, []byte, error) {
+func getElemByIdAndIndex(file *os.File, id uint64, startPos uint64, endPos uint64, format *recordFormat) (*diskElem, error) {
 	if file == nil {
-		return 0, 0, nil, errors.New("file ptr is nil in getElemByIdAndIndex")
+		return nil, fmt.Errorf("getElemByIdAndIndex: %w", errNilFile)
 	}
 
 	//fmt.Println("start getElemByIdAndIndex: startPos, endPos, id", startPos, endPos, id)
 	// read a section
-	sectionSize := endPos - startPos
-	sectionBuff := make([]byte, sectionSize)
-
-	n, err := file.ReadAt(sectionBuff, int64(startPos))
+	sectionBuff, err := readSection(file, startPos, endPos)
 	if err != nil {
-		if err == io.EOF {
-			sectionBuff = sectionBuff[ : n]
-			sectionSize = uint64(n)
-		} else {
-			return 0, 0, nil, err
-		}
+		return nil, err
 	}
 
-	for readSize := uint64(0); readSize < sectionSize; {
-		// read header
-		startId := binary.BigEndian.Uint64(sectionBuff[readSize + DATA_STARTID_POS : readSize + DATA_STARTID_POS + ID_LEN])
-		endId := binary.BigEndian.Uint64(sectionBuff[readSize + DATA_ENDID_POS : readSize + DATA_ENDID_POS + ID_LEN])
-		buffLen := binary.BigEndian.Uint64(sectionBuff[readSize + DATA_BUFFLEN_POS : readSize + DATA_BUFFLEN_POS + SIZE_LEN])
-		//fmt.Println("pos, startId, endId, bufflen:", readSize, startId, endId, buffLen)
-
-		if startId <= id {
-			if id <= endId || endId == 0 {
-				// hit
-				return startId, endId, sectionBuff[readSize+DATA_BUFF_POS : readSize+DATA_BUFF_POS+buffLen], nil
-			}
+	var hit *diskElem = nil
+	err = format.scanRecords(sectionBuff, file.Name(), startPos, func(elem *diskElem, pos uint64) bool {
+		if elem.startId <= id && (id <= elem.endId || elem.endId == 0) {
+			hit = elem
+			return false
 		}
 
-		paddedSize := getPaddedSize(buffLen)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		readSize += DATA_HEAD_SIZE+buffLen+paddedSize
+	if hit == nil {
+		return nil, &CorruptError{File: file.Name(), Offset: startPos,
+			Reason: fmt.Sprintf("the index points to section [%d, %d) for id %d, but it isn't there", startPos, endPos, id)}
 	}
 
-	return 0, 0, nil, errors.New(fmt.Sprintf("getElemByPosRange failed, id:%d, startPos:%d, endPos %d\n", id, startPos, endPos))
+	return hit, nil
 }
 
 func (this *diskIo) init() error {
-	// mkdir, nothing changed if path already exists
-	err := os.MkdirAll(this.path, 0777)
+	var err error
+	if this.opts.ReadOnly {
+		// a reader never creates a store
+		fileInfo, err := os.Stat(this.path)
+		if err != nil {
+			return err
+		}
+		if !fileInfo.IsDir() {
+			return errors.New(fmt.Sprintf("store %s is not a directory", this.path))
+		}
+	} else {
+		// mkdir, nothing changed if path already exists
+		err = os.MkdirAll(this.path, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	// no other process writes the store from now on
+	err = this.lock()
 	if err != nil {
 		return err
 	}
 
+	return this.load()
+}
+
+/*
+	drop the state kept in memory and load the store again, as it is opened. the lock is kept.
+	called after a write failed in the middle: what is left by it is finished or dropped like after a crash.
+ */
+func (this *diskIo) reload() error {
+	// the meta in memory may be ahead of the data, it isn't written
+	for _, indexInfo := range this.idxMgr.mapIndex {
+		if indexInfo.filePtr != nil {
+			indexInfo.filePtr.Close()
+		}
+	}
+	if this.latestFilePtr != nil {
+		this.latestFilePtr.Close()
+	}
+
+	this.latestFileName = ""
+	this.latestFilePtr = nil
+	this.idxMgr = &indexMgr{
+		mapIndex: make(map[string]*indexInfo),
+	}
+	this.validSizes = make(map[string]uint64)
+
+	return this.load()
+}
+
+// whether the last record starts from id, used to check an append failed in the middle after reloading
+func (this *diskIo) isPushed(id uint64) bool {
+	lastId, _, err := this.last()
+	return err == nil && lastId == id
+}
+
+// whether no record is left before id, used to check a truncation failed in the middle after reloading
+func (this *diskIo) isTruncatedBefore(id uint64) bool {
+	for _, indexInfo := range this.idxMgr.mapIndex {
+		if indexInfo.meta.recordNum > 0 && indexInfo.meta.minId < id {
+			return false
+		}
+	}
+
+	return true
+}
+
+// whether no record is left after id, used to check a truncation failed in the middle after reloading
+func (this *diskIo) isTruncatedAfter(id uint64) bool {
+	lastId, _, err := this.last()
+	if err == DISK_NOTFOUND_ERR {
+		return true
+	}
+
+	return err == nil && lastId <= id
+}
+
+// load the data files and their indexes, with the lock held
+func (this *diskIo) load() error {
+	var err error
+	// finish or roll back the truncation interrupted by a crash, left to the writer if read-only
+	if !this.opts.ReadOnly {
+		err = this.replayJournal()
+		if err != nil {
+			return err
+		}
+	}
+
 	// scan all data files
 	pattern := filepath.Join(this.path, "*.data")
 	//fmt.Println("pattern:", pattern)
@@ -1085,6 +1373,18 @@ func (this *diskIo) init() error {
 	}
 	//fmt.Println("files", files)
 
+	// make sure the files are laid out the same as the options say
+	err = this.checkStoreMeta(files)
+	if err != nil {
+		return err
+	}
+
+	// drop the partial record left by a crash
+	files, err = this.recoverLatestFile(files)
+	if err != nil {
+		return err
+	}
+
 	var maxStartId uint64 = 0
 	lastFileName := ""
 	for _, filename := range files {
@@ -1106,9 +1406,13 @@ func (this *diskIo) init() error {
 		}
 	}
 
-	// open last file
+	// open last file for append
 	if lastFileName != "" {
-		lastFile, err := os.Open(lastFileName)
+		flag := os.O_RDWR
+		if this.opts.ReadOnly {
+			flag = os.O_RDONLY
+		}
+		lastFile, err := os.OpenFile(lastFileName, flag, 0)
 		if err != nil {
 			return err
 		}
@@ -1119,71 +1423,390 @@ func (this *diskIo) init() error {
 	return nil
 }
 
-func (this *diskIo) loadIndex(dataFileName string) error {
-	// get index filename by data filename
-	indexFileName := dataFileNameToIdxFileName(dataFileName)
+func (this *diskIo) getMetaFileName() string {
+	return filepath.Join(this.path, this.header+".meta")
+}
 
-	_, err := os.Stat(indexFileName)
+// layout of a store persisted in its meta file
+type storeMeta struct {
+	version    uint64
+	blockSize  uint64
+	nameNumLen int
+	codecId    uint64
+	legacy     bool // the meta file has no codec, or there is no meta file at all
+
+	// the segments starting before upgradeFrom are of oldVersion, written before the store was upgraded to version.
+	// upgradeFrom is 0 if there is none, UINT64_MAX if all the segments are
+	oldVersion  uint64
+	upgradeFrom uint64
+}
+
+/*
+	read the meta file of the store, the os error is returned if it can't be read
+	@param dataFiles: data files of the store, the layout of the legacy stores is taken if there is no meta file, or nil
+	is returned for a new store
+ */
+func readStoreMeta(metaFileName string, dataFiles []string, log *storeLogger) (*storeMeta, error) {
+	buff, err := ioutil.ReadFile(metaFileName)
 	if err != nil {
-		//if not exists
-		if os.IsNotExist(err) {
-			if err := this.buildIndexByFile(dataFileName); err != nil {
-				return err
-			}
+		if !os.IsNotExist(err) {
+			log.error("open", "read meta file failed", LOG_KEY_FILE, metaFileName, LOG_KEY_ERROR, err)
+			return nil, err
+		}
 
-			// write index file to disk
-			indexInfo := this.idxMgr.mapIndex[dataFileName]
-			if err := indexInfo.writeIndexToDisk(); err != nil {
-				return err
+		// a new store
+		if len(dataFiles) == 0 {
+			return nil, nil
+		}
+
+		// the records of a store created before meta file was introduced have no crc, the ones with crc are written
+		// with a meta file, which keeps the codec of them and is lost
+		version, err := crcRecordVersion(dataFiles)
+		if err != nil {
+			log.error("open", "read data file failed", LOG_KEY_ERROR, err)
+			return nil, err
+		}
+		if version > 0 {
+			return nil, &CorruptError{File: metaFileName,
+				Reason: fmt.Sprintf("meta file is missing, but the data files are of format version %d, their codec is unknown", version)}
+		}
+
+		// store was created before meta file was introduced
+		return &storeMeta{
+			version: LEGACY_FORMAT_VERSION,
+			blockSize: LEGACY_BLOCK_SIZE,
+			nameNumLen: LEGACY_FILE_NAME_NUMLEN,
+			codecId: LEGACY_CODEC_ID,
+			legacy: true,
+		}, nil
+	}
+
+	if uint64(len(buff)) < META_CODEC_POS || binary.BigEndian.Uint64(buff[META_MAGIC_POS : META_MAGIC_POS+NUM_LEN]) != META_MAGIC {
+		return nil, &CorruptError{File: metaFileName, Offset: 0, Reason: "illegal meta file"}
+	}
+	meta := &storeMeta{
+		version: binary.BigEndian.Uint64(buff[META_VERSION_POS : META_VERSION_POS+NUM_LEN]),
+		blockSize: binary.BigEndian.Uint64(buff[META_BLOCKSIZE_POS : META_BLOCKSIZE_POS+SIZE_LEN]),
+		nameNumLen: int(binary.BigEndian.Uint64(buff[META_NAMENUMLEN_POS : META_NAMENUMLEN_POS+NUM_LEN])),
+		codecId: LEGACY_CODEC_ID,
+	}
+	if meta.version > META_FORMAT_VERSION {
+		return nil, errors.New(fmt.Sprintf("meta file %s has an unsupported version %d", metaFileName, meta.version))
+	}
+	if uint64(len(buff)) >= META_OLDVERSION_POS {
+		meta.codecId = binary.BigEndian.Uint64(buff[META_CODEC_POS : META_CODEC_POS+NUM_LEN])
+	} else {
+		meta.legacy = true
+	}
+	if uint64(len(buff)) >= META_SIZE {
+		meta.oldVersion = binary.BigEndian.Uint64(buff[META_OLDVERSION_POS : META_OLDVERSION_POS+NUM_LEN])
+		meta.upgradeFrom = binary.BigEndian.Uint64(buff[META_UPGRADEFROM_POS : META_UPGRADEFROM_POS+ID_LEN])
+	}
+
+	return meta, nil
+}
+
+/*
+	the format version of the first record of the data files if it has a crc, or 0 if it has not, as the records of the
+	stores created before the meta file. empty data files are skipped.
+ */
+func crcRecordVersion(dataFiles []string) (uint64, error) {
+	for _, fileName := range dataFiles {
+		buff, err := readFirstRecord(fileName)
+		if err != nil {
+			return 0, err
+		}
+		if len(buff) == 0 {
+			continue
+		}
+
+		// the crc doesn't depend on the block size
+		for _, version := range []uint64{3, 2} {
+			format := getRecordFormat(version, LEGACY_BLOCK_SIZE)
+			buffLen := binary.BigEndian.Uint64(buff[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS+SIZE_LEN])
+			if uint64(len(buff)) < format.headSize || buffLen > uint64(len(buff)) - format.headSize {
+				continue
+			}
+			crc := binary.BigEndian.Uint32(buff[DATA_CRC_POS : DATA_CRC_POS+CRC_LEN])
+			if crc == format.checksum(buff, 0, buffLen) {
+				return version, nil
 			}
+		}
+		return 0, nil
+	}
+
+	return 0, nil
+}
+
+// the header and buff of the first record of the data file whatever its format is, empty for an empty file
+func readFirstRecord(fileName string) ([]byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	head := make([]byte, DATA_HEAD_SIZE)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read %s: %w", fileName, err)
+	}
+	if uint64(n) < DATA_HEAD_SIZE_V1 {
+		return head[0 : 0], nil
+	}
 
+	// the buff of the longest header, buff_len is not trusted
+	buffLen := binary.BigEndian.Uint64(head[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS+SIZE_LEN])
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", fileName, err)
+	}
+	if buffLen > uint64(info.Size()) {
+		return head[0 : n], nil
+	}
+	buff := make([]byte, DATA_HEAD_SIZE + buffLen)
+	n, err = file.ReadAt(buff, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read %s: %w", fileName, err)
+	}
+
+	return buff[0 : n], nil
+}
+
+/*
+	compare the layout options with the ones persisted in the meta file, and create the meta file if not exists
+	@param dataFiles: data files of the store already
+ */
+func (this *diskIo) checkStoreMeta(dataFiles []string) error {
+	meta, err := readStoreMeta(this.getMetaFileName(), dataFiles, this.log())
+	if err != nil {
+		return err
+	}
+
+	// a new store, take the options and the latest format
+	if meta == nil {
+		this.setLayout(&storeMeta{version: META_FORMAT_VERSION, blockSize: this.opts.DataBlockSize})
+		this.codec = this.opts.Codec
+		if this.opts.ReadOnly {
 			return nil
 		}
+		return this.writeStoreMeta()
+	}
 
+	if meta.blockSize != this.opts.DataBlockSize {
+		return errors.New(fmt.Sprintf("store %s was created with DataBlockSize %d, can't be opened with %d", this.path, meta.blockSize, this.opts.DataBlockSize))
+	}
+	if meta.nameNumLen != this.opts.FileNameNumLen {
+		return errors.New(fmt.Sprintf("store %s was created with FileNameNumLen %d, can't be opened with %d", this.path, meta.nameNumLen, this.opts.FileNameNumLen))
+	}
+
+	// an old store keeps its codec, and the format of its segments
+	this.setLayout(meta)
+	this.codec, err = getCodecById(meta.codecId, this.opts.Codec)
+	if err != nil {
+		return errors.New(fmt.Sprintf("store %s: %s", this.path, err.Error()))
+	}
+	if this.codec.ID() != this.opts.Codec.ID() {
+		this.log().warn("open", "the store was created with another codec, it is used instead", LOG_KEY_FILE, this.getMetaFileName(),
+			"codec", this.codec.Name(), "options_codec", this.opts.Codec.Name())
+	}
+
+	// upgrade the old store, left to the writer if read-only. its segments are kept, the new ones are of the latest
+	// format, which is used by the next push
+	if this.opts.ReadOnly {
+		return nil
+	}
+	if meta.version < META_FORMAT_VERSION {
+		this.log().warn("open", "upgrade the store, the new data files are of the latest format", LOG_KEY_FILE, this.getMetaFileName(),
+			"version", meta.version, "latest_version", META_FORMAT_VERSION)
+		upgradeFrom := uint64(0)
+		if len(dataFiles) > 0 {
+			upgradeFrom = UINT64_MAX
+		}
+		this.setLayout(&storeMeta{version: META_FORMAT_VERSION, blockSize: meta.blockSize, oldVersion: meta.version, upgradeFrom: upgradeFrom})
+		return this.writeStoreMeta()
+	}
+	if meta.legacy {
+		return this.writeStoreMeta()
+	}
+
+	return nil
+}
+
+// take the record formats of meta
+func (this *diskIo) setLayout(meta *storeMeta) {
+	this.format = getRecordFormat(meta.version, meta.blockSize)
+	this.oldFormat = nil
+	this.upgradeFrom = 0
+	if meta.upgradeFrom != 0 {
+		this.oldFormat = getRecordFormat(meta.oldVersion, meta.blockSize)
+		this.upgradeFrom = meta.upgradeFrom
+	}
+}
+
+// the record format of the data file, the ones written before the store was upgraded keep their format
+func (this *diskIo) formatOf(fileName string) *recordFormat {
+	if this.oldFormat == nil {
+		return this.format
+	}
+	startId, err := this.getStartIdByFileName(fileName)
+	if err == nil && startId < this.upgradeFrom {
+		return this.oldFormat
+	}
+	return this.format
+}
+
+/*
+	all the segments are of the latest format after they are replaced by a restore, the old format is dropped from the
+	meta file. called before the journal of the restore is removed, as the meta may not be loaded yet.
+ */
+func (this *diskIo) dropOldFormat() error {
+	meta, err := readStoreMeta(this.getMetaFileName(), nil, this.log())
+	if err != nil || meta == nil || meta.upgradeFrom == 0 {
 		return err
 	}
 
-	//if index file exists, load it
-	return this.readIndex(indexFileName)
+	meta.oldVersion = 0
+	meta.upgradeFrom = 0
+	if err = this.writeMetaFile(meta); err != nil {
+		return err
+	}
+	this.oldFormat = nil
+	this.upgradeFrom = 0
+	return nil
 }
 
-func (this *indexInfo) writeIndexToDisk() error {
-	file := this.filePtr
-	// count for buff size
-	buffSize := IDX_HEADER_SIZE + uint64(len(this.indexs)) * SI_SIZE
-	buff := make([]byte, buffSize)
-	binary.BigEndian.PutUint64(buff[IDX_DATAFILESIZE_POS : IDX_DATAFILESIZE_POS+SIZE_LEN], this.meta.dataFileSize)
-	binary.BigEndian.PutUint64(buff[IDX_RECORDNUM_POS : IDX_RECORDNUM_POS+NUM_LEN], this.meta.recordNum)
-	binary.BigEndian.PutUint64(buff[IDX_LASTRECORDPOS_POS : IDX_LASTRECORDPOS_POS+POS_LEN], this.meta.lastRecordPos)
-	binary.BigEndian.PutUint64(buff[IDX_MINID_POS : IDX_MINID_POS+ID_LEN], this.meta.minId)
-	binary.BigEndian.PutUint64(buff[IDX_MAXID_POS : IDX_MAXID_POS+ID_LEN], this.meta.maxId)
+/*
+	write the layout options to the meta file, write a temp file first and then rename it to keep the old one complete.
+	both the temp file and the directory are flushed unless SyncNever, so the meta file is durable before any data file
+	is created.
+ */
+func (this *diskIo) writeStoreMeta() error {
+	meta := &storeMeta{
+		version: this.format.version,
+		blockSize: this.opts.DataBlockSize,
+		nameNumLen: this.opts.FileNameNumLen,
+		codecId: this.codec.ID(),
+		upgradeFrom: this.upgradeFrom,
+	}
+	if this.oldFormat != nil {
+		meta.oldVersion = this.oldFormat.version
+	}
+	return this.writeMetaFile(meta)
+}
 
-	nowPos := IDX_HEADER_SIZE
-	for _, idx := range this.indexs {
-		binary.BigEndian.PutUint64(buff[nowPos+SI_STARTID_POS : nowPos+SI_STARTID_POS+ID_LEN], idx.startId)
-		binary.BigEndian.PutUint64(buff[nowPos+SI_POS_POS : nowPos+SI_POS_POS+POS_LEN], idx.pos)
-		nowPos += SI_SIZE
+func (this *diskIo) writeMetaFile(meta *storeMeta) error {
+	buff := make([]byte, META_SIZE)
+	binary.BigEndian.PutUint64(buff[META_MAGIC_POS : META_MAGIC_POS+NUM_LEN], META_MAGIC)
+	binary.BigEndian.PutUint64(buff[META_VERSION_POS : META_VERSION_POS+NUM_LEN], meta.version)
+	binary.BigEndian.PutUint64(buff[META_BLOCKSIZE_POS : META_BLOCKSIZE_POS+SIZE_LEN], meta.blockSize)
+	binary.BigEndian.PutUint64(buff[META_NAMENUMLEN_POS : META_NAMENUMLEN_POS+NUM_LEN], uint64(meta.nameNumLen))
+	binary.BigEndian.PutUint64(buff[META_CODEC_POS : META_CODEC_POS+NUM_LEN], meta.codecId)
+	binary.BigEndian.PutUint64(buff[META_OLDVERSION_POS : META_OLDVERSION_POS+NUM_LEN], meta.oldVersion)
+	binary.BigEndian.PutUint64(buff[META_UPGRADEFROM_POS : META_UPGRADEFROM_POS+ID_LEN], meta.upgradeFrom)
+
+	metaFileName := this.getMetaFileName()
+	tmpFileName := metaFileName + ".tmp"
+	err := this.writeFileSync(tmpFileName, buff)
+	if err != nil {
+		this.log().error("write_meta", "write meta file failed", LOG_KEY_FILE, tmpFileName, LOG_KEY_ERROR, err)
+		return err
 	}
 
-	n, err := file.WriteAt(buff, 0)
+	if err = os.Rename(tmpFileName, metaFileName); err != nil {
+		return err
+	}
+	if this.needSync() {
+		if err = syncDir(this.path); err != nil {
+			this.log().error("write_meta", "sync the directory failed", LOG_KEY_FILE, this.path, LOG_KEY_ERROR, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write buff to the file, and flush it unless SyncNever
+func (this *diskIo) writeFileSync(fileName string, buff []byte) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
-	} else if uint64(n) < buffSize {
-		return errors.New("write index file failed: not write completely")
 	}
+	defer file.Close()
 
+	if _, err = file.Write(buff); err != nil {
+		return err
+	}
+	if this.needSync() {
+		return file.Sync()
+	}
 	return nil
 }
 
+func (this *diskIo) loadIndex(dataFileName string) error {
+	// get index filename by data filename
+	indexFileName := dataFileNameToIdxFileName(dataFileName)
+
+	// the meta of the file being written may be behind its data, a reader builds the index by what it has read
+	if _, ok := this.validSizes[dataFileName]; ok {
+		return this.buildIndexByFile(dataFileName)
+	}
+
+	_, err := os.Stat(indexFileName)
+	if err == nil {
+		// if index file exists, load it and make sure it matches the data file
+		err = this.readIndex(indexFileName)
+		if err == nil {
+			err = this.checkIndex(dataFileName)
+		}
+		if err == nil {
+			return nil
+		}
+
+		this.log().warn("load_index", "index doesn't match the data file, rebuild it", LOG_KEY_FILE, dataFileName, LOG_KEY_ERROR, err)
+		if _, ok := this.idxMgr.mapIndex[dataFileName]; ok {
+			this.deleteIndexByFile(dataFileName)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// build index from the data file, it is written to disk as well unless read-only
+	return this.buildIndexByFile(dataFileName)
+}
+
+
+
+/*
+	write meta to the slot which is not used by the last write, so if this write is torn, the last one is still valid
+ */
 func (this *indexInfo) writeMetaToDisk() error {
-	// insure that index file exists
+	if this.opts.ReadOnly {
+		return nil
+	}
 
+	this.generation++
+	buff := this.encodeMetaSlot()
+	pos := (this.generation % IDX_SLOT_NUM) * IDX_SLOT_SIZE
 
-	//fmt.Println("water!", this.waterLevel)
-	file := this.filePtr
-	// count for buff size
-	buffSize := IDX_HEADER_SIZE
-	buff := make([]byte, buffSize)
+	n, err := this.filePtr.WriteAt(buff, int64(pos))
+	if err == nil && uint64(n) < IDX_SLOT_SIZE {
+		err = fmt.Errorf("write the meta of %s at offset %d: %w", this.filePtr.Name(), pos, io.ErrShortWrite)
+	}
+	if err != nil {
+		// the slot of the last write must not be used by the next write
+		this.generation--
+		return err
+	}
+
+	return nil
+}
+
+// convert meta to a slot of the index file
+func (this *indexInfo) encodeMetaSlot() []byte {
+	buff := make([]byte, IDX_SLOT_SIZE)
+	binary.BigEndian.PutUint64(buff[IDX_MAGIC_POS : IDX_MAGIC_POS+NUM_LEN], IDX_SLOT_MAGIC)
+	binary.BigEndian.PutUint64(buff[IDX_GENERATION_POS : IDX_GENERATION_POS+NUM_LEN], this.generation)
 	binary.BigEndian.PutUint64(buff[IDX_DATAFILESIZE_POS : IDX_DATAFILESIZE_POS+SIZE_LEN], this.meta.dataFileSize)
 	binary.BigEndian.PutUint64(buff[IDX_RECORDNUM_POS : IDX_RECORDNUM_POS+NUM_LEN], this.meta.recordNum)
 	binary.BigEndian.PutUint64(buff[IDX_LASTRECORDPOS_POS : IDX_LASTRECORDPOS_POS+POS_LEN], this.meta.lastRecordPos)
@@ -1191,12 +1814,107 @@ func (this *indexInfo) writeMetaToDisk() error {
 	binary.BigEndian.PutUint64(buff[IDX_MAXID_POS : IDX_MAXID_POS+ID_LEN], this.meta.maxId)
 	binary.BigEndian.PutUint64(buff[IDX_RECORDLEVEL_POS : IDX_RECORDLEVEL_POS+NUM_LEN], this.waterLevel.recordCount)
 	binary.BigEndian.PutUint64(buff[IDX_SIZELEVEL_POS : IDX_SIZELEVEL_POS+SIZE_LEN], this.waterLevel.sizeCount)
-	//fmt.Println("pos:", IDX_RECORDLEVEL_POS, IDX_SIZELEVEL_POS, this.waterLevel.recordCount, this.waterLevel.sizeCount)
-	n, err := file.WriteAt(buff, 0)
+	crc := crc32.Checksum(buff[0 : IDX_SLOT_CRC_POS], CRC_TABLE)
+	binary.BigEndian.PutUint32(buff[IDX_SLOT_CRC_POS : IDX_SLOT_CRC_POS+CRC_LEN], crc)
+
+	return buff
+}
+
+// parse a slot of the index file into meta, return false if the slot is broken or never written
+func (this *indexInfo) decodeMetaSlot(buff []byte) bool {
+	if binary.BigEndian.Uint64(buff[IDX_MAGIC_POS : IDX_MAGIC_POS+NUM_LEN]) != IDX_SLOT_MAGIC {
+		return false
+	}
+	crc := binary.BigEndian.Uint32(buff[IDX_SLOT_CRC_POS : IDX_SLOT_CRC_POS+CRC_LEN])
+	if crc != crc32.Checksum(buff[0 : IDX_SLOT_CRC_POS], CRC_TABLE) {
+		return false
+	}
+
+	this.generation = binary.BigEndian.Uint64(buff[IDX_GENERATION_POS : IDX_GENERATION_POS+NUM_LEN])
+	this.meta = fileMeta{
+		dataFileSize: binary.BigEndian.Uint64(buff[IDX_DATAFILESIZE_POS : IDX_DATAFILESIZE_POS+SIZE_LEN]),
+		recordNum: binary.BigEndian.Uint64(buff[IDX_RECORDNUM_POS : IDX_RECORDNUM_POS+NUM_LEN]),
+		lastRecordPos: binary.BigEndian.Uint64(buff[IDX_LASTRECORDPOS_POS : IDX_LASTRECORDPOS_POS+POS_LEN]),
+		minId: binary.BigEndian.Uint64(buff[IDX_MINID_POS : IDX_MINID_POS+ID_LEN]),
+		maxId: binary.BigEndian.Uint64(buff[IDX_MAXID_POS : IDX_MAXID_POS+ID_LEN]),
+	}
+	this.waterLevel = waterLevelInfo{
+		recordCount: binary.BigEndian.Uint64(buff[IDX_RECORDLEVEL_POS : IDX_RECORDLEVEL_POS+NUM_LEN]),
+		sizeCount: binary.BigEndian.Uint64(buff[IDX_SIZELEVEL_POS : IDX_SIZELEVEL_POS+SIZE_LEN]),
+	}
+
+	return true
+}
+
+/*
+	check the index against its data file, the meta is stale if the process died before it was written
+ */
+func (this *diskIo) checkIndex(dataFileName string) error {
+	indexInfo := this.idxMgr.mapIndex[dataFileName]
+	meta := indexInfo.meta
+	stale := func(reason string) error {
+		return errors.New(fmt.Sprintf("index of %s is stale: %s", dataFileName, reason))
+	}
+
+	dataFile, err := os.Open(dataFileName)
 	if err != nil {
 		return err
-	} else if uint64(n) < buffSize {
-		return errors.New("write index file failed: not write completely")
+	}
+	defer dataFile.Close()
+
+	fileInfo, err := dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(fileInfo.Size()) != meta.dataFileSize {
+		return stale(fmt.Sprintf("dataFileSize is %d, but the data file has %d bytes", meta.dataFileSize, fileInfo.Size()))
+	}
+
+	if meta.recordNum == 0 {
+		if meta.dataFileSize != 0 || len(indexInfo.indexs) != 0 {
+			return stale("no record in meta, but the data file or sections are not empty")
+		}
+		return nil
+	}
+
+	// each section must point to the record it says, in order
+	if len(indexInfo.indexs) == 0 || indexInfo.indexs[0].pos != 0 || indexInfo.indexs[0].startId != meta.minId {
+		return stale("the first section is not the first record")
+	}
+	idBuff := make([]byte, ID_LEN)
+	for i, idx := range indexInfo.indexs {
+		if i > 0 && (idx.pos <= indexInfo.indexs[i-1].pos || idx.startId <= indexInfo.indexs[i-1].startId) {
+			return stale(fmt.Sprintf("section %d is out of order", i))
+		}
+		if idx.pos > meta.lastRecordPos {
+			return stale(fmt.Sprintf("section %d is after the last record", i))
+		}
+
+		if _, err := dataFile.ReadAt(idBuff, int64(idx.pos + DATA_STARTID_POS)); err != nil {
+			return err
+		}
+		if startId := binary.BigEndian.Uint64(idBuff); startId != idx.startId {
+			return stale(fmt.Sprintf("section %d says startId %d at %d, but the record has %d", i, idx.startId, idx.pos, startId))
+		}
+	}
+
+	// the last record ends at the end of the data file
+	lastElem, err := getElemByPos(dataFile, meta.lastRecordPos, this.formatOf(dataFileName))
+	if err != nil {
+		return stale(err.Error())
+	}
+	startId, endId, buff := lastElem.startId, lastElem.endId, lastElem.buff
+	if meta.lastRecordPos + this.formatOf(dataFileName).recordSize(uint64(len(buff))) != meta.dataFileSize {
+		return stale(fmt.Sprintf("the record at lastRecordPos %d doesn't end at the end of the data file", meta.lastRecordPos))
+	}
+
+	// endId of the last record is set when the file is full
+	maxId := startId
+	if endId != 0 {
+		maxId = endId
+	}
+	if meta.maxId != maxId {
+		return stale(fmt.Sprintf("maxId is %d, but the last record says %d", meta.maxId, maxId))
 	}
 
 	return nil
@@ -1211,84 +1929,89 @@ func (this *diskIo) buildIndexByFile(dataFileName string) error {
 	//open data file
 	dataFile, err := os.Open(dataFileName)
 	if err != nil {
-		glog.Errorf("open %s failed:%s\n", dataFileName, err.Error())
+		this.log().error("build_index", "open data file failed", LOG_KEY_FILE, dataFileName, LOG_KEY_ERROR, err)
 		return err
 	}
 	defer dataFile.Close()
 
+	var reader io.Reader = dataFile
+	if validSize, ok := this.validSizes[dataFileName]; ok {
+		reader = io.LimitReader(dataFile, int64(validSize))
+	}
+
 	// cycle read data file, 1MB a time, till read a EOF
-	buffSize := IDX_MAX_SECTION_SIZE
-	buff := make([]byte, buffSize)
-	restBuff := make([]byte, buffSize)
-	restBuffLen := 0
-	haveRestBuff := false
+	indexInfo := this.idxMgr.mapIndex[dataFileName]
+	buff := make([]byte, IDX_MAX_SECTION_SIZE)
+	var restBuff []byte = nil
+	offset := uint64(0) // offset of restBuff in the data file
 	for {
-		n , err := dataFile.Read(buff)
-		if err != nil && err != io.EOF {
-			glog.Errorf("read %s failed:%s\n", dataFileName, err.Error())
-			return err
-		}
-
-		if haveRestBuff {
-			buff = append(restBuff[0 : restBuffLen], buff...)
-			haveRestBuff = false
-			restBuffLen = 0
+		n, rdErr := reader.Read(buff)
+		if rdErr != nil && rdErr != io.EOF {
+			this.log().error("build_index", "read data file failed", LOG_KEY_FILE, dataFileName, LOG_KEY_ERROR, rdErr)
+			return rdErr
 		}
 
-		indexInfo := this.idxMgr.mapIndex[dataFileName]
-		rest, err := indexInfo.buildIndexByFileBuff(buff[0 : n])
+		// the tail of last read may not be a complete record
+		data := append(restBuff, buff[0 : n]...)
+		rest, err := indexInfo.buildIndexByFileBuff(data, this.formatOf(dataFileName), dataFileName, offset)
 		if err != nil {
-			if strings.Contains(err.Error(), "need more blocks") {
-				if err == io.EOF {
-					return errors.New(string("data file is imcomplete:") + err.Error())
-				} else if uint64(n) == buffSize {
-					copy(restBuff, rest)
-					restBuffLen = len(rest)
-					haveRestBuff = true
-					continue
-				}
-
+			if err != errNeedMoreBlocks {
+				this.log().error("build_index", "build index failed", LOG_KEY_FILE, dataFileName, LOG_KEY_ERROR, err)
 				return err
 			}
-
-			return err
 		}
+		offset += uint64(len(data) - len(rest))
+		restBuff = append([]byte(nil), rest...)
 
-		if uint64(n) < buffSize {
+		if rdErr == io.EOF {
+			if len(restBuff) > 0 {
+				return &CorruptError{File: dataFileName, Offset: offset,
+					Reason: fmt.Sprintf("data file is incomplete, %d bytes left at the end", len(restBuff))}
+			}
 			break
 		}
 	}
 
+	if err := indexInfo.writeMetaToDisk(); err != nil {
+		return err
+	}
+	this.log().debug("build_index", "index built from the data file", LOG_KEY_FILE, dataFileName,
+		"records", indexInfo.meta.recordNum)
 	return nil
 }
 
-//[record] = start_id(8 byte)end_id(8byte)buff_len(8 byte)buff(buff_len byte) 0 0 0 0 0 (expand to 512 bytes or n * 512 bytes)
 // cycle read records, the tail may not be a complete record, return this unhandled buff for the next read
-func (this *indexInfo) buildIndexByFileBuff(buff []byte) ([]byte, error) {
+// @param fileName, fileOffset: where buff is read from, only used to report the corruption
+func (this *indexInfo) buildIndexByFileBuff(buff []byte, format *recordFormat, fileName string, fileOffset uint64) ([]byte, error) {
 	buffLen := uint64(len(buff))
 	for nowPos := uint64(0); nowPos < buffLen; {
-		// read meta
-		startId := binary.BigEndian.Uint64(buff[nowPos + DATA_STARTID_POS : nowPos + DATA_STARTID_POS + ID_LEN])
-		//endId := binary.BigEndian.Uint64(buff[nowPos + DATA_ENDID_POS : nowPos + DATA_ENDID_POS + ID_LEN])
+		// finish read and return the unread part of buff if the remain size is less than a record
+		if nowPos + format.headSize > buffLen {
+			return buff[nowPos : ], errNeedMoreBlocks
+		}
 		dataBuffLen := binary.BigEndian.Uint64(buff[nowPos + DATA_BUFFLEN_POS : nowPos + DATA_BUFFLEN_POS + SIZE_LEN])
+		totalLen := nowPos + format.recordSize(dataBuffLen)
+		if dataBuffLen > buffLen || totalLen > buffLen {
+			return buff[nowPos : ], errNeedMoreBlocks
+		}
 
-		// get padded size
-		paddedSize := getPaddedSize(dataBuffLen)
-
-		// finish read and return the unread part of buff if the remain size is less than the data buff len
-		totalLen := nowPos + DATA_HEAD_SIZE + dataBuffLen + paddedSize
-		recordSize := DATA_HEAD_SIZE + dataBuffLen + paddedSize
-		//fmt.Println("nowPos startId, dataBuffLen, paddedSize, totalLen",nowPos, startId, dataBuffLen, paddedSize, totalLen)
-		if totalLen > buffLen {
-			return buff[nowPos : ], errors.New(fmt.Sprintf("need more blocks:totalLen %d, buffLen %d", totalLen, buffLen))
+		// check the record
+		elem, recordSize, err := format.parseRecord(buff, nowPos, fileName, fileOffset)
+		if err != nil {
+			return nil, err
 		}
 
 		// update index for each record
-		err := this.updateIndex(uint64(1), startId, recordSize)
+		err = this.updateIndex(uint64(1), elem.startId, recordSize)
 		if err != nil {
 			return nil, err
 		}
 
+		// the last record of a full file covers till the startId of the next file
+		if elem.endId != 0 {
+			this.meta.maxId = elem.endId
+		}
+
 		nowPos += recordSize
 	}
 
@@ -1296,13 +2019,19 @@ func (this *indexInfo) buildIndexByFileBuff(buff []byte) ([]byte, error) {
 }
 
 func (this *diskIo) createNewIndex(indexFileName string) error {
-	newIndexFile, err := os.Create(indexFileName)
-	if err != nil {
-		glog.Errorf("create %s failed:%s\n", indexFileName, err.Error())
-		return err
+	// a reader keeps the index in memory only
+	var newIndexFile *os.File = nil
+	if !this.opts.ReadOnly {
+		var err error
+		newIndexFile, err = os.Create(indexFileName)
+		if err != nil {
+			this.log().error("build_index", "create index file failed", LOG_KEY_FILE, indexFileName, LOG_KEY_ERROR, err)
+			return err
+		}
 	}
 
 	indexInfo := &indexInfo{
+		opts: this.opts,
 		filePtr: newIndexFile,
 		meta: fileMeta{},
 		indexs: make([]*indexElem, 0),
@@ -1315,9 +2044,13 @@ func (this *diskIo) createNewIndex(indexFileName string) error {
 }
 
 func (this *diskIo) readIndex(indexFileName string) error {
-	idxFile, err := os.OpenFile(indexFileName, os.O_RDWR, 0)
+	flag := os.O_RDWR
+	if this.opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	idxFile, err := os.OpenFile(indexFileName, flag, 0)
 	if err != nil {
-		glog.Errorf("open %s failed:%s\n", indexFileName, err.Error())
+		this.log().error("load_index", "open index file failed", LOG_KEY_FILE, indexFileName, LOG_KEY_ERROR, err)
 		return err
 	}
 
@@ -1325,35 +2058,52 @@ func (this *diskIo) readIndex(indexFileName string) error {
 
 	buff, err := readFileAll(idxFile)
 	if err != nil {
+		idxFile.Close()
+		return err
+	}
+	idxInfo, err := decodeIndex(buff, indexFileName)
+	if err != nil {
+		idxFile.Close()
 		return err
 	}
+	idxInfo.opts = this.opts
+	idxInfo.filePtr = idxFile
+
+	this.idxMgr.mapIndex[dataFileName] = idxInfo
+
+	return nil
+}
+
+// parse the content of an index file, opts and filePtr are not set
+func decodeIndex(buff []byte, indexFileName string) (*indexInfo, error) {
+	if uint64(len(buff)) < IDX_HEADER_SIZE {
+		return nil, &CorruptError{File: indexFileName, Offset: 0, Reason: fmt.Sprintf("index file is too short, %d bytes", len(buff))}
+	}
 
-	// for meta
-	//[data_file_size(8 byte)][record_num(4 byte)][last_record_pos(8 byte)][minId(8 byte)][maxId(8 byte)][record_num_level(4 byte)][size_level
-	dataFileSize := binary.BigEndian.Uint64(buff[IDX_DATAFILESIZE_POS : IDX_DATAFILESIZE_POS + SIZE_LEN])
-	recordNum := binary.BigEndian.Uint64(buff[IDX_RECORDNUM_POS : IDX_RECORDNUM_POS + NUM_LEN])
-	lastRecordPos := binary.BigEndian.Uint64(buff[IDX_LASTRECORDPOS_POS : IDX_LASTRECORDPOS_POS + POS_LEN])
-	minId := binary.BigEndian.Uint64(buff[IDX_MINID_POS : IDX_MINID_POS + ID_LEN])
-	maxId := binary.BigEndian.Uint64(buff[IDX_MAXID_POS : IDX_MAXID_POS + ID_LEN])
-	recordNumLevel := binary.BigEndian.Uint64(buff[IDX_RECORDLEVEL_POS : IDX_RECORDLEVEL_POS + NUM_LEN])
-	recordSizeLevel := binary.BigEndian.Uint64(buff[IDX_SIZELEVEL_POS : IDX_SIZELEVEL_POS + SIZE_LEN])
-	meta := fileMeta{
-		dataFileSize: dataFileSize,
-		recordNum: recordNum,
-		lastRecordPos: lastRecordPos,
-		minId: minId,
-		maxId:maxId,
-	}
-	waterLevel := waterLevelInfo{
-		recordCount: recordNumLevel,
-		sizeCount: recordSizeLevel,
-	}
-
-	// range sections
+	// for meta, take the valid slot with the larger generation
+	idxInfo := &indexInfo{}
+	found := false
+	for i := uint64(0); i < IDX_SLOT_NUM; i++ {
+		slot := &indexInfo{}
+		if !slot.decodeMetaSlot(buff[i * IDX_SLOT_SIZE : (i + 1) * IDX_SLOT_SIZE]) {
+			continue
+		}
+		if !found || slot.generation > idxInfo.generation {
+			idxInfo.generation = slot.generation
+			idxInfo.meta = slot.meta
+			idxInfo.waterLevel = slot.waterLevel
+			found = true
+		}
+	}
+	if !found {
+		return nil, &CorruptError{File: indexFileName, Offset: 0, Reason: "no valid meta in index file"}
+	}
+
+	// range sections, a torn one at the end is left out
 	//[section_index] = start_id(8 byte)pos(8 byte) // save the start position of the first record in each section
 	indexs := make([]*indexElem, 0)
 	idxLen := uint64(len(buff))
-	for nowPos := IDX_HEADER_SIZE; nowPos < idxLen; {
+	for nowPos := IDX_HEADER_SIZE; nowPos + SI_SIZE <= idxLen; {
 		startId := binary.BigEndian.Uint64(buff[nowPos + SI_STARTID_POS : nowPos + SI_STARTID_POS + ID_LEN])
 		pos := binary.BigEndian.Uint64(buff[nowPos + SI_POS_POS : nowPos + SI_POS_POS + POS_LEN])
 		indexElem := &indexElem{
@@ -1363,38 +2113,13 @@ func (this *diskIo) readIndex(indexFileName string) error {
 		indexs = append(indexs, indexElem)
 		nowPos += SI_SIZE
 	}
-	//fmt.Println("meta", meta)
-	//fmt.Println("waterlevel:", waterLevel)
-	//for _, idx := range indexs {
-	//fmt.Println("idx:", idx)
-	//}
+	idxInfo.indexs = indexs
 
-
-	indexInfo := &indexInfo {
-		filePtr: idxFile,
-		meta: meta,
-		indexs: indexs,
-		waterLevel: waterLevel,
-	}
-	this.idxMgr.mapIndex[dataFileName] = indexInfo
-
-	return nil
+	return idxInfo, nil
 }
 
+// latestFileName is kept by init, createNewDataFile and updateLastFile, this only reads, so that readers can share it
 func (this *diskIo) getLatestFileName() string {
-	if this.latestFileName == "" {
-		var latestStartId uint64 = 0
-		for filename, _ := range this.idxMgr.mapIndex {
-			id, err := this.getStartIdByFileName(filename)
-			if err == nil {
-				if id > latestStartId {
-					latestStartId = id
-					this.latestFileName = filename
-				}
-			}
-		}
-	}
-
 	return this.latestFileName
 }
 
@@ -1412,7 +2137,7 @@ func (this *diskIo) getLatestFileToWrite(id uint64, buffLen uint64) error {
 		} else { // file exists, open it
 			file, err := os.OpenFile(filename, os.O_RDWR, 0)
 			if err != nil {
-				glog.Errorf("open %s failed:%s\n", filename, err.Error())
+				this.log().error("push", "open data file failed", LOG_KEY_FILE, filename, LOG_KEY_INDEX, id, LOG_KEY_ERROR, err)
 				return err
 			}
 
@@ -1420,20 +2145,29 @@ func (this *diskIo) getLatestFileToWrite(id uint64, buffLen uint64) error {
 		}
 	}
 
-	// check size of the file, if exceed the DATA_MAX_FILE_SIZE, open a new data file for write
-	writeSize := buffLen + DATA_HEAD_SIZE
+	// check size of the file, if exceed the DataMaxFileSize, open a new data file for write. a data file written before
+	// the store was upgraded is not appended to, so the records pushed keep their terms
+	writeSize := this.format.recordSize(buffLen)
 	indexInfo := this.idxMgr.mapIndex[filename]
-	if indexInfo.meta.dataFileSize+writeSize > DATA_MAX_FILE_SIZE {
+	if indexInfo.meta.dataFileSize+writeSize > this.opts.DataMaxFileSize || this.formatOf(filename) != this.format {
 		// update maxId of the last file
-		this.idxMgr.mapIndex[filename].meta.maxId = id-1
+		indexInfo.meta.maxId = id-1
+		if err := indexInfo.writeMetaToDisk(); err != nil {
+			return err
+		}
 
-		// close the last file
+		// flush and close the last file, the syncer only flushes the latest one
+		if err := this.sync(); err != nil {
+			return err
+		}
 		this.latestFilePtr.Close()
 
 		// open a new one
 		if err := this.createNewDataFile(id); err != nil {
 			return err
 		}
+		this.log().debug("rollover", "roll over to a new data file", LOG_KEY_FILE, this.latestFileName, LOG_KEY_INDEX, id,
+			"full_file", filename)
 
 		return nil
 	}
@@ -1446,24 +2180,35 @@ func (this *diskIo) createNewDataFile(id uint64) error {
 	// generate filename
 	filename := this.getFileNameByStartId(id)
 
+	// the segments of the old format may be followed by it after the ones of the latest format are truncated, the
+	// meta file must tell it before it is created
+	if this.oldFormat != nil && id < this.upgradeFrom {
+		upgradeFrom := this.upgradeFrom
+		this.upgradeFrom = id
+		if err := this.writeStoreMeta(); err != nil {
+			this.upgradeFrom = upgradeFrom
+			return err
+		}
+	}
+
 	// create new file
 	file, err := os.Create(filename)
 	if err != nil {
-		return errors.New("createNewDataFile failed:" + err.Error())
+		return fmt.Errorf("create the data file of log index %d: %w", id, err)
 	}
 	this.latestFileName = filename
 	this.latestFilePtr = file
 
 	// create new index file
 	idxFileName := dataFileNameToIdxFileName(filename)
-	//idxFileName := fmt.Sprintf("%s_%0*d.idx", this.header, FILE_NAME_NUMLEN, id)
 	// idxFileName = filepath.Join(this.path, idxFileName)
 	idxFile, err := os.Create(idxFileName)
 	if err != nil {
-		glog.Errorf("create %s failed:%s\n", idxFileName, err.Error())
+		this.log().error("create_file", "create index file failed", LOG_KEY_FILE, idxFileName, LOG_KEY_ERROR, err)
 		return err
 	}
 	indexInfo := &indexInfo{
+		opts: this.opts,
 		filePtr: idxFile,
 		meta: fileMeta{},
 		indexs: make([]*indexElem, 0),
@@ -1471,6 +2216,14 @@ func (this *diskIo) createNewDataFile(id uint64) error {
 	}
 	this.idxMgr.mapIndex[filename] = indexInfo
 
+	// make the new files durable
+	if this.needSync() {
+		if err := syncDir(this.path); err != nil {
+			this.log().error("create_file", "sync the directory failed", LOG_KEY_FILE, this.path, LOG_KEY_ERROR, err)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -1496,13 +2249,13 @@ func (this *diskIo) checkIdValid(startId uint64) error {
 	idBuff := make([]byte, ID_LEN)
 	_, err = lastFile.ReadAt(idBuff, int64(lastPos))
 	if err != nil {
-		glog.Errorf("read lastfile failed:%s\n", err.Error())
+		this.log().error("push", "read the last record failed", LOG_KEY_FILE, this.getLatestFileName(), LOG_KEY_INDEX, startId, LOG_KEY_ERROR, err)
 		return err
 	}
 
 	lastStartId := binary.BigEndian.Uint64(idBuff)
 	if startId <= lastStartId {
-		return errors.New("id is less than the last startId\n")
+		return &OutOfOrderError{LogIndex: startId, LastIndex: lastStartId}
 	}
 
 	return nil
@@ -1550,48 +2303,28 @@ func (this *diskIo) updateLastElem(startId uint64) error {
 	binary.BigEndian.PutUint64(idBuff, endId)
 	_, err := lastFile.WriteAt(idBuff, int64(lastPos))
 	if err != nil {
-		glog.Errorf("write last file failed:%s\n", err.Error())
+		this.log().error("push", "update endId of the last record failed", LOG_KEY_FILE, lastFileName, LOG_KEY_INDEX, startId, LOG_KEY_ERROR, err)
 		return err
 	}
 
 	return nil
 }
 
-func (this *diskIo) appendElem(startId uint64, buff []byte) error {
+func (this *diskIo) appendElem(startId uint64, term uint64, buff []byte) error {
 	file := this.latestFilePtr
 
-	buffLen := uint64(len(buff))
-	headerSize := DATA_HEAD_SIZE
-	headerBuff := make([]byte, headerSize)
-
-	binary.BigEndian.PutUint64(headerBuff[DATA_STARTID_POS : DATA_STARTID_POS+ID_LEN], startId)
-	binary.BigEndian.PutUint64(headerBuff[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS+SIZE_LEN], buffLen)
+	// header, buff and the padded 0 (each block not full will be padded with 0 at the tail) are written at once
+	record := this.format.encode(startId, 0, term, buff)
 
 	lastFileName := this.getLatestFileName()
 	dataFileSize := this.idxMgr.mapIndex[lastFileName].meta.dataFileSize
 
-	n, err := file.WriteAt(headerBuff, int64(dataFileSize))
-	if err != nil {
-		return err
-	} else if n < int(headerSize) {
-		return errors.New("write new record to data file failed: header not write completely\n")
-	}
-
-	n, err = file.WriteAt(buff, int64(dataFileSize)+int64(headerSize))
+	n, err := file.WriteAt(record, int64(dataFileSize))
 	if err != nil {
 		return err
-	} else if n < int(buffLen) {
-		return errors.New(fmt.Sprintf("write new record to data file failed: buff not write completely, written %d, datasize:%d\n", n, int(buffLen)))
-	}
-
-	// each block not full will be padded with 0 at the tail
-	paddedSize := getPaddedSize(buffLen)
-	paddedBuff := make([]byte, paddedSize)
-	n, err = file.WriteAt(paddedBuff, int64(dataFileSize + headerSize + buffLen))
-	if err != nil {
-		return err
-	} else if n < int(paddedSize) {
-		return errors.New(fmt.Sprintf("write padded 0 to data file failed: buff not write completely, written %d, padded datasize:%d\n", n, int(paddedSize)))
+	} else if n < len(record) {
+		return fmt.Errorf("write the record of log index %d to %s at offset %d, %d of %d bytes written: %w",
+			startId, lastFileName, dataFileSize, n, len(record), io.ErrShortWrite)
 	}
 
 	return nil
@@ -1601,7 +2334,7 @@ func (this *diskIo) getLastElemPos() (uint64, error) {
 	lastFileName := this.getLatestFileName()
 	lastFileIdxInfo := this.idxMgr.mapIndex[lastFileName]
 	if lastFileIdxInfo == nil {
-		return 0, errors.New(fmt.Sprintf("count not find index info for data file %s\n", lastFileName))
+		return 0, &CorruptError{File: lastFileName, Reason: "no index is loaded for the latest data file"}
 	}
 
 	return lastFileIdxInfo.meta.lastRecordPos, nil
@@ -1613,42 +2346,23 @@ func (this *diskIo) getLatestElem() (uint64, []byte, error) {
 	lastPos := indexInfo.meta.lastRecordPos
 	lastFile := this.latestFilePtr
 
-	// read a block
-	buff := make([]byte, DATA_BLOCK_SIZE)
-	_, err := lastFile.ReadAt(buff, int64(lastPos))
+	elem, err := getElemByPos(lastFile, lastPos, this.formatOf(lastFileName))
 	if err != nil {
 		return 0, nil, err
 	}
-
-	// read header
-	startId := binary.BigEndian.Uint64(buff[DATA_STARTID_POS : DATA_STARTID_POS + ID_LEN])
-	//endId := binary.BigEndian.Uint64(buff[DATA_ENDID_POS : DATA_ENDID_POS + ID_LEN])
-	buffLen := binary.BigEndian.Uint64(buff[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS + SIZE_LEN])
-
-	// if one block is enough, return it
-	if buffLen+DATA_HEAD_SIZE <= DATA_BLOCK_SIZE {
-		return startId, buff[DATA_BUFF_POS : DATA_BUFF_POS+buffLen], nil
-	} else {
-		newBuff := make([]byte, buffLen)
-		// copy the first block
-		copy(newBuff, buff[DATA_BUFF_POS : DATA_BLOCK_SIZE])
-
-		// copy others
-		nowPos := DATA_BLOCK_SIZE - DATA_HEAD_SIZE
-		_, err := lastFile.ReadAt(buff[nowPos:buffLen], int64(lastPos)+int64(DATA_BLOCK_SIZE))
-		if err != nil {
-			return 0, nil, err
-		}
-
-		return startId, newBuff, nil
-	}
+	return elem.startId, elem.buff, nil
 }
 
 func (this *diskIo) updateLastIndex(count uint64, startId uint64, buffLen uint64) error {
 	lastFileName := this.getLatestFileName()
 
-	addSize := DATA_HEAD_SIZE + buffLen + getPaddedSize(buffLen)
-	return this.updateIndex(lastFileName, count, startId, addSize)
+	addSize := this.format.recordSize(buffLen)
+	if err := this.updateIndex(lastFileName, count, startId, addSize); err != nil {
+		return err
+	}
+
+	// meta is kept up to date on disk, not only when closing
+	return this.idxMgr.mapIndex[lastFileName].writeMetaToDisk()
 }
 
 func (this *diskIo) updateIndex(filename string, count uint64, startId uint64, size uint64) error {
@@ -1676,7 +2390,7 @@ func (this *indexInfo) updateIndex(count uint64, startId uint64, size uint64) er
 	this.waterLevel.recordCount += count
 	this.waterLevel.sizeCount += size
 
-	if this.waterLevel.recordCount > IDX_MAX_RECORD_PER_SECTION ||
+	if this.waterLevel.recordCount > this.opts.IdxMaxRecordPerSection ||
 		this.waterLevel.sizeCount > IDX_MAX_SECTION_SIZE ||
 		this.waterLevel.recordCount == 1 {
 		// add new index
@@ -1700,8 +2414,12 @@ func (this *indexInfo) addNewIndex(startId uint64, pos uint64) error {
 	}
 	indexTailPos := IDX_HEADER_SIZE + uint64(len(this.indexs)) * SI_SIZE
 
-	// write to disk
+	// write to disk, a reader keeps it in memory only
 	file := this.filePtr
+	if this.opts.ReadOnly {
+		this.indexs = append(this.indexs, idx)
+		return nil
+	}
 	buff := make([]byte, SI_SIZE)
 	binary.BigEndian.PutUint64(buff[SI_STARTID_POS : SI_STARTID_POS+ID_LEN], startId)
 	binary.BigEndian.PutUint64(buff[SI_POS_POS : SI_POS_POS+POS_LEN], pos)
@@ -1709,7 +2427,7 @@ func (this *indexInfo) addNewIndex(startId uint64, pos uint64) error {
 	if err != nil {
 		return err
 	} else if uint64(n) < SI_SIZE {
-		return errors.New("add new index to disk failed: not write completely")
+		return fmt.Errorf("write the index of log index %d to %s at offset %d: %w", startId, file.Name(), indexTailPos, io.ErrShortWrite)
 	}
 
 	// write to memory
@@ -1719,22 +2437,25 @@ func (this *indexInfo) addNewIndex(startId uint64, pos uint64) error {
 }
 
 func (this *diskIo) getStartIdByFileName(fileName string) (uint64, error) {
-	fileName = filepath.Base(fileName)
-	fileName = strings.TrimLeft(fileName, this.header+"_")
-	fileName = strings.TrimRight(fileName, ".data")
+	num := filepath.Base(fileName)
+	num = strings.TrimLeft(num, this.header+"_")
+	num = strings.TrimRight(num, ".data")
 
 	// check num len
-	if len(fileName) != FILE_NAME_NUMLEN {
-		return 0, errors.New("illegal data filename")
+	if len(num) != this.opts.FileNameNumLen {
+		return 0, &CorruptError{File: fileName, Reason: "illegal data filename"}
 	}
 
-	i, _ := strconv.ParseInt(fileName, 10, 64)
-	return uint64(i), nil
+	i, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, &CorruptError{File: fileName, Reason: "illegal data filename", Err: err}
+	}
+	return i, nil
 }
 
 func (this *diskIo) getFileNameByStartId(id uint64) string {
 	// generate filename
-	filename := fmt.Sprintf("%s_%0*d.data", this.header, FILE_NAME_NUMLEN, id)
+	filename := fmt.Sprintf("%s_%0*d.data", this.header, this.opts.FileNameNumLen, id)
 	filename = filepath.Join(this.path, filename)
 
 	return filename
@@ -1748,21 +2469,6 @@ func idxFileNameToDataFileName(idxFileName string) string {
 	return strings.TrimRight(idxFileName, ".idx") + ".data"
 }
 
-/*
- when the length of a record is more than the DATA_BLOCK_SIZE, will across multiple blocks, and padded with '\0' at the end to filling-in the entire block
- this func is used to find how many '\0' was padded
- @param buffLen : length of the record buff, not contain the length of startId, endId fields
- @return paddedSize: size of the padded parts
-  */
-func getPaddedSize(buffLen uint64) (uint64) {
-	tailSize := (DATA_HEAD_SIZE + buffLen) % DATA_BLOCK_SIZE
-	if tailSize == 0 {
-		return uint64(0)
-	} else {
-		return DATA_BLOCK_SIZE - tailSize
-	}
-}
-
 func newIdxMgrSorter(disk *diskIo) *idxMgrSorter {
 	sorter := &idxMgrSorter{
 		disk: disk,
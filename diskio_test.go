@@ -2,6 +2,8 @@ package conf
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -285,7 +287,6 @@ func Test_truncateBefore1(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	defer disk.close()
 
 	// push [100, 1500000]
 	err = pushDiskElems(disk, 15000)
@@ -319,6 +320,8 @@ func Test_truncateBefore1(t *testing.T) {
 		}
 	}
 
+	disk.close()
+
 	// delete index file
 	removeIndexs(DISK_DATA_PATH)
 
@@ -349,7 +352,6 @@ func Test_truncateAfter1(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	defer disk.close()
 
 	err = pushDiskElems(disk, 15000)
 	if err != nil {
@@ -405,6 +407,8 @@ func Test_truncateAfter1(t *testing.T) {
 		}
 	}
 
+	disk.close()
+
 	// delete index file
 	removeIndexs(DISK_DATA_PATH)
 
@@ -475,3 +479,135 @@ func Test_listBetween(t *testing.T) {
 func getBuff(id int) string {
 	return fmt.Sprintf("this is a buff for test %d", id)
 }
+
+// meta is written after each append, a store not closed can be opened without rebuilding the index
+func Test_indexMetaSlots(t *testing.T) {
+	removeAll(DISK_DATA_PATH)
+	disk, err := getDiskIO(DISK_DATA_PATH, DISK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err = pushDiskElems(disk, 10); err != nil {
+		t.Error(err)
+		return
+	}
+	fileName := disk.getLatestFileName()
+	idxFileName := dataFileNameToIdxFileName(fileName)
+	generation := disk.idxMgr.mapIndex[fileName].generation
+
+	// no close
+	crash(disk)
+	disk2, err := getDiskIO(DISK_DATA_PATH, DISK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	info := disk2.idxMgr.mapIndex[fileName]
+	if info.generation != generation || info.meta != disk.idxMgr.mapIndex[fileName].meta {
+		t.Errorf("index must be loaded from the last slot, generation %d, expected %d\n", info.generation, generation)
+	}
+	disk2.close()
+
+	// break the slot written by close(), the one before it is used
+	file, err := os.OpenFile(idxFileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lastSlotPos := ((generation + 1) % IDX_SLOT_NUM) * IDX_SLOT_SIZE
+	file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(lastSlotPos + IDX_MAXID_POS))
+	file.Close()
+
+	disk3 := &diskIo{
+		path: disk.path,
+		header: disk.header,
+		opts: disk.opts,
+		format: disk.format,
+		idxMgr: &indexMgr{mapIndex: make(map[string]*indexInfo)},
+	}
+	if err = disk3.readIndex(idxFileName); err != nil {
+		t.Error(err)
+		return
+	}
+	if disk3.idxMgr.mapIndex[fileName].generation != generation {
+		t.Errorf("generation must be %d, but get %d\n", generation, disk3.idxMgr.mapIndex[fileName].generation)
+	}
+	if err = disk3.checkIndex(fileName); err != nil {
+		t.Error("index must be valid:", err)
+	}
+	disk3.idxMgr.mapIndex[fileName].filePtr.Close()
+}
+
+// index saved before the last appends is rebuilt when opening
+func Test_staleIndexRebuilt(t *testing.T) {
+	removeAll(DISK_DATA_PATH)
+	disk, err := getDiskIO(DISK_DATA_PATH, DISK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushDiskElems(disk, 5); err != nil {
+		t.Error(err)
+		return
+	}
+	fileName := disk.getLatestFileName()
+	idxFileName := dataFileNameToIdxFileName(fileName)
+	oldIdx, err := ioutil.ReadFile(idxFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// 5 more, the index file goes back to the old one
+	for id := uint64(600); id <= 1000; id += 100 {
+		if err = disk.append(id, []byte(getBuff(int(id)))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	disk.close()
+	if err = ioutil.WriteFile(idxFileName, oldIdx, 0666); err != nil {
+		t.Error(err)
+		return
+	}
+
+	disk, err = getDiskIO(DISK_DATA_PATH, DISK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer disk.close()
+
+	lastId, buff, err := disk.last()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if lastId != 1000 || string(buff) != getBuff(1000) {
+		t.Errorf("last must be 1000, but get %d:%s\n", lastId, string(buff))
+	}
+
+	elems, err := disk.listAfter(100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(elems) != 10 {
+		t.Errorf("expected 10 elems, but get %d\n", len(elems))
+	}
+}
+
+// simulate the process dies: the files are closed without writing anything, and the lock is released with them
+func crash(disk *diskIo) {
+	for _, indexInfo := range disk.idxMgr.mapIndex {
+		if indexInfo.filePtr != nil {
+			indexInfo.filePtr.Close()
+		}
+	}
+	if disk.latestFilePtr != nil {
+		disk.latestFilePtr.Close()
+	}
+	disk.unlock()
+}
@@ -0,0 +1,139 @@
+package conf
+
+/*
+	the errors returned by ConfManager, test them by errors.Is, the errors returned carry the context of the failure
+	(log index, file and offset) and match the sentinel of their kind:
+
+	ErrNotFound:   no config covers the log index, *NotFoundError. it is ErrorConfigNotExist of rafted/persist
+	ErrOutOfOrder: a config is pushed at a log index not larger than the last one, *OutOfOrderError
+	ErrConflict:   a config is pushed over a different one, *ConflictError, it is ErrOutOfOrder as well
+	ErrCorrupt:    a file of the store is broken, *CorruptError
+	ErrClosed:     the ConfManager is closed
+	ErrLocked:     the store is opened by another process, *LockedError
+	ErrTooLarge:   a record or a result is over its limit, *TooLargeError
+	ErrReadOnly:   a write to a store opened with Options.ReadOnly
+
+		if _, err := cm.GetConfig(logIndex); errors.Is(err, ErrNotFound) {
+			...
+		}
+
+	errors other than these are the ones of the OS or the codec, wrapped with the file, offset or log index. the error of
+	the OS is kept behind them and a *CorruptError, so errors.Is(err, os.ErrNotExist) still works.
+ */
+
+import (
+	"errors"
+	"fmt"
+	. "rafted/persist"
+)
+
+var (
+	ErrNotFound   = ErrorConfigNotExist
+	ErrOutOfOrder = errors.New("log index is out of order")
+	ErrConflict   = errors.New("config conflicts with the one stored")
+	ErrCorrupt    = errors.New("store is corrupt")
+	ErrClosed     = errors.New("store is closed")
+	ErrLocked     = errors.New("store is locked by another process")
+	ErrTooLarge   = errors.New("too large")
+	ErrReadOnly   = errors.New("store is opened read-only")
+)
+
+// no config covers LogIndex
+type NotFoundError struct {
+	LogIndex uint64
+}
+
+func (this *NotFoundError) Error() string {
+	return fmt.Sprintf("%s: no config covers log index %d", ErrNotFound.Error(), this.LogIndex)
+}
+
+func (this *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// LogIndex is pushed after the config starting from LastIndex
+type OutOfOrderError struct {
+	LogIndex  uint64
+	LastIndex uint64
+}
+
+func (this *OutOfOrderError) Error() string {
+	return fmt.Sprintf("%s: log index %d is not larger than the last one %d", ErrOutOfOrder.Error(), this.LogIndex, this.LastIndex)
+}
+
+func (this *OutOfOrderError) Is(target error) bool {
+	return target == ErrOutOfOrder
+}
+
+// a config is pushed at LogIndex, which is covered by the one from StartId, and they differ
+type ConflictError struct {
+	LogIndex uint64
+	StartId  uint64 // the first config kept if LogIndex is before it
+}
+
+func (this *ConflictError) Error() string {
+	if this.StartId == this.LogIndex {
+		return fmt.Sprintf("%s: log index %d has another config", ErrConflict.Error(), this.LogIndex)
+	} else if this.LogIndex < this.StartId {
+		return fmt.Sprintf("%s: log index %d is before the first config kept from %d", ErrConflict.Error(), this.LogIndex, this.StartId)
+	}
+	return fmt.Sprintf("%s: log index %d is covered by the config from %d", ErrConflict.Error(), this.LogIndex, this.StartId)
+}
+
+func (this *ConflictError) Is(target error) bool {
+	return target == ErrConflict || target == ErrOutOfOrder
+}
+
+// a file of the store is broken, tells where it is
+type CorruptError struct {
+	File   string // data, index, meta or journal file
+	Offset uint64 // offset of the broken part in the file
+	Reason string
+	Err    error  // the error of the OS behind it, nil if the content is broken
+}
+
+func (this *CorruptError) Error() string {
+	if this.Err != nil {
+		return fmt.Sprintf("%s: %s at offset %d: %s: %s", ErrCorrupt.Error(), this.File, this.Offset, this.Reason, this.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s at offset %d: %s", ErrCorrupt.Error(), this.File, this.Offset, this.Reason)
+}
+
+func (this *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+func (this *CorruptError) Unwrap() error {
+	return this.Err
+}
+
+// the lock of a store is held by someone else
+type LockedError struct {
+	File string // lock file
+	PID  int    // process holding the lock, 0 if unknown
+}
+
+func (this *LockedError) Error() string {
+	if this.PID > 0 {
+		return fmt.Sprintf("%s: %s is held by process %d", ErrLocked.Error(), this.File, this.PID)
+	}
+	return fmt.Sprintf("%s: %s is held by another process", ErrLocked.Error(), this.File)
+}
+
+func (this *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// What is over Limit, e.g. the size of a record or the number of configs in a result
+type TooLargeError struct {
+	What  string
+	Limit uint64
+}
+
+func (this *TooLargeError) Error() string {
+	return fmt.Sprintf("%s: %s, the limit is %d", ErrTooLarge.Error(), this.What, this.Limit)
+}
+
+func (this *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
@@ -0,0 +1,204 @@
+package conf
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	. "rafted/persist"
+)
+
+var (
+	ERRORS_DATA_PATH = "./errors_data"
+	ERRORS_DATA_HEADER = "errors"
+)
+
+func Test_errorsNotFound(t *testing.T) {
+	cm, err := getTestStore(ERRORS_DATA_PATH, ERRORS_DATA_HEADER, 0, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	if _, err = cm.LastConfig(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LastConfig must return ErrNotFound, but get %v\n", err)
+	}
+	if err = pushConf(cm, START_ID, ID_RANGE, 10); err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = cm.GetConfig(uint64(START_ID - 1))
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.LogIndex != uint64(START_ID - 1) {
+		t.Errorf("GetConfig must return a NotFoundError of %d, but get %v\n", START_ID - 1, err)
+	}
+	// rafted compares it with ErrorConfigNotExist
+	if !errors.Is(err, ErrorConfigNotExist) || !errors.Is(err, CM_NOTFOUND_ERR) {
+		t.Errorf("%v must be ErrorConfigNotExist\n", err)
+	}
+	if _, err = cm.ListBefore(uint64(START_ID - 1), 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ListBefore must return ErrNotFound, but get %v\n", err)
+	}
+	if !errors.Is(DISK_NOTFOUND_ERR, ErrNotFound) || !errors.Is(MEM_NOTFOUND_ERR, ErrNotFound) {
+		t.Error("the internal not found errors must be ErrNotFound")
+	}
+}
+
+func Test_errorsOutOfOrder(t *testing.T) {
+	cm, err := getTestStore(ERRORS_DATA_PATH, ERRORS_DATA_HEADER, 0, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	if err = pushConf(cm, START_ID, ID_RANGE, 3); err != nil {
+		t.Error(err)
+		return
+	}
+	last := uint64(START_ID + 2 * ID_RANGE)
+	err = cm.PushConfig(last, getConf(int(last) + 1))
+	var conflict *ConflictError
+	if !errors.Is(err, ErrOutOfOrder) || !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) {
+		t.Errorf("expected ErrConflict, but get %v\n", err)
+		return
+	}
+	if conflict.LogIndex != last || conflict.StartId != last {
+		t.Errorf("expected log index %d of the config from %d, but get %d of %d\n", last, last, conflict.LogIndex, conflict.StartId)
+	}
+
+	// the disk checks it as well
+	err = cm.store.disk.append(last, []byte("config"))
+	var outOfOrder *OutOfOrderError
+	if !errors.As(err, &outOfOrder) || outOfOrder.LogIndex != last || outOfOrder.LastIndex != last {
+		t.Errorf("expected an OutOfOrderError of %d after %d, but get %v\n", last, last, err)
+	}
+}
+
+func Test_errorsTooLarge(t *testing.T) {
+	tweak := func(opts *Options) {
+		opts.DataMaxFileSize = 4 * opts.DataBlockSize
+		opts.MaxResultNum = 5
+	}
+	opts := getTestOptions(tweak)
+	cm, err := getTestStore(ERRORS_DATA_PATH, ERRORS_DATA_HEADER, 0, tweak)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// a record larger than a data file
+	if _, err = cm.store.push(uint64(START_ID), 0, make([]byte, opts.DataMaxFileSize)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("push a record larger than DataMaxFileSize must return ErrTooLarge, but get %v\n", err)
+	}
+	if _, err = cm.LastConfig(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("the record too large must not be pushed, but get %v\n", err)
+	}
+
+	if err = pushConf(cm, START_ID, ID_RANGE, 10); err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = cm.ListBetween(0, UINT64_MAX)
+	var tooLarge *TooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != uint64(opts.MaxResultNum) {
+		t.Errorf("ListBetween must return a TooLargeError, but get %v\n", err)
+	}
+}
+
+func Test_errorsCorrupt(t *testing.T) {
+	cm, err := getTestStore(ERRORS_DATA_PATH, ERRORS_DATA_HEADER, 0, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	metaFileName := cm.store.disk.getMetaFileName()
+	cm.Close()
+
+	if err = ioutil.WriteFile(metaFileName, make([]byte, META_SIZE), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = GetConfManager(ERRORS_DATA_PATH, ERRORS_DATA_HEADER)
+	var corrupt *CorruptError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.File != metaFileName {
+		t.Errorf("open a store with a broken meta file must return ErrCorrupt of it, but get %v\n", err)
+	}
+}
+
+func Test_errorsDataFileGone(t *testing.T) {
+	tweak := func(opts *Options) {
+		opts.DataMaxFileSize = 4 * 1024
+	}
+	cm, err := getTestStore(ERRORS_DATA_PATH, ERRORS_DATA_HEADER, 100, tweak)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// the first data file, its configs are only on disk
+	fileName := cm.store.disk.getFileNameByStartId(uint64(START_ID))
+	if fileName == cm.store.disk.getLatestFileName() {
+		t.Errorf("the configs must be written to more than one data file\n")
+		return
+	}
+	if err = os.Remove(fileName); err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = cm.GetConfig(uint64(START_ID))
+	var corrupt *CorruptError
+	if !errors.Is(err, os.ErrNotExist) || !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.File != fileName {
+		t.Errorf("GetConfig from a data file gone must return ErrCorrupt of it keeping os.ErrNotExist, but get %v\n", err)
+	}
+	if _, err = cm.ListAfter(uint64(START_ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ListAfter from a data file gone must keep os.ErrNotExist, but get %v\n", err)
+	}
+}
+
+func Test_errorsClosed(t *testing.T) {
+	cm, err := getTestStore(ERRORS_DATA_PATH, ERRORS_DATA_HEADER, 0, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cm, START_ID, ID_RANGE, 3); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+	it := cm.Iterator(0, UINT64_MAX)
+	cm.Close()
+	// more than once
+	cm.Close()
+
+	if err = cm.PushConfig(uint64(START_ID + 3 * ID_RANGE), getConf(START_ID + 3 * ID_RANGE)); err != ErrClosed {
+		t.Errorf("PushConfig must return ErrClosed, but get %v\n", err)
+	}
+	if _, err = cm.GetConfig(uint64(START_ID)); err != ErrClosed {
+		t.Errorf("GetConfig must return ErrClosed, but get %v\n", err)
+	}
+	if _, err = cm.LastConfig(); err != ErrClosed {
+		t.Errorf("LastConfig must return ErrClosed, but get %v\n", err)
+	}
+	if _, err = cm.ListAfter(uint64(START_ID)); err != ErrClosed {
+		t.Errorf("ListAfter must return ErrClosed, but get %v\n", err)
+	}
+	if _, _, err = cm.ListPage(uint64(START_ID), 10); err != ErrClosed {
+		t.Errorf("ListPage must return ErrClosed, but get %v\n", err)
+	}
+	if err = cm.TruncateBefore(uint64(START_ID)); err != ErrClosed {
+		t.Errorf("TruncateBefore must return ErrClosed, but get %v\n", err)
+	}
+	if err = cm.TruncateAfter(uint64(START_ID)); err != ErrClosed {
+		t.Errorf("TruncateAfter must return ErrClosed, but get %v\n", err)
+	}
+	if it.Next() || it.Err() != ErrClosed {
+		t.Errorf("Iterator must stop with ErrClosed, but get %v\n", it.Err())
+	}
+}
@@ -0,0 +1,114 @@
+package conf
+
+/*
+	export writes the config history as JSON for people to read, e.g. to attach it to a ticket, and import loads it
+	into the store of another environment.
+
+	one object is written per config, each on its own line:
+	{"FromLogIndex":100,"ToLogIndex":199,"Term":3,"Servers":{...},"NewServers":{...}}
+	Servers and NewServers are the ones of Config, as encoding/json writes them. Term is 0 if the config was pushed
+	without a term. ToLogIndex of the last config of the store is UINT64_MAX.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	. "rafted/persist"
+)
+
+// a config as it is exported
+type exportRecord struct {
+	FromLogIndex uint64
+	ToLogIndex   uint64
+	Term         uint64
+	Servers      *ServerAddressSlice
+	NewServers   *ServerAddressSlice
+}
+
+/*
+	write the configs covering the log indexes in [from, to] to w, use 0 and UINT64_MAX for all of them.
+	the writes to the store wait till it is done.
+ */
+func (this *ConfManager) ExportJSON(w io.Writer, from, to uint64) error {
+	encoder := json.NewEncoder(w)
+	return this.store.ScanRaw(from, to, func(raw *RangeRecord) error {
+		meta, err := rangeRecordToConfigMeta(this.codec, raw)
+		if err != nil {
+			return err
+		}
+		record := &exportRecord{
+			FromLogIndex: meta.FromLogIndex,
+			ToLogIndex: meta.ToLogIndex,
+			Term: raw.Term,
+			Servers: meta.Conf.Servers,
+			NewServers: meta.Conf.NewServers,
+		}
+		return encoder.Encode(record)
+	})
+}
+
+/*
+	load the configs written by ExportJSON to the store, which must be empty. r is read to the end and checked before
+	the store is changed: the configs must follow one another without a gap, an error telling where the export is
+	illegal is returned if not, and ErrTooLarge for a config which can't be put in a data file. they are loaded as
+	RestoreSnapshot does, all or nothing, and the watchers are told by Restored.
+	ToLogIndex of the last config is not used, it is the last config of the store.
+ */
+func (this *ConfManager) ImportJSON(r io.Reader) error {
+	records, err := decodeExport(r)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	n := 0
+	return this.store.load(func() (*diskElem, error) {
+		if n >= len(records) {
+			return nil, nil
+		}
+		record := records[n]
+		n++
+
+		buff, err := this.codec.Marshal(&Config{Servers: record.Servers, NewServers: record.NewServers})
+		if err != nil {
+			return nil, err
+		}
+		return &diskElem{startId: record.FromLogIndex, term: record.Term, buff: buff}, nil
+	})
+}
+
+func decodeExport(r io.Reader) ([]*exportRecord, error) {
+	illegal := func(offset int64, reason string) error {
+		return errors.New(fmt.Sprintf("illegal export at offset %d: %s", offset, reason))
+	}
+
+	records := make([]*exportRecord, 0)
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	for {
+		offset := decoder.InputOffset()
+		record := &exportRecord{}
+		if err := decoder.Decode(record); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("illegal export at offset %d: config %d: %w", offset, len(records), err)
+		}
+
+		if record.ToLogIndex < record.FromLogIndex {
+			return nil, illegal(offset, fmt.Sprintf("config %d ends at %d before it starts from %d", len(records), record.ToLogIndex, record.FromLogIndex))
+		}
+		if len(records) > 0 {
+			last := records[len(records)-1]
+			if last.ToLogIndex == UINT64_MAX || record.FromLogIndex != last.ToLogIndex + 1 {
+				return nil, illegal(offset, fmt.Sprintf("config %d from %d doesn't follow the one before till %d", len(records), record.FromLogIndex, last.ToLogIndex))
+			}
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,138 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// configs [0, count) of a source store pushed with terms, exported, and an empty target store
+func getExport(t *testing.T, count int, from, to uint64) *bytes.Buffer {
+	removeAll(filepath.Join(SNAPSHOT_DATA_PATH, SNAPSHOT_SOURCE_HEADER))
+	removeAll(filepath.Join(SNAPSHOT_DATA_PATH, SNAPSHOT_TARGET_HEADER))
+	source, err := getSnapshotStore(SNAPSHOT_SOURCE_HEADER, JSONCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if err = pushConfWithTerm(source, count); err != nil {
+		t.Fatal(err)
+	}
+
+	export := &bytes.Buffer{}
+	if err = source.ExportJSON(export, from, to); err != nil {
+		t.Fatal(err)
+	}
+	return export
+}
+
+func Test_exportImport(t *testing.T) {
+	count := 61
+	export := getExport(t, count, 0, UINT64_MAX)
+	if lines := strings.Count(export.String(), "\n"); lines != count {
+		t.Errorf("expected %d lines, but get %d\n", count, lines)
+	}
+
+	cm, err := getSnapshotStore(SNAPSHOT_TARGET_HEADER, MsgpackCodec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if err = cm.ImportJSON(bytes.NewReader(export.Bytes())); err != nil {
+		t.Error(err)
+		return
+	}
+	checkRestored(t, cm, count, "imported")
+
+	// only to an empty store
+	if err = cm.ImportJSON(bytes.NewReader(export.Bytes())); err == nil {
+		t.Error("a store with configs must not be imported to")
+	}
+}
+
+func Test_exportRange(t *testing.T) {
+	from, to := uint64(START_ID + 10 * ID_RANGE + 5), uint64(START_ID + 20 * ID_RANGE)
+	export := getExport(t, 61, from, to)
+
+	records := make([]*exportRecord, 0)
+	decoder := json.NewDecoder(export)
+	for decoder.More() {
+		record := &exportRecord{}
+		if err := decoder.Decode(record); err != nil {
+			t.Error(err)
+			return
+		}
+		records = append(records, record)
+	}
+	if len(records) != 11 || records[0].FromLogIndex != uint64(START_ID + 10 * ID_RANGE) || records[10].FromLogIndex != to {
+		t.Errorf("expected configs from %d to %d, but get %d of them\n", START_ID + 10 * ID_RANGE, to, len(records))
+		return
+	}
+	if records[0].Term != 2 || records[0].Servers == nil || records[0].NewServers == nil {
+		t.Errorf("the config must be exported with its term and servers, but get %+v\n", records[0])
+	}
+}
+
+// nothing is pushed if the export is malformed
+func Test_importMalformed(t *testing.T) {
+	export := getExport(t, 20, 0, UINT64_MAX).String()
+	lines := strings.SplitAfter(export, "\n")
+
+	cases := map[string]string{
+		"gap":        lines[0] + lines[2],
+		"outOfOrder": lines[1] + lines[0],
+		"afterLast":  lines[19] + lines[19],
+		"unknown":    `{"FromLogIndex":1,"ToLogIndex":2,"Servers":null,"Unknown":1}`,
+		"truncated":  lines[0] + lines[1][:10],
+	}
+	cm, err := getSnapshotStore(SNAPSHOT_TARGET_HEADER, MsgpackCodec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	for name, export := range cases {
+		if err = cm.ImportJSON(strings.NewReader(export)); err == nil || errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected an illegal export, but get %v\n", name, err)
+		}
+		if _, err = cm.LastConfig(); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: nothing must be imported, but get %v\n", name, err)
+		}
+	}
+}
+
+// nothing is loaded if a config is too large for a data file, even the ones before it
+func Test_importTooLarge(t *testing.T) {
+	export := getExport(t, 20, 0, UINT64_MAX).String()
+	lines := strings.SplitAfter(export, "\n")
+
+	record := &exportRecord{}
+	if err := json.Unmarshal([]byte(lines[10]), record); err != nil {
+		t.Error(err)
+		return
+	}
+	record.Servers.Addresses[0].Addresses[0].IP = strings.Repeat("1", 20000)
+	line, err := json.Marshal(record)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lines[10] = string(line) + "\n"
+
+	cm, err := getSnapshotStore(SNAPSHOT_TARGET_HEADER, MsgpackCodec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if err = cm.ImportJSON(strings.NewReader(strings.Join(lines, ""))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, but get %v\n", err)
+	}
+	if _, err = cm.LastConfig(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("nothing must be imported, but get %v\n", err)
+	}
+}
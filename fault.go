@@ -0,0 +1,25 @@
+package conf
+
+/*
+	fault injection, so that the tests can fail a write between its steps and check what is left.
+	Options.faultHook is nil out of the tests, they set it to return an error at the points wanted.
+ */
+
+const (
+	FAULT_APPEND_DATA    = "append.data"    // diskIo.append, the endId of the last record is set, the new one not written
+	FAULT_APPEND_INDEX   = "append.index"   // diskIo.append, the new record is written, the index not updated
+	FAULT_TRUNCATE_APPLY = "truncate.apply" // diskIo.commitTruncate, the journal is written, the files not changed
+	FAULT_RESTORE_COMMIT = "restore.commit" // diskIo.restore, the new segments are written, the journal not
+	FAULT_RESTORE_APPLY  = "restore.apply"  // diskIo.restore, the journal is written, the files not changed
+	FAULT_SYNC           = "sync"           // diskIo.sync, the latest data file is not flushed
+	FAULT_MEM_PUSH       = "mem.push"       // RangeStore, the disk is appended, the memory not
+	FAULT_MEM_TRUNCATE   = "mem.truncate"   // RangeStore, the disk is truncated, the memory not
+	FAULT_MEM_REBUILD    = "mem.rebuild"    // RangeStore, rebuilding the memory from the disk
+)
+
+func (this *Options) injectFault(point string) error {
+	if this.faultHook == nil {
+		return nil
+	}
+	return this.faultHook(point)
+}
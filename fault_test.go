@@ -0,0 +1,277 @@
+package conf
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+var (
+	FAULT_DATA_PATH = "./fault_data"
+	FAULT_DATA_HEADER = "fault"
+)
+
+// set the fault hook of the store of cm, nil to clear it
+func setFaultHook(cm *ConfManager, hook func(point string) error) {
+	cm.store.mutex.Lock()
+	defer cm.store.mutex.Unlock()
+	cm.store.opts.faultHook = hook
+}
+
+// fail the first time any of points is reached by cm, returns the number of faults injected
+func failOnce(cm *ConfManager, points ...string) *int {
+	hits := 0
+	setFaultHook(cm, func(point string) error {
+		for _, p := range points {
+			if p == point && hits < len(points) {
+				hits++
+				return errors.New("fault injected at " + point)
+			}
+		}
+		return nil
+	})
+	return &hits
+}
+
+// the startIds of the configs left by a truncation, as the truncation is described by ConfigManager
+func truncateModel(startIds []uint64, before bool, logIndex uint64) []uint64 {
+	result := make([]uint64, 0)
+	for i, id := range startIds {
+		if before {
+			if i + 1 < len(startIds) && startIds[i+1] <= logIndex {
+				continue
+			}
+			if id < logIndex {
+				id = logIndex
+			}
+		} else if id > logIndex {
+			break
+		}
+		result = append(result, id)
+	}
+	return result
+}
+
+// memory, disk and what the operations returned must agree
+func checkAgree(t *testing.T, cm *ConfManager, expected []uint64, step string) {
+	// what is read by cm, from memory if it is there
+	metas, err := cm.ListAfter(0)
+	if len(expected) == 0 {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected an empty store, but get %v\n", step, err)
+		}
+		if _, err = cm.LastConfig(); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: LastConfig of an empty store must return ErrNotFound, but get %v\n", step, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v\n", step, err)
+		return
+	}
+	if len(metas) != len(expected) {
+		t.Errorf("%s: expected %d configs, but get %d\n", step, len(expected), len(metas))
+		return
+	}
+	for i, meta := range metas {
+		if meta.FromLogIndex != expected[i] {
+			t.Errorf("%s: config %d must be from %d, but get %d\n", step, i, expected[i], meta.FromLogIndex)
+			return
+		}
+		got, err := cm.GetConfig(meta.FromLogIndex)
+		if err != nil || got.FromLogIndex != meta.FromLogIndex || got.ToLogIndex != meta.ToLogIndex {
+			t.Errorf("%s: GetConfig(%d) doesn't agree with ListAfter: %v, %v\n", step, meta.FromLogIndex, got, err)
+			return
+		}
+	}
+	last, err := cm.LastConfig()
+	if err != nil || last.FromLogIndex != expected[len(expected)-1] || last.ToLogIndex != UINT64_MAX {
+		t.Errorf("%s: LastConfig must be from %d, but get %v, %v\n", step, expected[len(expected)-1], last, err)
+	}
+
+	// what is on disk
+	opts := cm.store.opts
+	opts.ReadOnly = true
+	reader, err := GetConfManagerWithOptions(FAULT_DATA_PATH, FAULT_DATA_HEADER, opts)
+	if err != nil {
+		t.Errorf("%s: %v\n", step, err)
+		return
+	}
+	defer reader.Close()
+	diskMetas, err := reader.ListAfter(0)
+	if err != nil || len(diskMetas) != len(metas) {
+		t.Errorf("%s: disk has %d configs, but memory has %d, %v\n", step, len(diskMetas), len(metas), err)
+		return
+	}
+	for i, meta := range diskMetas {
+		if meta.FromLogIndex != metas[i].FromLogIndex || meta.ToLogIndex != metas[i].ToLogIndex {
+			t.Errorf("%s: config %d is [%d, %d] on disk, but [%d, %d] in memory\n", step, i,
+				meta.FromLogIndex, meta.ToLogIndex, metas[i].FromLogIndex, metas[i].ToLogIndex)
+			return
+		}
+	}
+}
+
+// a write failed at any step is applied to both memory and disk, or to neither
+func Test_faults(t *testing.T) {
+	count := 100
+	points := []string{FAULT_APPEND_DATA, FAULT_APPEND_INDEX, FAULT_TRUNCATE_APPLY, FAULT_MEM_PUSH, FAULT_MEM_TRUNCATE}
+	for _, point := range points {
+		cm, err := getTestStore(FAULT_DATA_PATH, FAULT_DATA_HEADER, count, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		expected := make([]uint64, 0)
+		for i := 0; i < count; i++ {
+			expected = append(expected, uint64(START_ID + i * ID_RANGE))
+		}
+
+		injected := 0
+		// every third push fails, some of them fill the latest data file and some go to a new one
+		for i := 0; i < 60; i++ {
+			id := START_ID + (count + i) * ID_RANGE
+			hits := failOnce(cm)
+			if i % 3 == 0 {
+				hits = failOnce(cm, point)
+			}
+			err = cm.PushConfig(uint64(id), getConf(id))
+			injected += *hits
+			if err == nil {
+				expected = append(expected, uint64(id))
+			} else if *hits == 0 {
+				t.Errorf("%s: push %d failed:%v\n", point, id, err)
+			}
+		}
+		checkAgree(t, cm, expected, point + " push")
+
+		truncateAfter := expected[len(expected)-1] - uint64(25 * ID_RANGE) + 1
+		hits := failOnce(cm, point)
+		if err = cm.TruncateAfter(truncateAfter); err == nil {
+			expected = truncateModel(expected, false, truncateAfter)
+		} else if *hits == 0 {
+			t.Errorf("%s: truncateAfter failed:%v\n", point, err)
+		}
+		injected += *hits
+		checkAgree(t, cm, expected, point + " truncateAfter")
+
+		truncateBefore := uint64(START_ID + 40 * ID_RANGE + 1)
+		hits = failOnce(cm, point)
+		if err = cm.TruncateBefore(truncateBefore); err == nil {
+			expected = truncateModel(expected, true, truncateBefore)
+		} else if *hits == 0 {
+			t.Errorf("%s: truncateBefore failed:%v\n", point, err)
+		}
+		injected += *hits
+		checkAgree(t, cm, expected, point + " truncateBefore")
+
+		setFaultHook(cm, nil)
+		if injected == 0 {
+			t.Errorf("%s: no fault injected\n", point)
+		}
+		if cm.store.stale {
+			t.Errorf("%s: memory must be rebuilt\n", point)
+		}
+
+		// writes go on
+		id := START_ID + (count + 100) * ID_RANGE
+		if err = cm.PushConfig(uint64(id), getConf(id)); err != nil {
+			t.Error(point, err)
+		} else {
+			expected = append(expected, uint64(id))
+		}
+		checkAgree(t, cm, expected, point + " after")
+		cm.Close()
+	}
+}
+
+// the memory can't be rebuilt, reads go to disk till the next write rebuilds it
+func Test_faultsStale(t *testing.T) {
+	count := 100
+	cm, err := getTestStore(FAULT_DATA_PATH, FAULT_DATA_HEADER, count, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	expected := make([]uint64, 0)
+	for i := 0; i <= count; i++ {
+		expected = append(expected, uint64(START_ID + i * ID_RANGE))
+	}
+
+	failOnce(cm, FAULT_MEM_PUSH, FAULT_MEM_REBUILD)
+	id := START_ID + count * ID_RANGE
+	if err = cm.PushConfig(uint64(id), getConf(id)); err != nil {
+		t.Error("push is on disk, it must succeed:", err)
+		return
+	}
+	setFaultHook(cm, nil)
+	if !cm.store.stale {
+		t.Error("memory must be stale")
+	}
+	checkAgree(t, cm, expected, "stale")
+	it := cm.ReverseIterator(UINT64_MAX)
+	if !it.Next() || it.Meta().FromLogIndex != uint64(id) {
+		t.Errorf("ReverseIterator must start from %d\n", id)
+	}
+	it.Close()
+
+	if err = cm.TruncateAfter(uint64(START_ID + 90 * ID_RANGE)); err != nil {
+		t.Error(err)
+		return
+	}
+	if cm.store.stale {
+		t.Error("memory must be rebuilt by the next write")
+	}
+	checkAgree(t, cm, truncateModel(expected, false, uint64(START_ID + 90 * ID_RANGE)), "rebuilt")
+}
+
+// a push which can't be flushed is rolled back, the watchers are told nothing till it is pushed again
+func Test_faultsSync(t *testing.T) {
+	count := 100
+	cm, err := getTestStore(FAULT_DATA_PATH, FAULT_DATA_HEADER, count, func(opts *Options) {
+		opts.SyncPolicy = SyncAlways
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	expected := make([]uint64, 0)
+	for i := 0; i < count; i++ {
+		expected = append(expected, uint64(START_ID + i * ID_RANGE))
+	}
+	events := cm.Watch(context.Background())
+
+	// every third push fails, some of them fill the latest data file and some go to a new one
+	for i := 0; i < 60; i++ {
+		id := START_ID + (count + i) * ID_RANGE
+		hits := failOnce(cm)
+		if i % 3 == 0 {
+			hits = failOnce(cm, FAULT_SYNC)
+		}
+		err = cm.PushConfig(uint64(id), getConf(id))
+		if *hits > 0 {
+			if err == nil {
+				t.Errorf("push %d isn't flushed, it must fail\n", id)
+				return
+			}
+			setFaultHook(cm, nil)
+			checkAgree(t, cm, expected, "sync failed")
+
+			// pushed again, as raft does
+			err = cm.PushConfig(uint64(id), getConf(id))
+		}
+		if err != nil {
+			t.Errorf("push %d failed:%v\n", id, err)
+			return
+		}
+		expected = append(expected, uint64(id))
+
+		if event, ok := receive(t, events).(Pushed); !ok || event.Meta.FromLogIndex != uint64(id) {
+			t.Errorf("expected Pushed of %d, but get %v\n", id, event)
+			return
+		}
+	}
+	checkAgree(t, cm, expected, "sync")
+}
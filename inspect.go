@@ -0,0 +1,129 @@
+package conf
+
+/*
+	inspect tells how a store is laid out on disk, for the tools looking into a store, e.g. the confmgr command:
+
+	Segments: the data files, as their indexes tell
+	DumpRaw:  the framing of each record in a data file, read without the index
+ */
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// a data file of the store
+type SegmentInfo struct {
+	File         string // base name of the data file
+	FromLogIndex uint64 // startId of the first record
+	ToLogIndex   uint64 // the last log index it covers, UINT64_MAX for the latest data file
+	Size         uint64 // bytes of the data file
+	Records      uint64
+	Sections     int // section indexes of the index file
+}
+
+// a record as it is laid out in a data file
+type RawRecord struct {
+	Offset  uint64 // where it starts in the data file
+	StartId uint64
+	EndId   uint64 // 0 for the last record of the store
+	Term    uint64 // 0 for the stores without term
+	BuffLen uint64
+	Crc     uint32 // 0 for the stores without crc
+	Padding uint64 // 0 bytes after buff, till the end of the block
+	Size    uint64 // header, buff and padding
+}
+
+// the data files of the store, ordered by the log indexes they cover
+func (this *ConfManager) Segments() ([]SegmentInfo, error) {
+	return this.store.Segments()
+}
+
+func (this *RangeStore) Segments() ([]SegmentInfo, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return nil, ErrClosed
+	}
+
+	return this.disk.segments(), nil
+}
+
+func (this *diskIo) segments() []SegmentInfo {
+	sorter := newIdxMgrSorter(this)
+	sort.Sort(sorter)
+
+	segments := make([]SegmentInfo, 0, len(sorter.items))
+	for i, item := range sorter.items {
+		meta := item.indexInfo.meta
+		segment := SegmentInfo{
+			File: filepath.Base(item.fileName),
+			FromLogIndex: meta.minId,
+			ToLogIndex: UINT64_MAX,
+			Size: meta.dataFileSize,
+			Records: meta.recordNum,
+			Sections: len(item.indexInfo.indexs),
+		}
+		if i + 1 < len(sorter.items) {
+			segment.ToLogIndex = sorter.items[i+1].indexInfo.meta.minId - 1
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments
+}
+
+/*
+	read the records of a data file of the store in dir, fileName is a base name in dir or a path. the store is not
+	opened, the layout is taken from its meta file.
+	the records before a broken one are returned with the *CorruptError of it.
+ */
+func DumpRaw(dir, header, fileName string) ([]RawRecord, error) {
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	disk, err := getToolDiskIO(dir, header, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := disk.loadLayout(); err != nil {
+		return nil, err
+	}
+
+	if filepath.Base(fileName) == fileName {
+		fileName = filepath.Join(disk.path, fileName)
+	}
+	buff, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]RawRecord, 0)
+	format := disk.formatOf(fileName)
+	for pos := uint64(0); pos < uint64(len(buff)); {
+		elem, recordSize, err := format.parseRecord(buff, pos, fileName, 0)
+		if err != nil {
+			return records, err
+		}
+
+		record := RawRecord{
+			Offset: pos,
+			StartId: elem.startId,
+			EndId: elem.endId,
+			Term: elem.term,
+			BuffLen: uint64(len(elem.buff)),
+			Padding: format.paddedSize(uint64(len(elem.buff))),
+			Size: recordSize,
+		}
+		if format.hasCrc() {
+			record.Crc = binary.BigEndian.Uint32(buff[pos+DATA_CRC_POS : pos+DATA_CRC_POS+CRC_LEN])
+		}
+		records = append(records, record)
+
+		pos += recordSize
+	}
+
+	return records, nil
+}
@@ -0,0 +1,58 @@
+package conf
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func Test_inspect(t *testing.T) {
+	cm, err := getVerifyStore(200)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	segments, err := cm.Segments()
+	cm.Close()
+	if err != nil || len(segments) < 3 {
+		t.Errorf("expected 3 data files at least, but get %v, %v\n", segments, err)
+		return
+	}
+
+	// the segments cover the configs one after another
+	records := uint64(0)
+	for i, segment := range segments {
+		records += segment.Records
+		if i > 0 && segment.FromLogIndex != segments[i-1].ToLogIndex + 1 {
+			t.Errorf("segment %s from %d doesn't follow the one before till %d\n", segment.File, segment.FromLogIndex, segments[i-1].ToLogIndex)
+		}
+	}
+	if records != 200 - 3 - 2 || segments[len(segments)-1].ToLogIndex != UINT64_MAX {
+		t.Errorf("expected %d records till the end, but get %v\n", 200 - 3 - 2, segments)
+	}
+
+	// the records of a data file are laid out one by one
+	rawRecords, err := DumpRaw(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, segments[1].File)
+	if err != nil || uint64(len(rawRecords)) != segments[1].Records {
+		t.Errorf("expected %d records, but get %d, %v\n", segments[1].Records, len(rawRecords), err)
+		return
+	}
+	offset := uint64(0)
+	for _, record := range rawRecords {
+		if record.Offset != offset || record.Size % DATA_BLOCK_SIZE != 0 || record.Size != DATA_HEAD_SIZE + record.BuffLen + record.Padding {
+			t.Errorf("unexpected framing: %+v\n", record)
+		}
+		offset += record.Size
+	}
+	if last := rawRecords[len(rawRecords)-1]; last.EndId != segments[1].ToLogIndex || offset != segments[1].Size {
+		t.Errorf("the last record must cover till %d and end at %d, but get %+v\n", segments[1].ToLogIndex, segments[1].Size, last)
+	}
+
+	// the ones before a broken record are returned
+	fileName := filepath.Join(VERIFY_DATA_PATH, segments[1].File)
+	writeAt(t, fileName, []byte{0xff}, rawRecords[1].Offset + DATA_HEAD_SIZE)
+	rawRecords, err = DumpRaw(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, fileName)
+	if !errors.Is(err, ErrCorrupt) || len(rawRecords) != 1 {
+		t.Errorf("expected 1 record and ErrCorrupt, but get %d, %v\n", len(rawRecords), err)
+	}
+}
@@ -0,0 +1,257 @@
+package conf
+
+/*
+	Iterator streams the configs covering the log indexes in [from, to] in order, without building the whole result.
+	configs kept in memory are read from memory, the older ones are read from disk a section of the index at a time.
+	ReverseIterator does the same from the newest to the oldest: it walks the list from the head, and then reads the
+	sections of the data files backwards.
+
+	it doesn't hold the lock of the ConfManager between the calls, so writes go on while iterating. it goes on from the
+	log index right after the last config it read, so a config is never returned twice, and it stops when the configs
+	are truncated after it.
+
+		it := cm.Iterator(from, to)
+		defer it.Close()
+		for it.Next() {
+			meta := it.Meta()
+			...
+		}
+		if err := it.Err(); err != nil {
+			...
+		}
+
+	the iterators of a RangeStore do the same with the records, read by Record() instead of Meta().
+ */
+
+import (
+	. "rafted/persist"
+)
+
+type Iterator struct {
+	store *RangeStore
+	codec Codec     // decodes meta, nil for the iterators of a RangeStore
+	next  uint64    // log index to read from when elems run out
+	to    uint64
+	elems []*myElem // read but not returned yet
+	meta  *ConfigMeta
+	elem  *myElem   // the one meta is decoded from, and the record of
+	err   error
+	done  bool // nothing more to read
+	locked bool // the caller holds the read lock of the store all the time
+	reverse bool // from large to small, to is not used
+}
+
+/*
+	iterate the configs covering the log indexes in [from, to], use UINT64_MAX as to for all the configs after from.
+	the config covering from is the first one, or the first config of the store if from is before it.
+ */
+func (this *ConfManager) Iterator(from, to uint64) *Iterator {
+	it := this.store.Iterator(from, to)
+	it.codec = this.codec
+	return it
+}
+
+/*
+	iterate the configs from the one covering from to the oldest one, newest first.
+	use UINT64_MAX as from to start from the last config.
+ */
+func (this *ConfManager) ReverseIterator(from uint64) *Iterator {
+	it := this.store.ReverseIterator(from)
+	it.codec = this.codec
+	return it
+}
+
+// Iterator of the records, read them by Record()
+func (this *RangeStore) Iterator(from, to uint64) *Iterator {
+	return &Iterator{
+		store: this,
+		next: from,
+		to: to,
+		done: from > to,
+	}
+}
+
+// ReverseIterator of the records, read them by Record()
+func (this *RangeStore) ReverseIterator(from uint64) *Iterator {
+	return &Iterator{
+		store: this,
+		next: from,
+		reverse: true,
+	}
+}
+
+// move to the next config, false if no more or an error happens
+func (this *Iterator) Next() bool {
+	for len(this.elems) == 0 {
+		if this.done || this.err != nil {
+			return false
+		}
+		if err := this.fill(); err != nil {
+			this.err = err
+			return false
+		}
+	}
+
+	elem := this.elems[0]
+	this.elems = this.elems[1:]
+	if !this.reverse && elem.startId > this.to {
+		this.done = true
+		this.elems = nil
+		return false
+	}
+
+	if this.codec != nil {
+		meta, err := memElemToConfigMeta(this.codec, elem)
+		if err != nil {
+			this.err = err
+			return false
+		}
+		this.meta = meta
+	}
+	this.elem = elem
+
+	return true
+}
+
+// the config Next() moved to, nil for the iterators of a RangeStore
+func (this *Iterator) Meta() *ConfigMeta {
+	return this.meta
+}
+
+// the record Next() moved to
+func (this *Iterator) Record() *RangeRecord {
+	if this.elem == nil {
+		return nil
+	}
+	return memElemToRangeRecord(this.elem)
+}
+
+// the raft term of the config Next() moved to, 0 if it was pushed without a term
+func (this *Iterator) Term() uint64 {
+	if this.elem == nil {
+		return 0
+	}
+	return this.elem.term
+}
+
+func (this *Iterator) Err() error {
+	return this.err
+}
+
+// stop iterating, it can be called before all the configs are read
+func (this *Iterator) Close() {
+	this.done = true
+	this.elems = nil
+	this.meta = nil
+	this.elem = nil
+}
+
+// read the next batch from memory, or a section from disk if this.next is before the memory
+func (this *Iterator) fill() error {
+	if !this.locked {
+		this.store.mutex.RLock()
+		defer this.store.mutex.RUnlock()
+	}
+	if this.store.closed {
+		return ErrClosed
+	}
+
+	var elems []*myElem
+	var err error
+	if this.reverse {
+		elems, err = this.readBackward()
+	} else {
+		elems, err = this.readForward()
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(elems) == 0 {
+		this.done = true
+		return nil
+	}
+
+	last := elems[len(elems)-1]
+	if this.reverse {
+		if last.startId == 0 {
+			this.done = true
+		} else {
+			this.next = last.startId - 1
+		}
+	} else {
+		if last.endId == UINT64_MAX || last.endId >= this.to {
+			this.done = true
+		} else {
+			this.next = last.endId + 1
+		}
+	}
+	this.elems = elems
+
+	return nil
+}
+
+// the config covering this.next and the ones after it
+func (this *Iterator) readForward() ([]*myElem, error) {
+	err := MEM_NOTFOUND_ERR
+	if !this.store.stale {
+		_, err = this.store.mem.get(this.next)
+	}
+	if err == nil {
+		memElems, err := this.store.mem.listAfter(this.next)
+		if err != nil {
+			return nil, err
+		}
+		return copyMemElems(memElems), nil
+	} else if err != MEM_NOTFOUND_ERR {
+		return nil, err
+	}
+
+	diskElems, err := this.store.disk.listSection(this.next)
+	if err != nil && err != DISK_NOTFOUND_ERR {
+		return nil, err
+	}
+	return diskElemsToMemElems(diskElems), nil
+}
+
+// the config covering this.next and the ones before it, from large to small
+func (this *Iterator) readBackward() ([]*myElem, error) {
+	var memElems []*myElem = nil
+	err := MEM_NOTFOUND_ERR
+	if !this.store.stale {
+		memElems, err = this.store.mem.listBefore(this.next)
+	}
+	if err == nil {
+		return copyMemElems(memElems), nil
+	} else if err != MEM_NOTFOUND_ERR {
+		return nil, err
+	}
+
+	diskElems, err := this.store.disk.listSectionBefore(this.next)
+	if err != nil && err != DISK_NOTFOUND_ERR {
+		return nil, err
+	}
+	return diskElemsToMemElems(diskElems), nil
+}
+
+// copied, the elems in the list are changed by truncateBefore
+func copyMemElems(memElems []*myElem) []*myElem {
+	elems := make([]*myElem, 0, len(memElems))
+	for _, e := range memElems {
+		elems = append(elems, &myElem{startId: e.startId, endId: e.endId, term: e.term, data: e.data})
+	}
+	return elems
+}
+
+func diskElemsToMemElems(diskElems []*diskElem) []*myElem {
+	elems := make([]*myElem, 0, len(diskElems))
+	for _, e := range diskElems {
+		endId := e.endId
+		if endId == 0 {
+			// the last one
+			endId = UINT64_MAX
+		}
+		elems = append(elems, &myElem{startId: e.startId, endId: endId, term: e.term, data: e.buff})
+	}
+	return elems
+}
@@ -0,0 +1,202 @@
+package conf
+
+import (
+	"testing"
+	. "rafted/persist"
+)
+
+var (
+	ITERATOR_DATA_PATH = "./iterator_data"
+	ITERATOR_DATA_HEADER = "iterator"
+)
+
+// a store of count configs in several data files, only the last ones in memory
+func getIteratorStore(count int) (*ConfManager, error) {
+	return getTestStore(ITERATOR_DATA_PATH, ITERATOR_DATA_HEADER, count, func(opts *Options) {
+		opts.IdxMaxRecordPerSection = 7
+	})
+}
+
+// read all by the iterator, and check they are continuous
+func iterateAll(t *testing.T, it *Iterator) []uint64 {
+	startIds := make([]uint64, 0)
+	var last *ConfigMeta = nil
+	for it.Next() {
+		meta := it.Meta()
+		if last != nil && meta.FromLogIndex != last.ToLogIndex + 1 {
+			t.Errorf("config from %d doesn't follow the one to %d\n", meta.FromLogIndex, last.ToLogIndex)
+		}
+		if !MultiAddrSliceEqual(meta.Conf.Servers, getConf(int(meta.FromLogIndex)).Servers) {
+			t.Errorf("wrong config from %d\n", meta.FromLogIndex)
+		}
+		last = meta
+		startIds = append(startIds, meta.FromLogIndex)
+	}
+	if err := it.Err(); err != nil {
+		t.Error(err)
+	}
+
+	return startIds
+}
+
+func Test_iterator(t *testing.T) {
+	count := 500
+	cm, err := getIteratorStore(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if len(cm.store.disk.idxMgr.mapIndex) < 3 {
+		t.Errorf("expected several data files, but get %d\n", len(cm.store.disk.idxMgr.mapIndex))
+	}
+
+	lastId := uint64(START_ID + (count - 1) * ID_RANGE)
+	cases := []struct {
+		from  uint64
+		to    uint64
+		first uint64
+		num   int
+	}{
+		{0, UINT64_MAX, uint64(START_ID), count},
+		{uint64(START_ID + 10 * ID_RANGE + 3), UINT64_MAX, uint64(START_ID + 10 * ID_RANGE), count - 10},
+		{uint64(START_ID + 10 * ID_RANGE), uint64(START_ID + 20 * ID_RANGE), uint64(START_ID + 10 * ID_RANGE), 11},
+		{uint64(START_ID + 100 * ID_RANGE + 1), uint64(START_ID + 480 * ID_RANGE - 1), uint64(START_ID + 100 * ID_RANGE), 380},
+		{lastId + 1000, UINT64_MAX, lastId, 1},
+		{uint64(START_ID + 5 * ID_RANGE), uint64(START_ID + 5 * ID_RANGE), uint64(START_ID + 5 * ID_RANGE), 1},
+		{uint64(START_ID + 5 * ID_RANGE), uint64(START_ID), 0, 0},
+	}
+	for _, c := range cases {
+		it := cm.Iterator(c.from, c.to)
+		startIds := iterateAll(t, it)
+		it.Close()
+		if len(startIds) != c.num {
+			t.Errorf("[%d, %d]: expected %d configs, but get %d\n", c.from, c.to, c.num, len(startIds))
+			continue
+		}
+		if c.num > 0 && startIds[0] != c.first {
+			t.Errorf("[%d, %d]: the first config must be from %d, but get %d\n", c.from, c.to, c.first, startIds[0])
+		}
+	}
+
+	// the same as ListAfter
+	from := uint64(START_ID + 123 * ID_RANGE + 1)
+	metas, err := cm.ListAfter(from)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	it := cm.Iterator(from, UINT64_MAX)
+	defer it.Close()
+	i := 0
+	for ; it.Next(); i++ {
+		meta := it.Meta()
+		if i >= len(metas) || meta.FromLogIndex != metas[i].FromLogIndex || meta.ToLogIndex != metas[i].ToLogIndex {
+			t.Errorf("config %d differs from ListAfter\n", i)
+			return
+		}
+	}
+	if i != len(metas) {
+		t.Errorf("expected %d configs as ListAfter, but get %d\n", len(metas), i)
+	}
+}
+
+// stop in the middle, and writes go on while iterating
+func Test_iteratorWithWrites(t *testing.T) {
+	count := 200
+	cm, err := getIteratorStore(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	it := cm.Iterator(0, UINT64_MAX)
+	for i := 0; i < 5; i++ {
+		if !it.Next() {
+			t.Error("iterator stops too early:", it.Err())
+			return
+		}
+	}
+	it.Close()
+	if it.Next() {
+		t.Error("iterator must stop after Close()")
+	}
+
+	// push while iterating, the new ones are read as well
+	it = cm.Iterator(0, UINT64_MAX)
+	defer it.Close()
+	pushed := 0
+	startIds := make([]uint64, 0)
+	for it.Next() {
+		startIds = append(startIds, it.Meta().FromLogIndex)
+		if pushed < 50 {
+			if err = pushConf(cm, START_ID + (count + pushed) * ID_RANGE, ID_RANGE, 1); err != nil {
+				t.Error(err)
+				return
+			}
+			pushed++
+		}
+	}
+	if err = it.Err(); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(startIds) != count + pushed {
+		t.Errorf("expected %d configs, but get %d\n", count + pushed, len(startIds))
+	}
+	for i := 1; i < len(startIds); i++ {
+		if startIds[i] <= startIds[i-1] {
+			t.Errorf("config from %d is returned after %d\n", startIds[i], startIds[i-1])
+			return
+		}
+	}
+}
+
+func Test_reverseIterator(t *testing.T) {
+	count := 500
+	cm, err := getIteratorStore(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	cases := []struct {
+		from  uint64
+		first uint64
+		num   int
+	}{
+		{UINT64_MAX, uint64(START_ID + (count - 1) * ID_RANGE), count},
+		{uint64(START_ID + 480 * ID_RANGE + 5), uint64(START_ID + 480 * ID_RANGE), 481},
+		{uint64(START_ID + 123 * ID_RANGE + 5), uint64(START_ID + 123 * ID_RANGE), 124},
+		{uint64(START_ID), uint64(START_ID), 1},
+		{uint64(START_ID - 1), 0, 0},
+	}
+	for _, c := range cases {
+		it := cm.ReverseIterator(c.from)
+		var last *ConfigMeta = nil
+		num := 0
+		for it.Next() {
+			meta := it.Meta()
+			if last == nil && meta.FromLogIndex != c.first {
+				t.Errorf("from %d: the first config must be from %d, but get %d\n", c.from, c.first, meta.FromLogIndex)
+			}
+			if last != nil && meta.ToLogIndex + 1 != last.FromLogIndex {
+				t.Errorf("from %d: config to %d doesn't precede the one from %d\n", c.from, meta.ToLogIndex, last.FromLogIndex)
+			}
+			if !MultiAddrSliceEqual(meta.Conf.Servers, getConf(int(meta.FromLogIndex)).Servers) {
+				t.Errorf("wrong config from %d\n", meta.FromLogIndex)
+			}
+			last = meta
+			num++
+		}
+		if err := it.Err(); err != nil {
+			t.Error(err)
+		}
+		it.Close()
+		if num != c.num {
+			t.Errorf("from %d: expected %d configs, but get %d\n", c.from, c.num, num)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package conf
+
+/*
+	truncation journal makes truncateBefore and truncateAfter atomic, and restoring a snapshot as well.
+
+	the segments changed by a truncation are written to temp files (filename + ".tmp") first, then an intent record is
+	written to the journal file ( path/header.journal ), which is the commit point, at last the temp files are renamed
+	to their targets and the segments not needed are removed. the journal is removed when all is done.
+
+	when opening a store:
+		journal exists: the truncation is committed, apply it again (each step of it can be done twice)
+		no journal:     temp files left are from a truncation not committed, remove them, the old segments are untouched
+
+	journal file content fmt:
+	[magic(8 byte)][op(8 byte)][id(8 byte)][rename_num(8 byte)][remove_num(8 byte)]
+	[rename] = [from][to], [remove] = [name], both of them are base names of the files in the store
+	[name] = name_len(8 byte)name(name_len byte)
+	[crc(4 byte)] // crc32(castagnoli) of all above
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	JOURNAL_MAGIC  uint64     = 0x434f4e464a524e4c // "CONFJRNL"
+	JOURNAL_OP_BEFORE  uint64 = 1 // truncateBefore
+	JOURNAL_OP_AFTER  uint64  = 2 // truncateAfter
+	JOURNAL_OP_RESTORE  uint64 = 3 // restore, all the segments are replaced
+	TMP_FILE_SUFFIX           = ".tmp"
+)
+
+type truncateJournal struct {
+	op      uint64 // JOURNAL_OP_BEFORE, JOURNAL_OP_AFTER or JOURNAL_OP_RESTORE
+	id      uint64 // id of the truncation
+	renames []journalRename
+	removes []string
+}
+
+// a temp file to be renamed to its target
+type journalRename struct {
+	from string
+	to   string
+}
+
+func (this *truncateJournal) encode() []byte {
+	buff := make([]byte, 0, 5 * NUM_LEN)
+	buff = appendUint64(buff, JOURNAL_MAGIC)
+	buff = appendUint64(buff, this.op)
+	buff = appendUint64(buff, this.id)
+	buff = appendUint64(buff, uint64(len(this.renames)))
+	buff = appendUint64(buff, uint64(len(this.removes)))
+	for _, rename := range this.renames {
+		buff = appendName(buff, rename.from)
+		buff = appendName(buff, rename.to)
+	}
+	for _, name := range this.removes {
+		buff = appendName(buff, name)
+	}
+
+	crc := make([]byte, CRC_LEN)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(buff, CRC_TABLE))
+	return append(buff, crc...)
+}
+
+func decodeJournal(buff []byte, fileName string) (*truncateJournal, error) {
+	corrupt := func(reason string) error {
+		return &CorruptError{File: fileName, Offset: 0, Reason: "illegal journal: " + reason}
+	}
+
+	buffLen := uint64(len(buff))
+	if buffLen < 5 * NUM_LEN + CRC_LEN {
+		return nil, corrupt(fmt.Sprintf("too short, %d bytes", buffLen))
+	}
+	crc := binary.BigEndian.Uint32(buff[buffLen-CRC_LEN : ])
+	buff = buff[0 : buffLen-CRC_LEN]
+	if crc != crc32.Checksum(buff, CRC_TABLE) {
+		return nil, corrupt("checksum mismatch")
+	}
+	if binary.BigEndian.Uint64(buff[0 : NUM_LEN]) != JOURNAL_MAGIC {
+		return nil, corrupt("bad magic")
+	}
+
+	journal := &truncateJournal{
+		op: binary.BigEndian.Uint64(buff[NUM_LEN : 2*NUM_LEN]),
+		id: binary.BigEndian.Uint64(buff[2*NUM_LEN : 3*NUM_LEN]),
+	}
+	renameNum := binary.BigEndian.Uint64(buff[3*NUM_LEN : 4*NUM_LEN])
+	removeNum := binary.BigEndian.Uint64(buff[4*NUM_LEN : 5*NUM_LEN])
+
+	pos := 5 * NUM_LEN
+	readName := func() (string, error) {
+		if pos + NUM_LEN > uint64(len(buff)) {
+			return "", corrupt("incomplete name")
+		}
+		nameLen := binary.BigEndian.Uint64(buff[pos : pos+NUM_LEN])
+		pos += NUM_LEN
+		if nameLen > uint64(len(buff)) - pos {
+			return "", corrupt("incomplete name")
+		}
+		name := string(buff[pos : pos+nameLen])
+		pos += nameLen
+		return name, nil
+	}
+	for i := uint64(0); i < renameNum; i++ {
+		from, err := readName()
+		if err != nil {
+			return nil, err
+		}
+		to, err := readName()
+		if err != nil {
+			return nil, err
+		}
+		journal.renames = append(journal.renames, journalRename{from: from, to: to})
+	}
+	for i := uint64(0); i < removeNum; i++ {
+		name, err := readName()
+		if err != nil {
+			return nil, err
+		}
+		journal.removes = append(journal.removes, name)
+	}
+
+	return journal, nil
+}
+
+func appendUint64(buff []byte, v uint64) []byte {
+	b := make([]byte, NUM_LEN)
+	binary.BigEndian.PutUint64(b, v)
+	return append(buff, b...)
+}
+
+func appendName(buff []byte, name string) []byte {
+	buff = appendUint64(buff, uint64(len(name)))
+	return append(buff, name...)
+}
+
+func (this *diskIo) getJournalFileName() string {
+	return filepath.Join(this.path, this.header+".journal")
+}
+
+/*
+	commit a truncation: write the journal, apply it, and then remove the journal.
+	if it fails after the journal is written, the truncation is finished when the store is opened next time.
+ */
+func (this *diskIo) commitTruncate(journal *truncateJournal) error {
+	if err := this.writeJournal(journal); err != nil {
+		// not committed, drop the temp files
+		for _, rename := range journal.renames {
+			os.Remove(filepath.Join(this.path, rename.from))
+		}
+		return err
+	}
+
+	// the indexes of the changed segments are rebuilt
+	for _, rename := range journal.renames {
+		fileName := filepath.Join(this.path, rename.to)
+		if _, ok := this.idxMgr.mapIndex[fileName]; ok {
+			this.deleteIndexByFile(fileName)
+		}
+	}
+	for _, name := range journal.removes {
+		fileName := filepath.Join(this.path, name)
+		if _, ok := this.idxMgr.mapIndex[fileName]; ok {
+			this.deleteIndexByFile(fileName)
+		}
+	}
+
+	if err := this.opts.injectFault(FAULT_TRUNCATE_APPLY); err != nil {
+		return err
+	}
+	if err := this.applyJournal(journal); err != nil {
+		return err
+	}
+
+	for _, rename := range journal.renames {
+		if err := this.buildIndexByFile(filepath.Join(this.path, rename.to)); err != nil {
+			return err
+		}
+	}
+	this.log().debug("commit_journal", "data files replaced", LOG_KEY_FILE, this.getJournalFileName(), LOG_KEY_INDEX, journal.id,
+		"journal_op", journal.op, "renamed", len(journal.renames), "removed", len(journal.removes))
+
+	return this.removeJournal()
+}
+
+// write the journal to a temp file and rename it, so the journal is either complete or not there
+func (this *diskIo) writeJournal(journal *truncateJournal) error {
+	journalFileName := this.getJournalFileName()
+	tmpFileName := journalFileName + TMP_FILE_SUFFIX
+
+	file, err := os.Create(tmpFileName)
+	if err != nil {
+		this.log().error("commit_journal", "create journal failed", LOG_KEY_FILE, tmpFileName, LOG_KEY_INDEX, journal.id, LOG_KEY_ERROR, err)
+		return err
+	}
+	if _, err := file.Write(journal.encode()); err != nil {
+		file.Close()
+		this.log().error("commit_journal", "write journal failed", LOG_KEY_FILE, tmpFileName, LOG_KEY_INDEX, journal.id, LOG_KEY_ERROR, err)
+		return err
+	}
+	if this.needSync() {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	file.Close()
+
+	if err := os.Rename(tmpFileName, journalFileName); err != nil {
+		this.log().error("commit_journal", "rename journal failed", LOG_KEY_FILE, tmpFileName, LOG_KEY_INDEX, journal.id, LOG_KEY_ERROR, err)
+		return err
+	}
+
+	if this.needSync() {
+		return syncDir(this.path)
+	}
+
+	return nil
+}
+
+// rename the temp files and remove the segments, each step can be done again after a crash
+func (this *diskIo) applyJournal(journal *truncateJournal) error {
+	for _, rename := range journal.renames {
+		from := filepath.Join(this.path, rename.from)
+		to := filepath.Join(this.path, rename.to)
+
+		_, err := os.Stat(from)
+		if err == nil {
+			if err := os.Rename(from, to); err != nil {
+				this.log().error("apply_journal", "rename temp file failed", LOG_KEY_FILE, from, LOG_KEY_INDEX, journal.id, LOG_KEY_ERROR, err)
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		// index will be rebuilt from the data file
+		os.Remove(dataFileNameToIdxFileName(to))
+	}
+
+	for _, name := range journal.removes {
+		fileName := filepath.Join(this.path, name)
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			this.log().error("apply_journal", "remove data file failed", LOG_KEY_FILE, fileName, LOG_KEY_INDEX, journal.id, LOG_KEY_ERROR, err)
+			return err
+		}
+		os.Remove(dataFileNameToIdxFileName(fileName))
+	}
+
+	if this.needSync() {
+		if err := syncDir(this.path); err != nil {
+			return err
+		}
+	}
+
+	// the segments written before the store was upgraded are all replaced
+	if journal.op == JOURNAL_OP_RESTORE {
+		return this.dropOldFormat()
+	}
+
+	return nil
+}
+
+func (this *diskIo) removeJournal() error {
+	journalFileName := this.getJournalFileName()
+	if err := os.Remove(journalFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if this.needSync() {
+		return syncDir(this.path)
+	}
+
+	return nil
+}
+
+/*
+	finish the truncation committed but not done, or roll back the one not committed, called by init before
+	the data files are loaded
+ */
+func (this *diskIo) replayJournal() error {
+	journalFileName := this.getJournalFileName()
+	buff, err := ioutil.ReadFile(journalFileName)
+	if err == nil {
+		journal, err := decodeJournal(buff, journalFileName)
+		if err != nil {
+			return err
+		}
+
+		this.log().warn("replay_journal", "finish the truncation committed", LOG_KEY_FILE, journalFileName, LOG_KEY_INDEX, journal.id,
+			"journal_op", journal.op)
+		if err := this.applyJournal(journal); err != nil {
+			return err
+		}
+		if err := this.removeJournal(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		this.log().error("replay_journal", "read journal failed", LOG_KEY_FILE, journalFileName, LOG_KEY_ERROR, err)
+		return err
+	}
+
+	// temp files of the data files, the journal and the meta file
+	for _, pattern := range []string{this.header + "_*" + TMP_FILE_SUFFIX, this.header + ".*" + TMP_FILE_SUFFIX} {
+		files, err := filepath.Glob(filepath.Join(this.path, pattern))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			this.log().warn("replay_journal", "remove the temp file left by a truncation not committed", LOG_KEY_FILE, file)
+			os.Remove(file)
+		}
+	}
+
+	return nil
+}
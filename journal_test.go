@@ -0,0 +1,200 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	JOURNAL_DATA_PATH = "./journal_data"
+	JOURNAL_DATA_HEADER = "journal"
+)
+
+func getJournalDisk(t *testing.T) *diskIo {
+	opts := DefaultOptions()
+	opts.DataMaxFileSize = 16 * 1024 // several data files
+	disk, err := getDiskIOWithOptions(JOURNAL_DATA_PATH, JOURNAL_DATA_HEADER, &opts)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return disk
+}
+
+func Test_journalEncodeAndDecode(t *testing.T) {
+	journal := &truncateJournal{
+		op: JOURNAL_OP_BEFORE,
+		id: 12345,
+		renames: []journalRename{{from: "a_0000000001.data.tmp", to: "a_0000000001.data"}},
+		removes: []string{"a_0000000000.data", "a_0000000001.data"},
+	}
+	buff := journal.encode()
+	decoded, err := decodeJournal(buff, "test")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decoded.op != journal.op || decoded.id != journal.id || len(decoded.renames) != 1 || decoded.renames[0] != journal.renames[0] ||
+		len(decoded.removes) != 2 || decoded.removes[1] != journal.removes[1] {
+		t.Errorf("decoded journal %+v is different from %+v\n", decoded, journal)
+	}
+
+	buff[len(buff) / 2] ^= 0xff
+	if _, err := decodeJournal(buff, "test"); err == nil {
+		t.Error("broken journal must be detected")
+	}
+}
+
+// crash after the journal is written, the truncation is finished when opening
+func Test_journalReplay(t *testing.T) {
+	removeAll(JOURNAL_DATA_PATH)
+	disk := getJournalDisk(t)
+	if disk == nil {
+		return
+	}
+	count := uint64(200)
+	if err := pushDiskElems(disk, count); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// what truncateBefore does before committing
+	id := uint64(100 + 150 * 100 + 50)
+	journal := &truncateJournal{op: JOURNAL_OP_BEFORE, id: id}
+	for fileName, indexInfo := range disk.idxMgr.mapIndex {
+		if indexInfo.meta.maxId < id {
+			journal.removes = append(journal.removes, filepath.Base(fileName))
+		} else if indexInfo.meta.minId < id {
+			elem, pos, err := disk.getStartPosById(fileName, id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			elem.startId = id
+			tmpFileName, err := disk.truncateFileBeforeId(fileName, id, elem, pos)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			journal.renames = append(journal.renames, journalRename{from: filepath.Base(tmpFileName), to: filepath.Base(disk.getFileNameByStartId(id))})
+			journal.removes = append(journal.removes, filepath.Base(fileName))
+		}
+	}
+	if err := disk.writeJournal(journal); err != nil {
+		t.Error(err)
+		return
+	}
+	disk.close()
+
+	disk = getJournalDisk(t)
+	if disk == nil {
+		return
+	}
+	defer disk.close()
+
+	if _, err := os.Stat(disk.getJournalFileName()); !os.IsNotExist(err) {
+		t.Error("journal must be removed after replay")
+	}
+	elems, err := disk.listAfter(id)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(elems) != int(count - 150) || elems[0].startId != id {
+		t.Errorf("expected %d elems from %d, but get %d elems\n", count - 150, id, len(elems))
+		return
+	}
+	for _, indexInfo := range disk.idxMgr.mapIndex {
+		if indexInfo.meta.minId < id {
+			t.Errorf("elems before %d must be removed, but get minId %d\n", id, indexInfo.meta.minId)
+		}
+	}
+}
+
+// crash before the journal is written, the store keeps the old range
+func Test_journalRollback(t *testing.T) {
+	removeAll(JOURNAL_DATA_PATH)
+	disk := getJournalDisk(t)
+	if disk == nil {
+		return
+	}
+	count := uint64(100)
+	if err := pushDiskElems(disk, count); err != nil {
+		t.Error(err)
+		return
+	}
+
+	id := uint64(100 + 50 * 100)
+	tmpFileName := ""
+	for fileName, indexInfo := range disk.idxMgr.mapIndex {
+		if indexInfo.meta.minId < id && id <= indexInfo.meta.maxId {
+			elem, pos, err := disk.getStartPosById(fileName, id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if tmpFileName, err = disk.truncateFileAfterElem(fileName, elem, pos); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+	disk.close()
+
+	disk = getJournalDisk(t)
+	if disk == nil {
+		return
+	}
+	defer disk.close()
+
+	if _, err := os.Stat(tmpFileName); !os.IsNotExist(err) {
+		t.Errorf("%s must be removed\n", tmpFileName)
+	}
+	lastId, _, err := disk.last()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if lastId != 100 + (count - 1) * 100 {
+		t.Errorf("last must be %d, but get %d\n", 100 + (count - 1) * 100, lastId)
+	}
+}
+
+// the elem kept by truncateAfter becomes the last one
+func Test_truncateAfterResetsEndId(t *testing.T) {
+	removeAll(JOURNAL_DATA_PATH)
+	disk := getJournalDisk(t)
+	if disk == nil {
+		return
+	}
+	if err := pushDiskElems(disk, 100); err != nil {
+		t.Error(err)
+		return
+	}
+
+	id := uint64(100 + 50 * 100 + 10)
+	if err := disk.truncateAfter(id); err != nil {
+		t.Error(err)
+		return
+	}
+	disk.close()
+
+	disk = getJournalDisk(t)
+	if disk == nil {
+		return
+	}
+	defer disk.close()
+
+	if disk.recovery != nil {
+		t.Errorf("nothing to recover after truncateAfter, but get %s\n", disk.recovery.String())
+	}
+	elems, err := disk.listAfter(100 + 49 * 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(elems) != 2 || elems[1].startId != 100 + 50 * 100 || elems[1].endId != 0 {
+		t.Errorf("expected the last elem to be %d with endId 0, but get %d elems\n", 100 + 50 * 100, len(elems))
+	}
+}
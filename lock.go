@@ -0,0 +1,105 @@
+package conf
+
+/*
+	lock of a store, so that two processes never write the same store.
+
+	path/header.lock:  the writer holds an exclusive flock on it, and writes its pid in it
+	path/header.rlock: readers (Options.ReadOnly) hold a shared flock on it, so they can run next to the writer.
+	                   a tool which must have the store to itself takes it exclusively as well.
+
+	flock is released by the OS when the process dies, a lock file left behind doesn't lock anything.
+	the lock is taken by flock on unix (lock_unix.go), the other platforms don't lock (lock_other.go).
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func (this *diskIo) getLockFileName() string {
+	return filepath.Join(this.path, this.header+".lock")
+}
+
+func (this *diskIo) getReadLockFileName() string {
+	return filepath.Join(this.path, this.header+".rlock")
+}
+
+// take the lock by the mode the store is opened with
+func (this *diskIo) lock() error {
+	var err error
+	if this.opts.ReadOnly {
+		this.lockFile, err = lockFile(this.getReadLockFileName(), false, this.log())
+	} else {
+		this.lockFile, err = lockFile(this.getLockFileName(), true, this.log())
+	}
+
+	return err
+}
+
+func (this *diskIo) unlock() {
+	if this.lockFile != nil {
+		unlockFile(this.lockFile)
+		this.lockFile = nil
+	}
+}
+
+/*
+	flock the file without waiting, the pid of this process is written in it if exclusive
+	@return *os.File: keep it opened till unlockFile
+ */
+func lockFile(fileName string, exclusive bool, log *storeLogger) (*os.File, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil && !exclusive {
+		// a reader may have no permission to write the directory
+		file, err = os.Open(fileName)
+	}
+	if err != nil {
+		log.error("lock", "open lock file failed", LOG_KEY_FILE, fileName, LOG_KEY_ERROR, err)
+		return nil, err
+	}
+
+	if err := tryLock(file, exclusive); err != nil {
+		defer file.Close()
+		if err == errWouldBlock {
+			return nil, &LockedError{File: fileName, PID: readLockPid(fileName)}
+		}
+		log.error("lock", "lock failed", LOG_KEY_FILE, fileName, LOG_KEY_ERROR, err)
+		return nil, err
+	}
+
+	if exclusive {
+		err := file.Truncate(0)
+		if err == nil {
+			_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+		if err != nil {
+			unlockFile(file)
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+func unlockFile(file *os.File) {
+	releaseLock(file)
+	file.Close()
+}
+
+// pid written in the lock file, 0 if it can't be read
+func readLockPid(fileName string) int {
+	buff, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buff)))
+	if err != nil {
+		return 0
+	}
+
+	return pid
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package conf
+
+/*
+	there is no flock out of unix, the lock files are still created and the pid is written, but nothing is locked: the
+	caller must make sure only one process writes a store, ErrLocked is never returned.
+ */
+
+import (
+	"errors"
+	"os"
+)
+
+const lockSupported = false
+
+// never returned by tryLock here
+var errWouldBlock = errors.New("lock file is locked by another process")
+
+func tryLock(file *os.File, exclusive bool) error {
+	return nil
+}
+
+func releaseLock(file *os.File) {
+}
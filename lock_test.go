@@ -0,0 +1,200 @@
+package conf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	LOCK_DATA_PATH = "./lock_data"
+	LOCK_DATA_HEADER = "lock"
+)
+
+func readOnlyOptions() Options {
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	return opts
+}
+
+// a second writer is refused, and told who holds the store
+func Test_lockExclusive(t *testing.T) {
+	if !lockSupported {
+		t.Skip("the store is not locked on this platform")
+	}
+	removeAll(LOCK_DATA_PATH)
+	cm, err := GetConfManager(LOCK_DATA_PATH, LOCK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = GetConfManager(LOCK_DATA_PATH, LOCK_DATA_HEADER)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("the second writer must get ErrLocked, but get %v\n", err)
+		cm.Close()
+		return
+	}
+	var lockedErr *LockedError
+	if !errors.As(err, &lockedErr) || lockedErr.PID != os.Getpid() {
+		t.Errorf("pid %d must be in the error, but get %v\n", os.Getpid(), err)
+	}
+
+	// opened again when released
+	cm.Close()
+	cm, err = GetConfManager(LOCK_DATA_PATH, LOCK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cm.Close()
+}
+
+// readers run next to the writer, see what was written before they opened, and can't write
+func Test_readOnlyNextToWriter(t *testing.T) {
+	removeAll(LOCK_DATA_PATH)
+	cm, err := GetConfManager(LOCK_DATA_PATH, LOCK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	count := 10
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		return
+	}
+	dataFileName := cm.store.disk.latestFileName
+	fileInfo, err := os.Stat(dataFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// two readers at the same time
+	reader1, err := GetConfManagerWithOptions(LOCK_DATA_PATH, LOCK_DATA_HEADER, readOnlyOptions())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer reader1.Close()
+	reader2, err := GetConfManagerWithOptions(LOCK_DATA_PATH, LOCK_DATA_HEADER, readOnlyOptions())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer reader2.Close()
+
+	lastId := uint64(START_ID + (count - 1) * ID_RANGE)
+	last, err := reader2.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != lastId {
+		t.Errorf("last config must be %d, but get %d\n", lastId, last.FromLogIndex)
+	}
+	conf, err := reader1.GetConfig(uint64(START_ID + ID_RANGE + 1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if conf.FromLogIndex != uint64(START_ID + ID_RANGE) {
+		t.Errorf("config must be from %d, but get %d\n", START_ID + ID_RANGE, conf.FromLogIndex)
+	}
+
+	if err = reader1.PushConfig(lastId + uint64(ID_RANGE), getConf(int(lastId) + ID_RANGE)); err != ErrReadOnly {
+		t.Errorf("push must get ErrReadOnly, but get %v\n", err)
+	}
+	if err = reader1.TruncateBefore(lastId); err != ErrReadOnly {
+		t.Errorf("TruncateBefore must get ErrReadOnly, but get %v\n", err)
+	}
+	if err = reader1.TruncateAfter(uint64(START_ID)); err != ErrReadOnly {
+		t.Errorf("TruncateAfter must get ErrReadOnly, but get %v\n", err)
+	}
+
+	// nothing is changed by the readers, and the writer goes on
+	newFileInfo, err := os.Stat(dataFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if newFileInfo.Size() != fileInfo.Size() {
+		t.Errorf("data file must be %d bytes, but get %d\n", fileInfo.Size(), newFileInfo.Size())
+	}
+	if err = pushConf(cm, int(lastId) + ID_RANGE, ID_RANGE, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+// a reader doesn't drop the torn tail, it reads till the last valid record
+func Test_readOnlyTornTail(t *testing.T) {
+	removeAll(LOCK_DATA_PATH)
+	cm, err := GetConfManager(LOCK_DATA_PATH, LOCK_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	count := 5
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		return
+	}
+	dataFileName := cm.store.disk.latestFileName
+	dataFileSize := cm.store.disk.idxMgr.mapIndex[dataFileName].meta.dataFileSize
+	nextId := uint64(START_ID + count * ID_RANGE)
+	record := cm.store.disk.format.encode(nextId, 0, 0, []byte(getBuff(int(nextId))))
+	crash(cm.store.disk)
+
+	// an append going on
+	file, err := os.OpenFile(dataFileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	file.WriteAt(record[:DATA_HEAD_SIZE + 3], int64(dataFileSize))
+	file.Close()
+
+	reader, err := GetConfManagerWithOptions(LOCK_DATA_PATH, LOCK_DATA_HEADER, readOnlyOptions())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer reader.Close()
+
+	last, err := reader.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != nextId - uint64(ID_RANGE) {
+		t.Errorf("last config must be %d, but get %d\n", nextId - uint64(ID_RANGE), last.FromLogIndex)
+	}
+	if reader.RecoveryReport() != nil {
+		t.Errorf("a reader must not recover, but get %s\n", reader.RecoveryReport().String())
+	}
+
+	fileInfo, err := os.Stat(dataFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if uint64(fileInfo.Size()) != dataFileSize + DATA_HEAD_SIZE + 3 {
+		t.Errorf("data file must not be changed, size %d\n", fileInfo.Size())
+	}
+}
+
+// a reader never creates a store
+func Test_readOnlyMissingStore(t *testing.T) {
+	path := filepath.Join(LOCK_DATA_PATH, "missing")
+	os.RemoveAll(path)
+
+	_, err := GetConfManagerWithOptions(path, LOCK_DATA_HEADER, readOnlyOptions())
+	if err == nil {
+		t.Error("open a missing store read-only must fail")
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s must not be created\n", path)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package conf
+
+import (
+	"os"
+	"syscall"
+)
+
+// the store is locked by the lock files
+const lockSupported = true
+
+// returned by tryLock if the file is locked by another process
+var errWouldBlock = syscall.EWOULDBLOCK
+
+// flock the file without waiting
+func tryLock(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+}
+
+func releaseLock(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
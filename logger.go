@@ -0,0 +1,74 @@
+package conf
+
+/*
+	logger is where the store tells what went wrong and what it did about it, set it by Options.Logger. nothing is
+	logged by default, SlogLogger writes to a log/slog.Logger (logger_slog.go), or implement Logger for your own.
+
+	each entry carries the fields telling where it happens, as the key value pairs log/slog takes:
+	LOG_KEY_HEADER and LOG_KEY_OP always, LOG_KEY_FILE, LOG_KEY_INDEX and LOG_KEY_ERROR if there are.
+	the things done as they should be, e.g. a new data file rolled over to, an index rebuilt or a truncation, are
+	logged at the debug level.
+ */
+
+const (
+	LOG_KEY_HEADER = "header"    // header of the store
+	LOG_KEY_OP     = "op"        // what the store is doing, e.g. push or truncate_before
+	LOG_KEY_FILE   = "file"      // data, index or other file of the store
+	LOG_KEY_INDEX  = "log_index"
+	LOG_KEY_ERROR  = "error"
+)
+
+type Logger interface {
+	// keyvals are key value pairs, a key is a string
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+var (
+	NopLogger Logger = nopLogger{}
+	LOGGER    Logger = NopLogger // default of Options.Logger
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// Options.Logger with the header of a store, attached to each entry with the op
+type storeLogger struct {
+	logger Logger
+	header string
+}
+
+// a nil opts or Options.Logger logs nothing
+func getStoreLogger(opts *Options, header string) *storeLogger {
+	logger := NopLogger
+	if opts != nil && opts.Logger != nil {
+		logger = opts.Logger
+	}
+	return &storeLogger{logger: logger, header: header}
+}
+
+func (this *storeLogger) keyvals(op string, keyvals []interface{}) []interface{} {
+	return append([]interface{}{LOG_KEY_HEADER, this.header, LOG_KEY_OP, op}, keyvals...)
+}
+
+func (this *storeLogger) debug(op string, msg string, keyvals ...interface{}) {
+	this.logger.Debug(msg, this.keyvals(op, keyvals)...)
+}
+
+func (this *storeLogger) info(op string, msg string, keyvals ...interface{}) {
+	this.logger.Info(msg, this.keyvals(op, keyvals)...)
+}
+
+func (this *storeLogger) warn(op string, msg string, keyvals ...interface{}) {
+	this.logger.Warn(msg, this.keyvals(op, keyvals)...)
+}
+
+func (this *storeLogger) error(op string, msg string, keyvals ...interface{}) {
+	this.logger.Error(msg, this.keyvals(op, keyvals)...)
+}
@@ -0,0 +1,35 @@
+//go:build go1.21
+
+package conf
+
+import (
+	"log/slog"
+)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// a Logger writing to logger, slog.Default() if it is nil
+func SlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return slogLogger{logger: logger}
+}
+
+func (this slogLogger) Debug(msg string, keyvals ...interface{}) {
+	this.logger.Debug(msg, keyvals...)
+}
+
+func (this slogLogger) Info(msg string, keyvals ...interface{}) {
+	this.logger.Info(msg, keyvals...)
+}
+
+func (this slogLogger) Warn(msg string, keyvals ...interface{}) {
+	this.logger.Warn(msg, keyvals...)
+}
+
+func (this slogLogger) Error(msg string, keyvals ...interface{}) {
+	this.logger.Error(msg, keyvals...)
+}
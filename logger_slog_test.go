@@ -0,0 +1,27 @@
+//go:build go1.21
+
+package conf
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func Test_slogLogger(t *testing.T) {
+	buff := &bytes.Buffer{}
+	logger := SlogLogger(slog.New(slog.NewTextHandler(buff, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	log := getStoreLogger(&Options{Logger: logger}, LOGGER_DATA_HEADER)
+
+	log.debug("rollover", "roll over to a new data file", LOG_KEY_FILE, "logger_0000000100.data", LOG_KEY_INDEX, uint64(100))
+	line := buff.String()
+	for _, expected := range []string{"level=DEBUG", "header=" + LOGGER_DATA_HEADER, "op=rollover", "file=logger_0000000100.data", "log_index=100"} {
+		if !strings.Contains(line, expected) {
+			t.Errorf("expected %s in %s\n", expected, line)
+		}
+	}
+
+	// nothing is logged by default
+	getStoreLogger(&Options{}, LOGGER_DATA_HEADER).error("push", "push to disk failed")
+}
@@ -0,0 +1,109 @@
+package conf
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+var (
+	LOGGER_DATA_PATH = "./logger_data"
+	LOGGER_DATA_HEADER = "logger"
+)
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// keeps what is logged
+type recordLogger struct {
+	mutex   sync.Mutex
+	entries []logEntry
+}
+
+func (this *recordLogger) log(level string, msg string, keyvals []interface{}) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	fields := make(map[string]interface{})
+	for i := 0; i + 1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	this.entries = append(this.entries, logEntry{level: level, msg: msg, fields: fields})
+}
+
+func (this *recordLogger) Debug(msg string, keyvals ...interface{}) { this.log("debug", msg, keyvals) }
+func (this *recordLogger) Info(msg string, keyvals ...interface{})  { this.log("info", msg, keyvals) }
+func (this *recordLogger) Warn(msg string, keyvals ...interface{})  { this.log("warn", msg, keyvals) }
+func (this *recordLogger) Error(msg string, keyvals ...interface{}) { this.log("error", msg, keyvals) }
+
+// the entries of op
+func (this *recordLogger) find(op string) []logEntry {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	found := make([]logEntry, 0)
+	for _, entry := range this.entries {
+		if entry.fields[LOG_KEY_OP] == op {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+func Test_logger(t *testing.T) {
+	logger := &recordLogger{}
+	cm, err := getTestStore(LOGGER_DATA_PATH, LOGGER_DATA_HEADER, 50, func(opts *Options) {
+		opts.Logger = logger
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if err = cm.TruncateBefore(uint64(START_ID + 20 * ID_RANGE + 5)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// debug events of what is done, with the fields telling where
+	cases := []struct {
+		op     string
+		fields []string
+	}{
+		{"rollover", []string{LOG_KEY_FILE, LOG_KEY_INDEX}},
+		{"build_index", []string{LOG_KEY_FILE}},
+		{"commit_journal", []string{LOG_KEY_FILE, LOG_KEY_INDEX}},
+		{"truncate_before", []string{LOG_KEY_INDEX}},
+	}
+	for _, c := range cases {
+		entries := logger.find(c.op)
+		if len(entries) == 0 {
+			t.Errorf("%s: nothing logged\n", c.op)
+			continue
+		}
+		entry := entries[0]
+		if entry.level != "debug" || entry.fields[LOG_KEY_HEADER] != LOGGER_DATA_HEADER {
+			t.Errorf("%s: expected a debug entry of header %s, but get %+v\n", c.op, LOGGER_DATA_HEADER, entry)
+		}
+		for _, key := range c.fields {
+			if _, ok := entry.fields[key]; !ok {
+				t.Errorf("%s: expected field %s, but get %+v\n", c.op, key, entry)
+			}
+		}
+	}
+
+	// an error, e.g. a failed write of the memory, is logged with the log index
+	failOnce(cm, FAULT_MEM_PUSH)
+	defer setFaultHook(cm, nil)
+	id := START_ID + 50 * ID_RANGE
+	if err = cm.PushConfig(uint64(id), getConf(id)); err != nil {
+		t.Error(err)
+	}
+	entries := logger.find("push")
+	if len(entries) == 0 || entries[0].level != "error" || entries[0].fields[LOG_KEY_INDEX] != uint64(id) || entries[0].fields[LOG_KEY_ERROR] == nil {
+		t.Errorf("expected an error logged for %d, but get %+v\n", id, entries)
+	}
+}
@@ -26,30 +26,39 @@ import (
 	"errors"
 	"fmt"
 	"math"
-	"modules/glog"
 
 )
 
+// defaults of Options, see options.go
 var (
 	MAX_RECORD_NUM int  = 1000 // how many elements it keeps in memory at most
 	MAX_LEVEL_LIMIT int = 10   // recommended best set this value to log(MAX_RECORD_NUM)
 	// when the level(randomly get) of an element is larger than MAX_LEVEL_LIMIT, will be set to MAX_LEVEL_LIMIT
 	NUM_PER_TRUNCATE int = 100 // truncate some old data when reach the MAX_RECORD_NUM
 	UINT64_MAX uint64    = math.MaxUint64
-	MAX_RESULT_NUM       = 10000 // when call List(), you can at most MAX_RESULT_NUM records per time
+	MAX_RESULT_NUM       = 10000 // when call ListBetween() or ListPage(), you can at most MAX_RESULT_NUM records per time
 )
 
 var (
-	MEM_NOTFOUND_ERR = errors.New("mylist.go:NOT FOUND IN MYLIST")
+	// kept for the comparisons inside, errors.Is(MEM_NOTFOUND_ERR, ErrNotFound) is true
+	MEM_NOTFOUND_ERR = fmt.Errorf("mylist.go:NOT FOUND IN MYLIST: %w", ErrNotFound)
+
+	// the list doesn't agree with itself, e.g. a hole between the elems, it must be rebuilt from disk
+	errListBroken = errors.New("mylist.go:BROKEN LIST")
 )
 
 type myList struct {
+	maxRecordNum   int
+	numPerTruncate int
+	maxLevelLimit  int
+
 	rnd *rand.Rand
 	sum      int // how many elements in all (including both n levels)
 	maxLevel int // max level of the list in fact
 	head *myNode
 	tail *myNode
-	lock *sync.Mutex
+	lock *sync.RWMutex // readers share it, push and truncate hold it exclusively
+	log  *storeLogger
 }
 
 /*
@@ -60,6 +69,7 @@ we travel to the next element with the same level specified.
 type myElem struct {
 	startId uint64
 	endId   uint64
+	term    uint64 // raft term it was pushed in
 	data    []byte
 }
 
@@ -75,60 +85,73 @@ type myNode struct {
 }
 
 func getMyList() *myList {
+	opts := DefaultOptions()
+	return getMyListWithOptions(&opts, getStoreLogger(&opts, ""))
+}
+
+func getMyListWithOptions(opts *Options, log *storeLogger) *myList {
 	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	levelLimit := opts.MaxLevelLimit
 
 	//new header
 	head := &myNode{
 		myElem: &myElem{},
-		maxLevel: MAX_LEVEL_LIMIT,
-		levels: make([]*levelPointer, MAX_LEVEL_LIMIT),
+		maxLevel: levelLimit,
+		levels: make([]*levelPointer, levelLimit),
 	}
 
 	//new tail
 	tail := &myNode{
 		myElem: &myElem{},
-		maxLevel: MAX_LEVEL_LIMIT,
-		levels: make([]*levelPointer, MAX_LEVEL_LIMIT),
+		maxLevel: levelLimit,
+		levels: make([]*levelPointer, levelLimit),
 	}
 
-	for i := 0; i < MAX_LEVEL_LIMIT; i++ {
+	for i := 0; i < levelLimit; i++ {
 		head.levels[i] = &levelPointer{}
 		head.levels[i].next = tail
 	}
 
 	mcl := &myList{
+		maxRecordNum: opts.MaxRecordNum,
+		numPerTruncate: opts.NumPerTruncate,
+		maxLevelLimit: levelLimit,
 		rnd: rnd,
 		sum: 0,
 		maxLevel:0,
 		head: head,
 		tail: tail,
-		lock: new(sync.Mutex),
+		lock: new(sync.RWMutex),
+		log: log,
 	}
 
 	return mcl
 }
 
 func (this *myList) close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	this.head = nil
 }
 
 // push an elem to list
 func (this *myList) push(e *myElem) error {
-	// check if reach the max limit
-	if this.sum >= MAX_RECORD_NUM {
-		// delete a few records
-		this.truncateSome(NUM_PER_TRUNCATE)
-	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
 	maxLevel := this.getLevel()
 	newNode := getNode(e, maxLevel)
 
 	if ok := this.isLatest(newNode); !ok {
-		return errors.New(fmt.Sprintf("new node appended is not the latest:%V\n", newNode))
+		return fmt.Errorf("elem of log index %d is not after the latest %d: %w", newNode.startId, this.head.startId, errListBroken)
 	}
 
-	this.lock.Lock()
-	defer this.lock.Unlock()
+	// check if reach the max limit
+	if this.sum >= this.maxRecordNum {
+		// delete a few records
+		this.truncateSomeLocked(this.numPerTruncate)
+	}
 
 	if maxLevel > this.maxLevel {
 		this.maxLevel = maxLevel
@@ -158,6 +181,9 @@ func (this *myList) push(e *myElem) error {
 }
 
 func (this *myList) last() (*myElem, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	if this.sum <= 0 {
 		return nil, MEM_NOTFOUND_ERR
 	}
@@ -221,17 +247,25 @@ func (this *myList) truncateAfter(logIndex uint64) (*myElem, error) {
 		if this.sum <= 0 {
 			return nil, MEM_NOTFOUND_ERR
 		}
-		return nil, errors.New("i dont know")
+		return nil, fmt.Errorf("no elem is kept at log index %d, but the sum is %d: %w", logIndex, this.sum, errListBroken)
 	}
 
 	return resultData, nil
 }
 
 func (this *myList) get(logIndex uint64) (*myElem, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	// start from level max
 	// case x in tmp.next: hits
 	// case tmp.next > x: go head
 	// case tmp.next < x: drop a level (if the level is already 0, return err)
+	// no elems, tail is empty
+	if this.sum == 0 {
+		return nil, MEM_NOTFOUND_ERR
+	}
+
 	nowLevel := this.maxLevel
 	tmpNode := this.head
 	for {
@@ -251,7 +285,7 @@ func (this *myList) get(logIndex uint64) (*myElem, error) {
 		} else {
 			if nowLevel == 0 {
 				// this scene may never happen because there are no holes in the list.
-				return nil, errors.New(fmt.Sprintf("cound not find data for specified logindex: %d", logIndex))
+				return nil, fmt.Errorf("a hole at log index %d: %w", logIndex, errListBroken)
 			}
 
 			nowLevel--
@@ -260,14 +294,17 @@ func (this *myList) get(logIndex uint64) (*myElem, error) {
 		//fmt.Printf("tmp change to (%d,%d)<level %d>, \n", tmpNode.startId, tmpNode.endId, nowLevel)
 		if tmpNode == nil {
 			// impossible to get here, but leave an exit just in case it happens
-			return nil, errors.New("what happend?")
+			return nil, fmt.Errorf("a nil node before log index %d: %w", logIndex, errListBroken)
 		}
 	}
 
-	return nil, errors.New(fmt.Sprintf("cound not find data for specified logindex: %d", logIndex))
+	return nil, fmt.Errorf("a hole at log index %d: %w", logIndex, errListBroken)
 }
 
 func (this *myList) listAfter(logIndex uint64) ([]*myElem, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	count := 0 // how many elems to return
 
 	// find the pos
@@ -279,9 +316,6 @@ func (this *myList) listAfter(logIndex uint64) ([]*myElem, error) {
 
 		count++
 	}
-	if count > MAX_RESULT_NUM {
-		count = MAX_RESULT_NUM
-	}
 
 	resultElems := make([]*myElem, count)
 	for tmpNode := this.head.levels[0].next; count > 0; tmpNode = tmpNode.levels[0].next {
@@ -292,7 +326,40 @@ func (this *myList) listAfter(logIndex uint64) ([]*myElem, error) {
 	return resultElems, nil
 }
 
+/*
+	the elem covering logIndex and the ones before it, from large to small, which is the order of the list
+ */
+func (this *myList) listBefore(logIndex uint64) ([]*myElem, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.sum == 0 {
+		return nil, MEM_NOTFOUND_ERR
+	}
+
+	// find the node right before the hit, going down the levels as get() does
+	tmpNode := this.head
+	for nowLevel := this.maxLevel; nowLevel >= 0; nowLevel-- {
+		for next := tmpNode.levels[nowLevel].next; next != this.tail && next.compareTo(logIndex) > 0; next = tmpNode.levels[nowLevel].next {
+			tmpNode = next
+		}
+	}
+
+	resultElems := make([]*myElem, 0)
+	for node := tmpNode.levels[0].next; node != this.tail; node = node.levels[0].next {
+		resultElems = append(resultElems, node.myElem)
+	}
+	if len(resultElems) == 0 {
+		return nil, MEM_NOTFOUND_ERR
+	}
+
+	return resultElems, nil
+}
+
 func (this *myList) list() ([]*myElem, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	resultElems := make([]*myElem, this.sum)
 
 	// get from memory
@@ -315,6 +382,10 @@ func (this *myList) truncateBefore(logIndex uint64) error {
 	for nowLevel := this.maxLevel; nowLevel >= 0; nowLevel-- {
 		for tmpNode := this.head; tmpNode != this.tail; tmpNode = tmpNode.levels[nowLevel].next {
 			nextNode := tmpNode.levels[nowLevel].next
+			if nextNode == this.tail { // all nodes of this level are larger than x, nothing to cut
+				break
+			}
+
 			cmp := nextNode.compareTo(logIndex)
 			if cmp < 0 { // if tmp > x > next, truncate from next to tail(result: ...tmp->tail)
 				tmpNode.levels[nowLevel].next = this.tail
@@ -347,6 +418,11 @@ func (this *myList) truncateSome(n int) error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
+	return this.truncateSomeLocked(n)
+}
+
+// same as truncateSome, the caller must hold the lock
+func (this *myList) truncateSomeLocked(n int) error {
 	if n >= this.sum {
 		for nowLevel := this.maxLevel; nowLevel >= 0; nowLevel-- {
 			this.head.levels[nowLevel].next = this.tail
@@ -372,12 +448,13 @@ func (this *myList) truncateSome(n int) error {
 
 	// didn't found the position
 	if positionNode == nil {
-		glog.Errorf("truncateSome error, something might wrong, elems count less than the sum\n")
-		return errors.New("truncateSome error, something might wrong, elems count less than the sum\n")
+		this.log.error("truncate_some", "elems count less than the sum, something might wrong", "sum", this.sum, "n", n)
+		return fmt.Errorf("truncate %d of %d elems, but less are linked: %w", n, this.sum, errListBroken)
 	}
 
-	// delete from level 0
+	// delete from level 0, the tail keeps the smallest elem, which is used by get() to stop searching
 	positionNode.levels[0].next = this.tail
+	this.tail.myElem = positionNode.myElem
 
 	// delete from other levels
 	minId := positionNode.startId
@@ -406,10 +483,10 @@ func (this *myList) isLatest(n *myNode) bool {
 	return false
 }
 
-//while insert an element, get a level randomly, return value between [0, MAX_LEVEL_LIMIT-1]
+//while insert an element, get a level randomly, return value between [0, maxLevelLimit-1]
 func (this *myList) getLevel() int {
 	level := 0
-	for i := 0; i < MAX_LEVEL_LIMIT; i++ {
+	for i := 0; i < this.maxLevelLimit; i++ {
 		level = i
 
 		// random between [0, 1]，50% possibility to level++
@@ -425,9 +502,9 @@ func (this *myList) print() {
 	fmt.Println("===Print myList:===")
 	fmt.Printf("sum:%d\n", this.sum)
 	fmt.Printf("maxlevel:%d\n", this.maxLevel)
-	fmt.Printf("MAX_LEVEL_LIMIT:%d\n", MAX_LEVEL_LIMIT)
-	fmt.Printf("MAX_RECORD_NUM:%d\n", MAX_RECORD_NUM)
-	fmt.Printf("MAX_RECORD_NUM:%d\n", NUM_PER_TRUNCATE)
+	fmt.Printf("maxLevelLimit:%d\n", this.maxLevelLimit)
+	fmt.Printf("maxRecordNum:%d\n", this.maxRecordNum)
+	fmt.Printf("numPerTruncate:%d\n", this.numPerTruncate)
 
 	this.head.print()
 	for tmpNode := this.head.levels[0].next; tmpNode != this.tail; tmpNode = tmpNode.levels[0].next {
@@ -136,6 +136,36 @@ func Test_listAfter(t *testing.T) {
 //	}
 }
 
+func Test_listBefore(t *testing.T) {
+	list := getMyList()
+	defer list.close()
+	// build a list, from (100, 200) to (9900, 10000)
+	for i := 1; i < 100; i++ {
+		e := getElem(uint64(i * 100), []byte(fmt.Sprintf("%d", i)))
+		list.push(e)
+	}
+
+	elems, err := list.listBefore(uint64(5324))
+	if err != nil {
+		t.Error("listBefore failed:", err)
+		return
+	}
+	if len(elems) != 53 {
+		t.Errorf("listBefore failed, result num %d, expected %d", len(elems), 53)
+		return
+	}
+	for i, e := range elems {
+		if e.startId != uint64((53 - i) * 100) {
+			t.Errorf("listBefore failed, elem %d starts from %d, expected %d", i, e.startId, (53 - i) * 100)
+			return
+		}
+	}
+
+	if _, err = list.listBefore(uint64(99)); err != MEM_NOTFOUND_ERR {
+		t.Error("listBefore must not find any before the first elem:", err)
+	}
+}
+
 func Test_truncateBefore(t *testing.T) {
 	list := getMyList()
 	defer list.close()
@@ -220,6 +250,33 @@ func Test_truncateSome(t *testing.T) {
 	}
 }
 
+// the elems truncated must not be found again by get
+func Test_getAfterTruncateSome(t *testing.T) {
+	list := getMyList()
+	defer list.close()
+	// build a list, from (100, 199) to (9900, max)
+	for i := 1; i < 100; i++ {
+		e := getElem(uint64(i * 100), []byte(fmt.Sprintf("%d", i)))
+		list.push(e)
+	}
+
+	// (100, 199) ... (8900, 8999) are truncated
+	err := list.truncateSome(89)
+	if err != nil {
+		t.Error("truncateSome error:", err)
+	}
+
+	for _, logIndex := range []uint64{150, 8950} {
+		if e, err := list.get(logIndex); err != MEM_NOTFOUND_ERR {
+			t.Errorf("get %d truncated must return MEM_NOTFOUND_ERR, but get %v, %v\n", logIndex, e, err)
+		}
+	}
+	e, err := list.get(9050)
+	if err != nil || e.startId != 9000 {
+		t.Errorf("get 9050 must return the elem of 9000, but get %v, %v\n", e, err)
+	}
+}
+
 func Test_compareTo(t *testing.T) {
 	node := &myNode {
 		myElem: getElem(uint64(111), []byte("aaa")),
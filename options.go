@@ -0,0 +1,110 @@
+package conf
+
+/*
+	options tune a single ConfManager. They replace the package level knobs (MAX_RECORD_NUM, DATA_BLOCK_SIZE ...),
+	which now only act as the defaults, so that two ConfManagers in one process can be tuned differently.
+
+	DataBlockSize and FileNameNumLen decide how records and files are laid out on disk, they are persisted
+	in the meta file of the store ( path/header.meta ) and a store can't be reopened with different values.
+	so is the ID of Codec, but a store is decoded by the codec it was created with, see codec.go.
+ */
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Options struct {
+	// for memory
+	MaxRecordNum   int // how many elements it keeps in memory at most
+	NumPerTruncate int // truncate some old data when reach the MaxRecordNum
+	MaxLevelLimit  int // max level of the skiplist, recommended best set this value to log(MaxRecordNum)
+	MaxResultNum   int // ListBetween returns at most this configs, and so does a page of ListPage
+
+	// for disk
+	DataMaxFileSize        uint64 // open a new data file if it grows larger than this size
+	DataBlockSize          uint64 // each record stored in disk must be n times of this size (persisted)
+	IdxMaxRecordPerSection uint64 // each section of index must have no more than this records
+	FileNameNumLen         int    // length of startId in the data filename (persisted)
+	SyncPolicy             SyncPolicy // when the writes are flushed to disk, see sync.go
+	Codec                  Codec  // converts configs to records, for a new store (persisted)
+
+	WatchBufferSize int // events queued for a watcher at most, see watch.go
+
+	Logger Logger // what goes wrong and what is done about it, see logger.go, nil logs nothing
+
+	// a config pushed at a log index not after the last config, and not the same as the one there, is taken as a
+	// log conflict of raft: the configs from the index on are truncated and it is pushed. ErrConflict is returned
+	// if not set. see PushConfig.
+	RaftOverwrite bool
+
+	// open the store to read only, it can run next to the process writing the store, see lock.go.
+	// it reads what is on disk when opening, and nothing is written.
+	ReadOnly bool
+
+	// fault injection of the tests, see fault.go. set with the write lock of the store held, nil out of the tests
+	faultHook func(point string) error
+}
+
+// options made up of the package level values
+func DefaultOptions() Options {
+	return Options{
+		MaxRecordNum:           MAX_RECORD_NUM,
+		NumPerTruncate:         NUM_PER_TRUNCATE,
+		MaxLevelLimit:          MAX_LEVEL_LIMIT,
+		MaxResultNum:           MAX_RESULT_NUM,
+		DataMaxFileSize:        DATA_MAX_FILE_SIZE,
+		DataBlockSize:          DATA_BLOCK_SIZE,
+		IdxMaxRecordPerSection: IDX_MAX_RECORD_PER_SECTION,
+		FileNameNumLen:         FILE_NAME_NUMLEN,
+		SyncPolicy:             SYNC_POLICY,
+		Codec:                  CODEC,
+		WatchBufferSize:        WATCH_BUFFER_SIZE,
+		Logger:                 LOGGER,
+	}
+}
+
+func (this *Options) validate() error {
+	if this.MaxRecordNum <= 0 {
+		return errors.New(fmt.Sprintf("invalid options: MaxRecordNum must be positive, got %d", this.MaxRecordNum))
+	}
+	if this.NumPerTruncate <= 0 || this.NumPerTruncate > this.MaxRecordNum {
+		return errors.New(fmt.Sprintf("invalid options: NumPerTruncate must be in [1, %d], got %d", this.MaxRecordNum, this.NumPerTruncate))
+	}
+	if this.MaxLevelLimit <= 0 || this.MaxLevelLimit > 64 {
+		return errors.New(fmt.Sprintf("invalid options: MaxLevelLimit must be in [1, 64], got %d", this.MaxLevelLimit))
+	}
+	if this.MaxResultNum <= 0 {
+		return errors.New(fmt.Sprintf("invalid options: MaxResultNum must be positive, got %d", this.MaxResultNum))
+	}
+
+	// a block must at least hold the header of a record
+	if this.DataBlockSize < DATA_HEAD_SIZE {
+		return errors.New(fmt.Sprintf("invalid options: DataBlockSize must be at least %d, got %d", DATA_HEAD_SIZE, this.DataBlockSize))
+	}
+	if this.DataMaxFileSize < this.DataBlockSize {
+		return errors.New(fmt.Sprintf("invalid options: DataMaxFileSize must be at least DataBlockSize(%d), got %d", this.DataBlockSize, this.DataMaxFileSize))
+	}
+	if this.IdxMaxRecordPerSection == 0 {
+		return errors.New("invalid options: IdxMaxRecordPerSection must be positive")
+	}
+
+	// uint64 has 20 digits at most
+	if this.FileNameNumLen <= 0 || this.FileNameNumLen > 20 {
+		return errors.New(fmt.Sprintf("invalid options: FileNameNumLen must be in [1, 20], got %d", this.FileNameNumLen))
+	}
+
+	if err := this.SyncPolicy.validate(); err != nil {
+		return err
+	}
+
+	if err := validateCodec(this.Codec); err != nil {
+		return err
+	}
+
+	if this.WatchBufferSize <= 0 {
+		return errors.New(fmt.Sprintf("invalid options: WatchBufferSize must be positive, got %d", this.WatchBufferSize))
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package conf
+
+import (
+	"testing"
+)
+
+var (
+	OPTS_DATA_PATH = "./opts_data"
+	OPTS_DATA_HEADER = "opts"
+)
+
+func Test_validateOptions(t *testing.T) {
+	opts := DefaultOptions()
+	if err := opts.validate(); err != nil {
+		t.Error("default options must be valid:", err)
+		return
+	}
+
+	bads := []func(o *Options){
+		func(o *Options) { o.MaxRecordNum = 0 },
+		func(o *Options) { o.NumPerTruncate = o.MaxRecordNum + 1 },
+		func(o *Options) { o.MaxLevelLimit = 0 },
+		func(o *Options) { o.MaxResultNum = 0 },
+		func(o *Options) { o.DataBlockSize = DATA_HEAD_SIZE - 1 },
+		func(o *Options) { o.DataMaxFileSize = o.DataBlockSize - 1 },
+		func(o *Options) { o.IdxMaxRecordPerSection = 0 },
+		func(o *Options) { o.FileNameNumLen = 21 },
+	}
+	for i, bad := range bads {
+		o := DefaultOptions()
+		bad(&o)
+		if err := o.validate(); err == nil {
+			t.Errorf("options %d must be invalid: %+v\n", i, o)
+		}
+	}
+}
+
+// two stores in one process tuned differently
+func Test_GetConfManagerWithOptions(t *testing.T) {
+	removeAll(OPTS_DATA_PATH)
+	removeAll(DATAFILE_PATH)
+
+	opts := DefaultOptions()
+	opts.MaxRecordNum = 50
+	opts.NumPerTruncate = 10
+	opts.DataBlockSize = 1024
+	opts.DataMaxFileSize = 64 * 1024
+	opts.IdxMaxRecordPerSection = 7
+	opts.FileNameNumLen = 16
+	cm, err := GetConfManagerWithOptions(OPTS_DATA_PATH, OPTS_DATA_HEADER, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	cmDefault, err := GetConfManager(DATAFILE_PATH, DATAFILE_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cmDefault.Close()
+
+	count := 300
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cmDefault, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if cm.store.mem.sum > opts.MaxRecordNum {
+		t.Errorf("list keeps %d elems, more than MaxRecordNum %d\n", cm.store.mem.sum, opts.MaxRecordNum)
+	}
+	if cmDefault.store.mem.sum != count {
+		t.Errorf("default list keeps %d elems, expected %d\n", cmDefault.store.mem.sum, count)
+	}
+	if len(cm.store.disk.idxMgr.mapIndex) < 2 {
+		t.Errorf("expected more than one data file with DataMaxFileSize %d\n", opts.DataMaxFileSize)
+	}
+
+	// elems truncated from memory are still readable from disk
+	testIdx := START_ID + 17 * ID_RANGE + 3
+	meta, err := cm.GetConfig(uint64(testIdx))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if meta.FromLogIndex != uint64(START_ID + 17 * ID_RANGE) {
+		t.Errorf("GetConfig %d got [%d, %d]\n", testIdx, meta.FromLogIndex, meta.ToLogIndex)
+	}
+}
+
+func Test_reopenWithIncompatibleOptions(t *testing.T) {
+	removeAll(OPTS_DATA_PATH)
+
+	opts := DefaultOptions()
+	opts.DataBlockSize = 1024
+	cm, err := GetConfManagerWithOptions(OPTS_DATA_PATH, OPTS_DATA_HEADER, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cm, START_ID, ID_RANGE, 10); err != nil {
+		t.Error(err)
+		return
+	}
+	cm.Close()
+
+	// layout options changed, refuse to open
+	_, err = GetConfManager(OPTS_DATA_PATH, OPTS_DATA_HEADER)
+	if err == nil {
+		t.Error("reopen with a different DataBlockSize must fail")
+		return
+	}
+
+	// tuning options changed, that's fine
+	opts.MaxRecordNum = 5
+	opts.NumPerTruncate = 1
+	opts.IdxMaxRecordPerSection = 3
+	cm, err = GetConfManagerWithOptions(OPTS_DATA_PATH, OPTS_DATA_HEADER, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	last, err := cm.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != uint64(START_ID + 9 * ID_RANGE) {
+		t.Errorf("last config is [%d, %d] after reopen\n", last.FromLogIndex, last.ToLogIndex)
+	}
+}
@@ -0,0 +1,712 @@
+package conf
+
+/*
+	rangestore keeps records of bytes, each valid over a range of log indexes: [FromLogIndex, ToLogIndex], ToLogIndex
+	is the index right before the next record, and UINT64_MAX for the last one. what the bytes are is up to the user,
+	ConfManager is a RangeStore of the configs encoded by its codec, other things versioned by the raft log, e.g. ACLs
+	or schemas, can be kept by a RangeStore of their own.
+
+	it keeps the recent records in memory, and persist all records to disk. Read requests will be fast return with the
+	memory data, and write will be first applied to disk for safety.
+	it is safe for concurrent use: reads run in parallel, and writes (push, truncate) hold them off till memory and
+	disk are both updated.
+	a write is all or nothing across the two: if the disk fails in the middle, it is reloaded as after a crash, which
+	finishes or drops what is left, and the memory is rebuilt from it. if the memory fails, it is rebuilt from the disk,
+	and while it can't be, it is marked stale and the reads go to the disk.
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// a record of a RangeStore
+type RangeRecord struct {
+	FromLogIndex uint64
+	ToLogIndex   uint64 // UINT64_MAX for the last one
+	Term         uint64 // raft term it was pushed in, 0 if not told
+	Data         []byte // a copy, it can be changed by the caller
+}
+
+type RangeStore struct {
+	dir    string // dir path of data files
+	header string // header of data files
+	opts   Options
+	mem    *myList
+	disk   *diskIo
+	mutex  sync.RWMutex // writes are serialized, reads share it and never see a half done write
+	syncer *syncer
+
+	observer rangeObserver // nil if nobody is told of the changes
+
+	closeOnce sync.Once
+	closed    bool // set by Close() with mutex held, everything returns ErrClosed after it
+	stale     bool // mem doesn't match disk after a failed write, reads go to disk till it is rebuilt
+}
+
+/*
+	told of the changes of a RangeStore with the lock held, after both memory and disk are changed. a push of SyncBatch
+	is told after it is flushed, with the read lock held.
+ */
+type rangeObserver interface {
+	pushed(elem *myElem)
+	truncatedBefore(logIndex uint64)
+	truncatedAfter(logIndex uint64)
+	restored(last *myElem) // nil if the snapshot is empty
+	closing()
+}
+
+// Options.Logger with the header of the store
+func (this *RangeStore) log() *storeLogger {
+	return getStoreLogger(&this.opts, this.header)
+}
+
+/******************** public functions ************************/
+func GetRangeStore(dir, header string) (*RangeStore, error) {
+	return GetRangeStoreWithOptions(dir, header, DefaultOptions())
+}
+
+/*
+	get a RangeStore tuned by opts, as GetConfManagerWithOptions does. Options.Codec is recorded in a new store, but
+	the records are not encoded by it.
+ */
+func GetRangeStoreWithOptions(dir, header string, opts Options) (*RangeStore, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	store := &RangeStore{
+		dir: dir,
+		header: header,
+		opts: opts,
+		mem: nil,
+		disk: nil,
+	}
+
+	store.mem = getMyListWithOptions(&store.opts, store.log())
+
+	disk, err := getDiskIOWithOptions(dir, header, &store.opts)
+	if err != nil {
+		return nil, err
+	}
+	store.disk = disk
+	store.syncer = newSyncer(disk, &store.mutex, store.opts.SyncPolicy)
+	store.syncer.pushed = store.notifyPushed
+	store.syncer.rollback = store.rollbackPush
+
+	err = store.initList()
+	if err != nil {
+		store.disk.close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// it can be called more than once, only the first one does the work
+func (this *RangeStore) Close() {
+	this.closeOnce.Do(func() {
+		// flush what is left by SyncBatch or SyncInterval
+		if err := this.syncer.close(); err != nil {
+			this.log().error("close", "sync when closing failed", LOG_KEY_ERROR, err)
+		}
+
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+
+		this.closed = true
+		if this.observer != nil {
+			this.observer.closing()
+		}
+		this.mem.close()
+		this.disk.close()
+	})
+}
+
+/*
+	tells what was dropped from the latest data file because of a crash while opening the store, or a write failed in
+	the middle, returns nil if nothing was dropped.
+ */
+func (this *RangeStore) RecoveryReport() *RecoveryReport {
+	return this.disk.recovery
+}
+
+/*
+	push data at logIndex in term, as PushConfigWithTerm does: logIndex must be after the last record, and a record
+	pushed again is a no-op if both data and term are the same, term 0 matches any term. data is copied, the caller may reuse it.
+ */
+func (this *RangeStore) PushRaw(logIndex uint64, term uint64, data []byte) error {
+	pending, err := this.push(logIndex, term, data)
+	if err != nil {
+		return err
+	}
+
+	// SyncBatch waits here, out of the lock, so that concurrent pushers share one flush. the batch is rolled back if
+	// it can't be flushed
+	return this.syncer.wait(pending)
+}
+
+// @return *pendingWrite: the push of SyncBatch to wait for, nil for the other policies
+func (this *RangeStore) push(logIndex uint64, term uint64, buff []byte) (*pendingWrite, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return nil, ErrClosed
+	}
+	if err := this.checkStale(); err != nil {
+		return nil, err
+	}
+
+	replayed, err := this.checkReplay(logIndex, term, buff)
+	if err != nil {
+		return nil, err
+	}
+	if replayed {
+		// the caller waits for it to be flushed, it may be pushed by someone else right before
+		return this.syncer.lastWrite(), nil
+	}
+
+	// push disk
+	err = this.disk.appendWithTerm(logIndex, term, buff)
+	if err != nil {
+		if !diskChanged(err) {
+			return nil, err
+		}
+		this.log().error("push", "push to disk failed", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+		// it may be written completely before failing, it is kept by reloading then, and the memory is rebuilt
+		if this.reload() != nil || !this.disk.isPushed(logIndex) {
+			return nil, err
+		}
+	}
+
+	// SyncAlways flushes here, a record which can't be flushed is rolled back, nothing is pushed then
+	listElem := getElem(logIndex, buff)
+	listElem.term = term
+	pending, syncErr := this.syncer.afterWrite(listElem)
+	if syncErr != nil {
+		this.log().error("push", "sync failed, roll back the record", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, syncErr)
+		this.rollbackPush(logIndex)
+		return nil, syncErr
+	}
+
+	// push mem, it is there already if rebuilt from the disk above
+	if err == nil {
+		err = this.opts.injectFault(FAULT_MEM_PUSH)
+		if err == nil {
+			err = this.mem.push(listElem)
+		}
+		if err != nil {
+			this.log().error("push", "push to memory failed", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+			if err := this.rebuildMem(); err != nil {
+				this.log().error("push", "rebuild memory failed, read from disk till the next write", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+			}
+		}
+	}
+	// SyncBatch tells it after it is flushed
+	if pending == nil {
+		this.notifyPushed(listElem)
+	}
+
+	return pending, nil
+}
+
+func (this *RangeStore) notifyPushed(elem *myElem) {
+	if this.observer != nil {
+		this.observer.pushed(elem)
+	}
+}
+
+/*
+	remove the records appended from logIndex from the disk, as they can't be flushed. the disk is reloaded if they
+	can't be removed, they may be kept then. the memory is rebuilt from the disk. called with the write lock held.
+ */
+func (this *RangeStore) rollbackPush(logIndex uint64) {
+	// the store can't be emptied by truncateAfter
+	err := errors.New("nothing is kept before log index 0")
+	if logIndex > 0 {
+		err = this.disk.truncateAfter(logIndex - 1)
+	}
+	if err != nil {
+		this.log().error("push", "roll back the record failed, reload the disk", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+		// a truncation with its journal written is finished by reloading, the memory is rebuilt then
+		this.reload()
+		return
+	}
+
+	if err := this.rebuildMem(); err != nil {
+		this.log().error("push", "rebuild memory failed, read from disk till the next write", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+	}
+}
+
+// the record covering logIndex
+func (this *RangeStore) GetRaw(logIndex uint64) (*RangeRecord, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return nil, ErrClosed
+	}
+
+	elem, err := this.getElem(logIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	return memElemToRangeRecord(elem), nil
+}
+
+func (this *RangeStore) LastRaw() (*RangeRecord, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return nil, ErrClosed
+	}
+
+	elem, err := this.lastElem()
+	if err != nil {
+		return nil, err
+	}
+
+	return memElemToRangeRecord(elem), nil
+}
+
+/*
+	return at most n records covering the log indexes in [from, to], all of them if n <= 0. the record covering from is
+	the first one, or the first record of the store if from is before it.
+ */
+func (this *RangeStore) ListRaw(from, to uint64, n int) ([]*RangeRecord, error) {
+	return this.list(this.Iterator(from, to), n)
+}
+
+// return at most n records from the one covering from backwards, newest first, all of them if n <= 0
+func (this *RangeStore) ListRawBefore(from uint64, n int) ([]*RangeRecord, error) {
+	return this.list(this.ReverseIterator(from), n)
+}
+
+/*
+	call fn with the records covering the log indexes in [from, to] in order, till it returns an error, which is
+	returned then. the read lock is held all the time, so the records are of the same moment, and the writes wait
+	till it is done.
+ */
+func (this *RangeStore) ScanRaw(from, to uint64, fn func(record *RangeRecord) error) error {
+	return this.scan(this.Iterator(from, to), func(elem *myElem) error {
+		return fn(memElemToRangeRecord(elem))
+	})
+}
+
+/*
+	return the raft term of the record covering logIndex, 0 if it was pushed without a term.
+ */
+func (this *RangeStore) GetTerm(logIndex uint64) (uint64, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return 0, ErrClosed
+	}
+
+	elem, err := this.getElem(logIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	return elem.term, nil
+}
+
+/*
+	truncate the records from logIndex on if the one starting from logIndex is of a term other than term, as raft does
+	when an entry of the follower conflicts with the leader's. nothing is done if no record starts from logIndex, or
+	either term is 0, which is unknown.
+	@return bool: the records are truncated
+ */
+func (this *RangeStore) TruncateAfterTermMismatch(logIndex uint64, term uint64) (bool, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return false, ErrClosed
+	}
+	if err := this.checkStale(); err != nil {
+		return false, err
+	}
+	// the batch pushed before is flushed or rolled back first
+	if err := this.syncer.settleLocked(); err != nil {
+		return false, err
+	}
+
+	elem, err := this.getElem(logIndex)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if elem.startId != logIndex || sameTerm(elem.term, term) {
+		return false, nil
+	}
+	// nothing is kept before log index 0, the store can't be emptied by truncateAfter
+	if logIndex == 0 {
+		return false, &ConflictError{LogIndex: logIndex, StartId: elem.startId}
+	}
+
+	this.log().warn("truncate_after_term_mismatch", "the record is of another term, truncate the ones from it", LOG_KEY_INDEX, logIndex,
+		"term", elem.term, "expected_term", term)
+	if err = this.truncateAfter(logIndex - 1); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// delete the records before logIndex, the one covering it is kept and starts from it
+func (this *RangeStore) TruncateBefore(logIndex uint64) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return ErrClosed
+	}
+
+	if err := this.checkStale(); err != nil {
+		return err
+	}
+	// the batch pushed before is flushed or rolled back first
+	if err := this.syncer.settleLocked(); err != nil {
+		return err
+	}
+
+	// truncate from disk
+	err := this.disk.truncateBefore(logIndex)
+	if err != nil {
+		this.log().error("truncate_before", "truncate the disk failed", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+		// it is finished by reloading if its journal is written, the memory is rebuilt then
+		if !diskChanged(err) || this.reload() != nil || !this.disk.isTruncatedBefore(logIndex) {
+			return err
+		}
+	} else {
+		// truncate from mem
+		err = this.opts.injectFault(FAULT_MEM_TRUNCATE)
+		if err == nil {
+			err = this.mem.truncateBefore(logIndex)
+		}
+		if err != nil {
+			this.log().error("truncate_before", "truncate the memory failed", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+			if err := this.rebuildMem(); err != nil {
+				this.log().error("truncate_before", "rebuild memory failed, read from disk till the next write", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+			}
+		}
+	}
+
+	this.log().debug("truncate_before", "truncated", LOG_KEY_INDEX, logIndex)
+	if this.observer != nil {
+		this.observer.truncatedBefore(logIndex)
+	}
+
+	return nil
+}
+
+// delete the records after logIndex, the one covering it becomes the last one
+func (this *RangeStore) TruncateAfter(logIndex uint64) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return ErrClosed
+	}
+
+	if err := this.checkStale(); err != nil {
+		return err
+	}
+	// the batch pushed before is flushed or rolled back first
+	if err := this.syncer.settleLocked(); err != nil {
+		return err
+	}
+
+	return this.truncateAfter(logIndex)
+}
+
+// called with the write lock held
+func (this *RangeStore) truncateAfter(logIndex uint64) error {
+	// truncate from disk
+	err := this.disk.truncateAfter(logIndex)
+	if err != nil {
+		this.log().error("truncate_after", "truncate the disk failed", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+		// it is finished by reloading if its journal is written, the memory is rebuilt then
+		if !diskChanged(err) || this.reload() != nil || !this.disk.isTruncatedAfter(logIndex) {
+			return err
+		}
+	} else {
+		// truncate from mem
+		err = this.opts.injectFault(FAULT_MEM_TRUNCATE)
+		if err == nil {
+			_, err = this.mem.truncateAfter(logIndex)
+		}
+		if err != nil {
+			this.log().error("truncate_after", "truncate the memory failed", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+			if err := this.rebuildMem(); err != nil {
+				this.log().error("truncate_after", "rebuild memory failed, read from disk till the next write", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+			}
+		}
+	}
+
+	this.log().debug("truncate_after", "truncated", LOG_KEY_INDEX, logIndex)
+	if this.observer != nil {
+		this.observer.truncatedAfter(logIndex)
+	}
+
+	return nil
+}
+
+/**************** internal functions ***********************************/
+
+// returned by the fn of scan to stop early
+var errStopScan = errors.New("stop scanning")
+
+// at most n records of it, all of them if n <= 0
+func (this *RangeStore) list(it *Iterator, n int) ([]*RangeRecord, error) {
+	from := it.next
+	result := make([]*RangeRecord, 0)
+	err := this.scan(it, func(elem *myElem) error {
+		result = append(result, memElemToRangeRecord(elem))
+		if n > 0 && len(result) >= n {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, &NotFoundError{LogIndex: from}
+	}
+
+	return result, nil
+}
+
+// iterate it with the read lock held all the time
+func (this *RangeStore) scan(it *Iterator, fn func(elem *myElem) error) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return ErrClosed
+	}
+
+	return this.scanLocked(it, fn)
+}
+
+// iterate it, called with the lock held. fn stops it by errStopScan
+func (this *RangeStore) scanLocked(it *Iterator, fn func(elem *myElem) error) error {
+	it.locked = true
+	defer it.Close()
+	for it.Next() {
+		if err := fn(it.elem); err != nil {
+			if err == errStopScan {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// term 0 is unknown, it matches any term
+func sameTerm(a, b uint64) bool {
+	return a == b || a == 0 || b == 0
+}
+
+func memElemToRangeRecord(memElem *myElem) *RangeRecord {
+	return &RangeRecord{
+		FromLogIndex: memElem.startId,
+		ToLogIndex: memElem.endId,
+		Term: memElem.term,
+		// the cached bytes must not be changed by the caller
+		Data: append([]byte(nil), memElem.data...),
+	}
+}
+
+/*
+	read data of the latest file from disk and push them into list
+ */
+func (this *RangeStore) initList() error {
+	elems, err := this.disk.listOfLatestFile()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range elems {
+		listElem := getElem(e.startId, e.buff)
+		listElem.term = e.term
+		err = this.mem.push(listElem)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+	check a push at logIndex not after the last record, see PushConfig. called with the write lock held.
+	@return bool: the same record is stored at logIndex already
+ */
+func (this *RangeStore) checkReplay(logIndex uint64, term uint64, buff []byte) (bool, error) {
+	last, err := this.lastElem()
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if logIndex > last.startId {
+		return false, nil
+	}
+
+	elem, err := this.getElem(logIndex)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		// truncated before, it can't be told
+		it := this.Iterator(0, UINT64_MAX)
+		it.locked = true
+		defer it.Close()
+		if !it.Next() {
+			return false, it.Err()
+		}
+		return false, &ConflictError{LogIndex: logIndex, StartId: it.Record().FromLogIndex}
+	}
+	if elem.startId == logIndex && sameTerm(elem.term, term) && bytes.Equal(elem.data, buff) {
+		return true, nil
+	}
+
+	// nothing is kept before log index 0, the store can't be emptied by truncateAfter
+	if !this.opts.RaftOverwrite || logIndex == 0 {
+		return false, &ConflictError{LogIndex: logIndex, StartId: elem.startId}
+	}
+
+	this.log().warn("push", "the record conflicts with the one stored, truncate the ones from it", LOG_KEY_INDEX, logIndex,
+		"start_id", elem.startId)
+	return false, this.truncateAfter(logIndex - 1)
+}
+
+/*
+	rebuild the memory from the disk, it is marked stale if failed, and rebuilt by the next write. the memory is read
+	around while stale, the caller logs the error if the write it follows is kept. called with the write lock held.
+ */
+func (this *RangeStore) rebuildMem() error {
+	this.stale = true
+	if err := this.opts.injectFault(FAULT_MEM_REBUILD); err != nil {
+		return err
+	}
+
+	this.mem.close()
+	this.mem = getMyListWithOptions(&this.opts, this.log())
+	if err := this.initList(); err != nil {
+		return err
+	}
+
+	this.stale = false
+	return nil
+}
+
+/*
+	reload the disk after a write failed in the middle, and rebuild the memory from it.
+	only the error of the disk is returned, the memory is read around while stale.
+ */
+func (this *RangeStore) reload() error {
+	this.stale = true
+	if err := this.disk.reload(); err != nil {
+		this.log().error("reload", "reload the disk failed", LOG_KEY_FILE, this.dir, LOG_KEY_ERROR, err)
+		return err
+	}
+
+	if err := this.rebuildMem(); err != nil {
+		this.log().error("reload", "rebuild memory failed, read from disk till the next write", LOG_KEY_FILE, this.dir, LOG_KEY_ERROR, err)
+	}
+	return nil
+}
+
+// called before a write, the memory must match the disk before it is changed
+func (this *RangeStore) checkStale() error {
+	if !this.stale {
+		return nil
+	}
+
+	if err := this.disk.reload(); err != nil {
+		this.log().error("reload", "reload the disk failed", LOG_KEY_FILE, this.dir, LOG_KEY_ERROR, err)
+		return err
+	}
+	if err := this.rebuildMem(); err != nil {
+		return fmt.Errorf("memory is stale and can't be rebuilt from disk: %w", err)
+	}
+
+	return nil
+}
+
+// whether a failed write may have changed the disk, the ones rejected before writing anything don't
+func diskChanged(err error) bool {
+	return !errors.Is(err, ErrOutOfOrder) && !errors.Is(err, ErrTooLarge) && !errors.Is(err, ErrReadOnly)
+}
+
+/*
+	the record covering logIndex, read from memory if it is there, or from disk. called with the lock held.
+ */
+func (this *RangeStore) getElem(logIndex uint64) (*myElem, error) {
+	if !this.stale {
+		memElem, err := this.mem.get(logIndex)
+		if err == nil {
+			return memElem, nil
+		} else if errors.Is(err, errListBroken) {
+			// the disk still has it
+			this.log().error("get", "read memory failed, read from disk", LOG_KEY_INDEX, logIndex, LOG_KEY_ERROR, err)
+		} else if err != MEM_NOTFOUND_ERR {
+			return nil, err
+		}
+	}
+
+	// if not found in memory, try to read from disk
+	diskElem, err := this.disk.getElem(logIndex)
+	if err != nil {
+		if err == DISK_NOTFOUND_ERR {
+			return nil, &NotFoundError{LogIndex: logIndex}
+		}
+		return nil, err
+	}
+	endId := diskElem.endId
+	if endId == 0 {
+		// the last one, it is only read from disk when mem is stale
+		endId = UINT64_MAX
+	}
+
+	return &myElem{startId: diskElem.startId, endId: endId, term: diskElem.term, data: diskElem.buff}, nil
+}
+
+// the last record, called with the lock held
+func (this *RangeStore) lastElem() (*myElem, error) {
+	if this.stale {
+		diskElem, err := this.disk.lastElem()
+		if err != nil {
+			if err == DISK_NOTFOUND_ERR {
+				return nil, ErrNotFound
+			}
+			return nil, err
+		}
+		return &myElem{startId: diskElem.startId, endId: UINT64_MAX, term: diskElem.term, data: diskElem.buff}, nil
+	}
+
+	elem, err := this.mem.last()
+	if err != nil {
+		if err == MEM_NOTFOUND_ERR {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return elem, nil
+}
@@ -0,0 +1,140 @@
+package conf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var (
+	RANGE_DATA_PATH = "./range_data"
+	RANGE_DATA_HEADER = "range"
+)
+
+func getRangeStore() (*RangeStore, error) {
+	return GetRangeStoreWithOptions(RANGE_DATA_PATH, RANGE_DATA_HEADER, getTestOptions(nil))
+}
+
+// bytes which are not a config
+func getRangeData(id int) []byte {
+	return []byte(fmt.Sprintf("schema version %d", id))
+}
+
+func Test_rangeStore(t *testing.T) {
+	removeAll(RANGE_DATA_PATH)
+	store, err := getRangeStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = store.LastRaw(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an empty store, but get %v\n", err)
+	}
+
+	count := 100
+	for i := 0; i < count; i++ {
+		id := START_ID + i * ID_RANGE
+		if err = store.PushRaw(uint64(id), uint64(i / 10 + 1), getRangeData(id)); err != nil {
+			t.Error(err)
+			store.Close()
+			return
+		}
+	}
+
+	// pushed again is a no-op, other data is a conflict
+	if err = store.PushRaw(uint64(START_ID), 1, getRangeData(START_ID)); err != nil {
+		t.Errorf("expected the replay to be a no-op, but get %v\n", err)
+	}
+	if err = store.PushRaw(uint64(START_ID), 1, getRangeData(START_ID + 1)); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected ErrConflict, but get %v\n", err)
+	}
+	if err = store.TruncateAfter(uint64(START_ID + (count - 2) * ID_RANGE + 5)); err != nil {
+		t.Error(err)
+	}
+	store.Close()
+
+	// read from memory and from disk after reopening
+	store, err = getRangeStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer store.Close()
+	for i := 0; i < count - 1; i++ {
+		id := START_ID + i * ID_RANGE
+		record, err := store.GetRaw(uint64(id + 5))
+		if err != nil || record.FromLogIndex != uint64(id) || record.Term != uint64(i / 10 + 1) || !bytes.Equal(record.Data, getRangeData(id)) {
+			t.Errorf("record %d must be from %d, but get %+v, %v\n", i, id, record, err)
+			return
+		}
+	}
+	last, err := store.LastRaw()
+	if err != nil || last.FromLogIndex != uint64(START_ID + (count - 2) * ID_RANGE) || last.ToLogIndex != UINT64_MAX {
+		t.Errorf("expected the last one from %d, but get %+v, %v\n", START_ID + (count - 2) * ID_RANGE, last, err)
+	}
+
+	// the records follow one another
+	n := 0
+	it := store.Iterator(0, UINT64_MAX)
+	defer it.Close()
+	for it.Next() {
+		record := it.Record()
+		if it.Meta() != nil || record.FromLogIndex != uint64(START_ID + n * ID_RANGE) {
+			t.Errorf("unexpected record %d: %+v\n", n, record)
+			return
+		}
+		n++
+	}
+	if it.Err() != nil || n != count - 1 {
+		t.Errorf("expected %d records, but get %d, %v\n", count - 1, n, it.Err())
+	}
+}
+
+// the bytes pushed and read are not shared with the cache
+func Test_rangeStoreCopy(t *testing.T) {
+	removeAll(RANGE_DATA_PATH)
+	store, err := getRangeStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer store.Close()
+
+	data := getRangeData(START_ID)
+	if err = store.PushRaw(uint64(START_ID), 1, data); err != nil {
+		t.Error(err)
+		return
+	}
+	data[0] = 'x'
+	record, err := store.GetRaw(uint64(START_ID))
+	if err != nil || !bytes.Equal(record.Data, getRangeData(START_ID)) {
+		t.Errorf("the pushed bytes are changed by the caller: %+v, %v\n", record, err)
+		return
+	}
+	record.Data[0] = 'x'
+
+	it := store.Iterator(0, UINT64_MAX)
+	defer it.Close()
+	if !it.Next() || !bytes.Equal(it.Record().Data, getRangeData(START_ID)) {
+		t.Errorf("the cached bytes are changed by the caller: %+v, %v\n", it.Record(), it.Err())
+	}
+	it.Record().Data[0] = 'x'
+	if last, err := store.LastRaw(); err != nil || !bytes.Equal(last.Data, getRangeData(START_ID)) {
+		t.Errorf("the cached bytes are changed by the caller: %+v, %v\n", last, err)
+	}
+}
+
+// the bytes of a ConfManager are always encoded by its codec, it has no raw writes or reads
+func Test_rangeStoreNotExposed(t *testing.T) {
+	var cm interface{} = &ConfManager{}
+	if _, ok := cm.(interface{ PushRaw(uint64, uint64, []byte) error }); ok {
+		t.Error("ConfManager must not have PushRaw")
+	}
+	if _, ok := cm.(interface{ GetRaw(uint64) (*RangeRecord, error) }); ok {
+		t.Error("ConfManager must not have GetRaw")
+	}
+	if _, ok := cm.(interface{ LastRaw() (*RangeRecord, error) }); ok {
+		t.Error("ConfManager must not have LastRaw")
+	}
+}
@@ -0,0 +1,212 @@
+package conf
+
+/*
+	record is the unit stored in data files, the layout depends on the format version of the store:
+
+	[record] v1 = start_id(8 byte)end_id(8 byte)buff_len(8 byte)buff(buff_len byte) 0 0 0 0 0 (expand to n * block size)
+	[record] v2 = start_id(8 byte)end_id(8 byte)buff_len(8 byte)crc(4 byte)buff(buff_len byte) 0 0 0 0 0 (expand to n * block size)
+	[record] v3 = start_id(8 byte)end_id(8 byte)buff_len(8 byte)crc(4 byte)term(8 byte)buff(buff_len byte) 0 0 0 0 0 (expand to n * block size)
+
+	crc is the crc32(castagnoli) of start_id, buff_len, term (v3) and buff. end_id is left out, because it is rewritten in
+	place when the next record is appended or the records after it are truncated, it's checked by linking with the next
+	record. term is the raft term the config was pushed in, 0 if it's not told.
+	the format version is kept per data file: the ones written before a store is upgraded keep their format, v1 is read
+	without crc checks, and v1 and v2 are read with term 0, which is unknown and matches any term. the data files written
+	after it are of the latest format, see storeMeta.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+var (
+	CRC_TABLE = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type recordFormat struct {
+	version   uint64 // format version of the store
+	blockSize uint64 // each record must be n times of this size
+	headSize  uint64 // size of the record header, buff starts here
+}
+
+func getRecordFormat(version uint64, blockSize uint64) *recordFormat {
+	format := &recordFormat{
+		version: version,
+		blockSize: blockSize,
+		headSize: DATA_HEAD_SIZE,
+	}
+
+	if version < 2 {
+		format.headSize = DATA_HEAD_SIZE_V1
+	} else if version < 3 {
+		format.headSize = DATA_HEAD_SIZE_V2
+	}
+
+	return format
+}
+
+func (this *recordFormat) hasCrc() bool {
+	return this.version >= 2
+}
+
+func (this *recordFormat) hasTerm() bool {
+	return this.version >= 3
+}
+
+/*
+ when the length of a record is more than the block size, will across multiple blocks, and padded with '\0' at the end to filling-in the entire block
+ this func is used to find how many '\0' was padded
+ @param buffLen : length of the record buff, not contain the length of the header
+ @return paddedSize: size of the padded parts
+  */
+func (this *recordFormat) paddedSize(buffLen uint64) uint64 {
+	tailSize := (this.headSize + buffLen) % this.blockSize
+	if tailSize == 0 {
+		return uint64(0)
+	} else {
+		return this.blockSize - tailSize
+	}
+}
+
+// size of the whole record on disk, including header and padding
+func (this *recordFormat) recordSize(buffLen uint64) uint64 {
+	return this.headSize + buffLen + this.paddedSize(buffLen)
+}
+
+// convert a record to bytes, padded to n * block size
+func (this *recordFormat) encode(startId uint64, endId uint64, term uint64, buff []byte) []byte {
+	buffLen := uint64(len(buff))
+	record := make([]byte, this.recordSize(buffLen))
+
+	binary.BigEndian.PutUint64(record[DATA_STARTID_POS : DATA_STARTID_POS+ID_LEN], startId)
+	binary.BigEndian.PutUint64(record[DATA_ENDID_POS : DATA_ENDID_POS+ID_LEN], endId)
+	binary.BigEndian.PutUint64(record[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS+SIZE_LEN], buffLen)
+	copy(record[this.headSize : this.headSize+buffLen], buff)
+
+	if this.hasTerm() {
+		binary.BigEndian.PutUint64(record[DATA_TERM_POS : DATA_TERM_POS+TERM_LEN], term)
+	}
+	if this.hasCrc() {
+		binary.BigEndian.PutUint32(record[DATA_CRC_POS : DATA_CRC_POS+CRC_LEN], this.checksum(record, 0, buffLen))
+	}
+
+	return record
+}
+
+// crc of the record starts at pos of buff
+func (this *recordFormat) checksum(buff []byte, pos uint64, buffLen uint64) uint32 {
+	crc := crc32.Update(0, CRC_TABLE, buff[pos+DATA_STARTID_POS : pos+DATA_STARTID_POS+ID_LEN])
+	crc = crc32.Update(crc, CRC_TABLE, buff[pos+DATA_BUFFLEN_POS : pos+DATA_BUFFLEN_POS+SIZE_LEN])
+	if this.hasTerm() {
+		crc = crc32.Update(crc, CRC_TABLE, buff[pos+DATA_TERM_POS : pos+DATA_TERM_POS+TERM_LEN])
+	}
+	crc = crc32.Update(crc, CRC_TABLE, buff[pos+this.headSize : pos+this.headSize+buffLen])
+	return crc
+}
+
+/*
+	parse and check the record starts at pos of buff
+	@param fileName, fileOffset: where buff is read from, only used to report the corruption
+	@return *diskElem: the record, buff is copied
+	@return uint64: size of the record, including header and padding
+ */
+func (this *recordFormat) parseRecord(buff []byte, pos uint64, fileName string, fileOffset uint64) (*diskElem, uint64, error) {
+	buffLen := uint64(len(buff))
+	corrupt := func(reason string) error {
+		return &CorruptError{File: fileName, Offset: fileOffset + pos, Reason: reason}
+	}
+
+	if pos + this.headSize > buffLen {
+		return nil, 0, corrupt(fmt.Sprintf("incomplete header, need %d bytes but only %d left", this.headSize, buffLen - pos))
+	}
+
+	startId := binary.BigEndian.Uint64(buff[pos+DATA_STARTID_POS : pos+DATA_STARTID_POS+ID_LEN])
+	endId := binary.BigEndian.Uint64(buff[pos+DATA_ENDID_POS : pos+DATA_ENDID_POS+ID_LEN])
+	elemBuffLen := binary.BigEndian.Uint64(buff[pos+DATA_BUFFLEN_POS : pos+DATA_BUFFLEN_POS+SIZE_LEN])
+
+	// check buff_len before using it, a broken one may walk past the end of data
+	left := buffLen - pos - this.headSize
+	if elemBuffLen > left {
+		return nil, 0, corrupt(fmt.Sprintf("buff_len %d exceeds the end of data, only %d left", elemBuffLen, left))
+	}
+	recordSize := this.recordSize(elemBuffLen)
+	if pos + recordSize > buffLen {
+		return nil, 0, corrupt(fmt.Sprintf("incomplete record, need %d bytes but only %d left", recordSize, buffLen - pos))
+	}
+
+	if this.hasCrc() {
+		crc := binary.BigEndian.Uint32(buff[pos+DATA_CRC_POS : pos+DATA_CRC_POS+CRC_LEN])
+		if expected := this.checksum(buff, pos, elemBuffLen); crc != expected {
+			return nil, 0, corrupt(fmt.Sprintf("checksum mismatch, stored %08x but computed %08x", crc, expected))
+		}
+	}
+
+	// endId of the last record is 0
+	if endId != 0 && endId < startId {
+		return nil, 0, corrupt(fmt.Sprintf("end_id %d is less than start_id %d", endId, startId))
+	}
+
+	elem := &diskElem{
+		startId: startId,
+		endId: endId,
+		buff: make([]byte, elemBuffLen),
+	}
+	if this.hasTerm() {
+		elem.term = binary.BigEndian.Uint64(buff[pos+DATA_TERM_POS : pos+DATA_TERM_POS+TERM_LEN])
+	}
+	copy(elem.buff, buff[pos+this.headSize : pos+this.headSize+elemBuffLen])
+
+	return elem, recordSize, nil
+}
+
+/*
+	whether the record starts at pos of buff runs to the end of buff, told by its header: the header is incomplete, or
+	buff_len reaches the end. a torn append can only break such a record. so does a tail of all 0, as the file may be
+	extended before its data reaches the disk on a power loss.
+ */
+func (this *recordFormat) runsToEnd(buff []byte, pos uint64) bool {
+	buffLen := uint64(len(buff))
+	if pos + this.headSize > buffLen || isZeroTail(buff, pos) {
+		return true
+	}
+
+	elemBuffLen := binary.BigEndian.Uint64(buff[pos+DATA_BUFFLEN_POS : pos+DATA_BUFFLEN_POS+SIZE_LEN])
+	if elemBuffLen > buffLen - pos - this.headSize {
+		return true
+	}
+	return pos + this.recordSize(elemBuffLen) >= buffLen
+}
+
+/*
+	parse records of buff one by one, stop when fn returns false
+	@param fn: called with each record and its position in buff
+ */
+func (this *recordFormat) scanRecords(buff []byte, fileName string, fileOffset uint64, fn func(elem *diskElem, pos uint64) bool) error {
+	buffLen := uint64(len(buff))
+	for pos := uint64(0); pos < buffLen; {
+		elem, recordSize, err := this.parseRecord(buff, pos, fileName, fileOffset)
+		if err != nil {
+			return err
+		}
+
+		if !fn(elem, pos) {
+			break
+		}
+
+		pos += recordSize
+	}
+
+	return nil
+}
+
+// all the bytes from pos are 0
+func isZeroTail(buff []byte, pos uint64) bool {
+	for _, b := range buff[pos : ] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
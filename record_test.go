@@ -0,0 +1,119 @@
+package conf
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	RECORD_DATA_PATH = "./record_data"
+	RECORD_DATA_HEADER = "record"
+)
+
+func Test_recordEncodeAndParse(t *testing.T) {
+	format := getRecordFormat(META_FORMAT_VERSION, 512)
+	buff := []byte(getBuff(123))
+
+	record := format.encode(123, 0, 0, buff)
+	if uint64(len(record)) != 512 {
+		t.Errorf("record size must be padded to 512, but get %d\n", len(record))
+		return
+	}
+
+	elem, size, err := format.parseRecord(record, 0, "test", 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if size != 512 || elem.startId != 123 || elem.endId != 0 || string(elem.buff) != string(buff) {
+		t.Errorf("parse error, get [%d, %d] %s size %d\n", elem.startId, elem.endId, string(elem.buff), size)
+		return
+	}
+
+	// endId is not covered by crc, rewrite it in place
+	binary.BigEndian.PutUint64(record[DATA_ENDID_POS : DATA_ENDID_POS+ID_LEN], 199)
+	if _, _, err = format.parseRecord(record, 0, "test", 0); err != nil {
+		t.Error("rewrite endId must keep the record valid:", err)
+		return
+	}
+
+	// flip a bit of buff
+	record[format.headSize + 3] ^= 0x10
+	_, _, err = format.parseRecord(record, 0, "test", 1024)
+	if cerr, ok := err.(*CorruptError); !ok || cerr.Offset != 1024 || cerr.File != "test" {
+		t.Errorf("a flipped bit must be found, but get %v\n", err)
+		return
+	}
+	record[format.headSize + 3] ^= 0x10
+
+	// a broken buff_len must not walk past the end
+	binary.BigEndian.PutUint64(record[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS+SIZE_LEN], 1 << 40)
+	if _, _, err = format.parseRecord(record, 0, "test", 0); err == nil {
+		t.Error("a broken buff_len must be found")
+		return
+	}
+
+	// records of v1 has no crc
+	formatV1 := getRecordFormat(1, 512)
+	recordV1 := formatV1.encode(123, 0, 0, buff)
+	recordV1[formatV1.headSize + 3] ^= 0x10
+	if _, _, err = formatV1.parseRecord(recordV1, 0, "test", 0); err != nil {
+		t.Error("v1 records are not checked by crc:", err)
+		return
+	}
+}
+
+// a flipped bit in a data file is reported by GetConfig with the file and offset
+func Test_GetConfigCorrupt(t *testing.T) {
+	cm, err := getTestStore(RECORD_DATA_PATH, RECORD_DATA_HEADER, 100, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cm.Close()
+
+	// flip a bit of the second record in the first data file
+	firstFile := filepath.Join(RECORD_DATA_PATH, "record_0000001000.data")
+	file, err := os.OpenFile(firstFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	head := make([]byte, DATA_HEAD_SIZE)
+	file.ReadAt(head, 0)
+	secondPos := cm.store.disk.format.recordSize(binary.BigEndian.Uint64(head[DATA_BUFFLEN_POS : DATA_BUFFLEN_POS+SIZE_LEN]))
+	b := make([]byte, 1)
+	file.ReadAt(b, int64(secondPos + DATA_HEAD_SIZE + 5))
+	b[0] ^= 0x01
+	file.WriteAt(b, int64(secondPos + DATA_HEAD_SIZE + 5))
+	file.Close()
+
+	cm, err = GetConfManagerWithOptions(RECORD_DATA_PATH, RECORD_DATA_HEADER, getTestOptions(nil))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	_, err = cm.GetConfig(uint64(START_ID + ID_RANGE + 1))
+	cerr, ok := err.(*CorruptError)
+	if !ok {
+		t.Errorf("GetConfig must return a CorruptError, but get %v\n", err)
+		return
+	}
+	if cerr.Offset != secondPos || filepath.Base(cerr.File) != filepath.Base(firstFile) {
+		t.Errorf("corrupt record must be at %s:%d, but get %s\n", firstFile, secondPos, cerr.Error())
+	}
+
+	_, err = cm.ListAfter(uint64(START_ID))
+	if _, ok := err.(*CorruptError); !ok {
+		t.Errorf("ListAfter must return a CorruptError, but get %v\n", err)
+	}
+
+	// others are fine
+	if _, err = cm.GetConfig(uint64(START_ID + 50 * ID_RANGE)); err != nil {
+		t.Error(err)
+	}
+}
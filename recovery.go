@@ -0,0 +1,188 @@
+package conf
+
+/*
+	recovery of torn writes.
+
+	if the process dies in the middle of append(), the latest data file may end with a partial record, and the endId
+	of the record before it may have been set already. when opening a store, the latest data file is scanned to find the
+	last complete and valid record, the file is truncated there and the endId of that record is reset to 0 (the last one).
+	only the record running to the end of the file can be broken by a torn append, one broken before it is returned as
+	a *CorruptError, the records after it are not dropped, see Repair.
+	if no valid record is left, the file is moved to the quarantine directory (never removed) and the data file before it
+	is checked the same way.
+	a read-only store changes nothing: it reads the latest data file till the last valid record, as the rest may be an
+	append going on in the writer.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// tells what was dropped when opening a store
+type RecoveryReport struct {
+	File         string   // data file which is truncated
+	ValidSize    uint64   // size of the data file kept
+	DroppedBytes uint64   // size of the torn tail dropped
+	Reason       string   // why the tail was dropped
+	LastId       uint64   // startId of the last valid record
+	ResetEndId   bool     // whether the endId of the last valid record was reset
+	DroppedFiles []string // data files quarantined because no complete record left in them
+}
+
+func (this *RecoveryReport) String() string {
+	return fmt.Sprintf("recovered %s: kept %d bytes (last startId %d), dropped %d bytes (%s), reset endId:%v, dropped files:%v",
+		this.File, this.ValidSize, this.LastId, this.DroppedBytes, this.Reason, this.ResetEndId, this.DroppedFiles)
+}
+
+/*
+	find the last complete and valid record of the latest data file and drop everything after it
+	@param files: all data files of the store
+	@return []string: data files left
+ */
+func (this *diskIo) recoverLatestFile(files []string) ([]string, error) {
+	sorted := make([]string, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		startIdi, _ := this.getStartIdByFileName(sorted[i])
+		startIdj, _ := this.getStartIdByFileName(sorted[j])
+		return startIdi < startIdj
+	})
+
+	report := &RecoveryReport{}
+	for len(sorted) > 0 {
+		fileName := sorted[len(sorted)-1]
+		kept, err := this.recoverFile(fileName, report)
+		if err != nil {
+			return nil, err
+		}
+		if kept {
+			break
+		}
+
+		// nothing left in it, the file before it becomes the latest one
+		sorted = sorted[:len(sorted)-1]
+		if this.opts.ReadOnly {
+			// the writer may be writing its first record
+			continue
+		}
+		this.log().warn("recover", "quarantine the data file without a complete record", LOG_KEY_FILE, fileName)
+		if err := this.quarantine(fileName); err != nil {
+			return nil, err
+		}
+		indexFileName := dataFileNameToIdxFileName(fileName)
+		if _, err := os.Stat(indexFileName); err == nil {
+			if err := this.quarantine(indexFileName); err != nil {
+				return nil, err
+			}
+		}
+		report.DroppedFiles = append(report.DroppedFiles, fileName)
+	}
+
+	// report is filled by recoverFile only if the file is changed
+	if report.File != "" || len(report.DroppedFiles) > 0 {
+		this.log().warn("recover", report.String(), LOG_KEY_FILE, report.File)
+		this.recovery = report
+	}
+
+	return sorted, nil
+}
+
+/*
+	truncate the data file after the last valid record, if what is after it is a torn append
+	@return bool: false if no valid record in the file
+ */
+func (this *diskIo) recoverFile(fileName string, report *RecoveryReport) (bool, error) {
+	buff, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		this.log().error("recover", "read data file failed", LOG_KEY_FILE, fileName, LOG_KEY_ERROR, err)
+		return false, err
+	}
+
+	// scan till the first broken record
+	format := this.formatOf(fileName)
+	validSize := uint64(0)
+	lastPos := uint64(0)
+	var lastElem *diskElem = nil
+	reason := ""
+	for validSize < uint64(len(buff)) {
+		// a header of 0 is parsed as a record without crc
+		if isZeroTail(buff, validSize) {
+			reason = "the tail is all 0"
+			break
+		}
+		elem, recordSize, err := format.parseRecord(buff, validSize, fileName, 0)
+		if err != nil {
+			// a torn append only breaks the last record, the valid ones after a broken record must not be dropped
+			if !format.runsToEnd(buff, validSize) {
+				this.log().error("recover", "broken record before the end of the data file", LOG_KEY_FILE, fileName,
+					"offset", validSize, LOG_KEY_ERROR, err)
+				return false, err
+			}
+			reason = err.Error()
+			break
+		}
+		if lastElem != nil && elem.startId <= lastElem.startId {
+			return false, &CorruptError{File: fileName, Offset: validSize,
+				Reason: fmt.Sprintf("startId %d is not larger than the one before %d", elem.startId, lastElem.startId)}
+		}
+
+		lastElem = elem
+		lastPos = validSize
+		validSize += recordSize
+	}
+
+	if lastElem == nil {
+		return false, nil
+	}
+
+	// a reader changes nothing, it reads till the last valid record, the rest may be an append going on
+	if this.opts.ReadOnly {
+		this.validSizes[fileName] = validSize
+		return true, nil
+	}
+
+	droppedBytes := uint64(len(buff)) - validSize
+	resetEndId := lastElem.endId != 0
+	if droppedBytes == 0 && !resetEndId {
+		// nothing to do, a stale index is rebuilt by loadIndex
+		return true, nil
+	}
+
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		this.log().error("recover", "open data file failed", LOG_KEY_FILE, fileName, LOG_KEY_ERROR, err)
+		return false, err
+	}
+	defer file.Close()
+
+	if droppedBytes > 0 {
+		this.log().warn("recover", "drop the broken bytes at the end", LOG_KEY_FILE, fileName, "offset", validSize,
+			"dropped_bytes", droppedBytes, "reason", reason)
+		if err := file.Truncate(int64(validSize)); err != nil {
+			return false, err
+		}
+	}
+
+	// it is the last record now
+	if resetEndId {
+		idBuff := make([]byte, ID_LEN)
+		if _, err := file.WriteAt(idBuff, int64(lastPos + DATA_ENDID_POS)); err != nil {
+			return false, err
+		}
+	}
+
+	// index will be rebuilt from the data file
+	os.Remove(dataFileNameToIdxFileName(fileName))
+
+	report.File = fileName
+	report.ValidSize = validSize
+	report.DroppedBytes = droppedBytes
+	report.Reason = reason
+	report.LastId = lastElem.startId
+	report.ResetEndId = resetEndId
+
+	return true, nil
+}
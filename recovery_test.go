@@ -0,0 +1,286 @@
+package conf
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	RECOVERY_DATA_PATH = "./recovery_data"
+	RECOVERY_DATA_HEADER = "recovery"
+)
+
+// the process died in the middle of append: endId of the last record is set, and the new record is partial
+func Test_recoverTornWrite(t *testing.T) {
+	removeAll(RECOVERY_DATA_PATH)
+	cm, err := GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	count := 20
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		return
+	}
+	lastId := uint64(START_ID + (count - 1) * ID_RANGE)
+	nextId := lastId + uint64(ID_RANGE)
+	dataFileName := cm.store.disk.latestFileName
+	lastPos := cm.store.disk.idxMgr.mapIndex[dataFileName].meta.lastRecordPos
+	dataFileSize := cm.store.disk.idxMgr.mapIndex[dataFileName].meta.dataFileSize
+	format := cm.store.disk.format
+	cm.Close()
+
+	file, err := os.OpenFile(dataFileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	idBuff := make([]byte, ID_LEN)
+	binary.BigEndian.PutUint64(idBuff, nextId - 1)
+	file.WriteAt(idBuff, int64(lastPos + DATA_ENDID_POS))
+	record := format.encode(nextId, 0, 0, []byte(getBuff(int(nextId))))
+	file.WriteAt(record[:DATA_HEAD_SIZE + 3], int64(dataFileSize))
+	file.Close()
+
+	cm, err = GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	report := cm.RecoveryReport()
+	if report == nil {
+		t.Error("torn write must be reported")
+		return
+	}
+	if report.ValidSize != dataFileSize || report.DroppedBytes != DATA_HEAD_SIZE + 3 || !report.ResetEndId || report.LastId != lastId {
+		t.Errorf("wrong report: %s\n", report.String())
+	}
+
+	last, err := cm.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != lastId {
+		t.Errorf("last config must be %d, but get %d\n", lastId, last.FromLogIndex)
+	}
+	if meta, err := cm.GetConfig(nextId + 5); err != nil || meta.FromLogIndex != lastId {
+		t.Errorf("the last record must cover the ids after it again, get %v, err:%v\n", meta, err)
+	}
+
+	// keep going
+	if err = pushConf(cm, int(nextId), ID_RANGE, 5); err != nil {
+		t.Error(err)
+		return
+	}
+	cm.Close()
+
+	cm, err = GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if cm.RecoveryReport() != nil {
+		t.Errorf("nothing to recover, but get %s\n", cm.RecoveryReport().String())
+	}
+	last, err = cm.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != nextId + uint64(4 * ID_RANGE) {
+		t.Errorf("last config must be %d, but get %d\n", nextId + uint64(4 * ID_RANGE), last.FromLogIndex)
+	}
+}
+
+// the process died right after a new data file was created
+// the power is lost after the data file is extended, but before the record reaches the disk
+func Test_recoverZeroTail(t *testing.T) {
+	removeAll(RECOVERY_DATA_PATH)
+	cm, err := GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	count := 20
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		return
+	}
+	lastId := uint64(START_ID + (count - 1) * ID_RANGE)
+	dataFileName := cm.store.disk.latestFileName
+	dataFileSize := cm.store.disk.idxMgr.mapIndex[dataFileName].meta.dataFileSize
+	cm.Close()
+
+	// longer than a record, so the header of 0 doesn't run to the end
+	zeroSize := 3 * DATA_BLOCK_SIZE
+	if err = os.Truncate(dataFileName, int64(dataFileSize + zeroSize)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cm, err = GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	report := cm.RecoveryReport()
+	if report == nil || report.ValidSize != dataFileSize || report.DroppedBytes != zeroSize || report.LastId != lastId {
+		t.Errorf("the tail of 0 must be dropped, but get %v\n", report)
+	}
+	if info, err := os.Stat(dataFileName); err != nil || uint64(info.Size()) != dataFileSize {
+		t.Errorf("the data file must be truncated to %d, err:%v\n", dataFileSize, err)
+	}
+	if last, err := cm.LastConfig(); err != nil || last.FromLogIndex != lastId {
+		t.Errorf("last config must be %d, but get %v, %v\n", lastId, last, err)
+	}
+}
+
+func Test_recoverEmptyLatestFile(t *testing.T) {
+	removeAll(RECOVERY_DATA_PATH)
+	cm, err := GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	count := 10
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		return
+	}
+	lastId := uint64(START_ID + (count - 1) * ID_RANGE)
+	nextId := lastId + uint64(ID_RANGE)
+	cm.Close()
+
+	// a partial record in a new data file
+	newFileName := cm.store.disk.getFileNameByStartId(nextId)
+	if err = os.WriteFile(newFileName, []byte("partial"), 0666); err != nil {
+		t.Error(err)
+		return
+	}
+
+	cm, err = GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	report := cm.RecoveryReport()
+	if report == nil || len(report.DroppedFiles) != 1 || filepath.Base(report.DroppedFiles[0]) != filepath.Base(newFileName) {
+		t.Errorf("the new data file must be dropped, report: %v\n", report)
+		return
+	}
+	if _, err := os.Stat(newFileName); !os.IsNotExist(err) {
+		t.Error("the new data file must be moved away")
+	}
+	if _, err := os.Stat(filepath.Join(RECOVERY_DATA_PATH, QUARANTINE_DIR, filepath.Base(newFileName))); err != nil {
+		t.Errorf("the new data file must be quarantined, err:%v\n", err)
+	}
+
+	if err = pushConf(cm, int(nextId), ID_RANGE, 1); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+// the process died without Close(), the index file is saved before the last appends
+func Test_recoverStaleIndex(t *testing.T) {
+	removeAll(RECOVERY_DATA_PATH)
+	cm, err := GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cm, START_ID, ID_RANGE, 5); err != nil {
+		t.Error(err)
+		return
+	}
+	cm.Close()
+
+	cm, err = GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = pushConf(cm, START_ID + 5 * ID_RANGE, ID_RANGE, 5); err != nil {
+		t.Error(err)
+		return
+	}
+	// no Close() here
+	crash(cm.store.disk)
+
+	cm, err = GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	last, err := cm.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != uint64(START_ID + 9 * ID_RANGE) {
+		t.Errorf("last config must be %d, but get %d\n", START_ID + 9 * ID_RANGE, last.FromLogIndex)
+	}
+}
+
+// a broken record before the end of the latest data file isn't a torn write, nothing is dropped
+func Test_recoverBrokenRecord(t *testing.T) {
+	for _, pos := range []string{"first", "middle"} {
+		removeAll(RECOVERY_DATA_PATH)
+		removeAll(filepath.Join(RECOVERY_DATA_PATH, QUARANTINE_DIR))
+		cm, err := GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = pushConf(cm, START_ID, ID_RANGE, 10); err != nil {
+			t.Error(err)
+			return
+		}
+		dataFileName := cm.store.disk.latestFileName
+		format := cm.store.disk.format
+		cm.Close()
+
+		// flip a byte of the buff of the first record or the 5th one
+		buff, err := os.ReadFile(dataFileName)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		brokenPos := uint64(0)
+		if pos == "middle" {
+			count := 0
+			format.scanRecords(buff, dataFileName, 0, func(elem *diskElem, recordPos uint64) bool {
+				brokenPos = recordPos
+				count++
+				return count < 5
+			})
+		}
+		buff[brokenPos + format.headSize] ^= 0xff
+		if err = os.WriteFile(dataFileName, buff, 0666); err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = GetConfManager(RECOVERY_DATA_PATH, RECOVERY_DATA_HEADER)
+		var corrupt *CorruptError
+		if !errors.As(err, &corrupt) || corrupt.File != dataFileName || corrupt.Offset != brokenPos {
+			t.Errorf("%s: expected CorruptError of %s at %d, but get %v\n", pos, dataFileName, brokenPos, err)
+		}
+		if after, err := os.ReadFile(dataFileName); err != nil || len(after) != len(buff) {
+			t.Errorf("%s: the data file must be kept as it is, err:%v\n", pos, err)
+		}
+	}
+}
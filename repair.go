@@ -0,0 +1,412 @@
+package conf
+
+/*
+	repair fixes what Verify finds, on a store not opened by anyone. the files are never deleted, the ones which can't
+	be used are moved to path/quarantine/ instead.
+
+	the plan is made from the files first, and then applied step by step:
+
+		replay-journal: finish the truncation committed by the journal, as opening the store does
+		quarantine:     move away a data file without a valid record in it, one out of order with the data files
+		                before it, and the index and temp files which belong to no data file
+		cut:            truncate a data file after its last good record, what is after a broken record is unknown
+		restitch:       rewrite the endId of a record, so that it covers till the next record, 0 for the last one
+		rebuild-index:  build the index of each data file left from its data, the one on disk is not trusted
+
+	with Options.ReadOnly, the plan is made and nothing is changed (dry run). otherwise the store is locked against
+	the writer and the readers while it is repaired, see lock.go.
+
+		plan, err := Repair(dir, header, opts)
+		fmt.Println(plan)
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	QUARANTINE_DIR = "quarantine" // under the path of the store
+)
+
+type RepairActionKind string
+
+const (
+	RepairReplayJournal RepairActionKind = "replay-journal"
+	RepairQuarantine    RepairActionKind = "quarantine"
+	RepairCut           RepairActionKind = "cut"
+	RepairRestitch      RepairActionKind = "restitch"
+	RepairRebuildIndex  RepairActionKind = "rebuild-index"
+)
+
+// a step of the repair
+type RepairAction struct {
+	Kind   RepairActionKind
+	File   string
+	Offset uint64 // cut: the size kept, restitch: position of the record
+	EndId  uint64 // restitch: the endId written
+	Reason string
+}
+
+func (this RepairAction) String() string {
+	switch this.Kind {
+	case RepairCut:
+		return fmt.Sprintf("%s %s at %d: %s", this.Kind, this.File, this.Offset, this.Reason)
+	case RepairRestitch:
+		return fmt.Sprintf("%s %s at %d to endId %d: %s", this.Kind, this.File, this.Offset, this.EndId, this.Reason)
+	}
+	return fmt.Sprintf("%s %s: %s", this.Kind, this.File, this.Reason)
+}
+
+// the steps to repair a store, in the order they are applied
+type RepairPlan struct {
+	Dir     string
+	Header  string
+	Actions []RepairAction
+	Applied bool // false for a dry run
+
+	journal *truncateJournal // replayed by RepairReplayJournal
+}
+
+func (this *RepairPlan) String() string {
+	applied := "planned"
+	if this.Applied {
+		applied = "applied"
+	}
+	s := fmt.Sprintf("repair %s/%s: %d actions %s", this.Dir, this.Header, len(this.Actions), applied)
+	for _, action := range this.Actions {
+		s += "\n\t" + action.String()
+	}
+	return s
+}
+
+// a data file kept by the repair
+type repairSegment struct {
+	fileName string
+	startId  uint64 // in the filename
+	records  []verifyRecord
+}
+
+/*
+	repair the store in dir, which must not be opened by anyone. the layout is taken from the meta file of the store,
+	or opts if there is no meta file, and so is the sync policy. an error is returned if the store can't be repaired
+	at all, e.g. the meta file is broken, the plan is returned with the error if it fails in the middle.
+ */
+func Repair(dir, header string, opts Options) (*RepairPlan, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	disk, err := getToolDiskIO(dir, header, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// readers are kept away as well, they can't read the files being changed
+	if opts.ReadOnly {
+		disk.lockFile, err = lockFile(disk.getReadLockFileName(), false, disk.log())
+		if err != nil {
+			return nil, err
+		}
+		defer disk.unlock()
+	} else {
+		writerLock, err := lockFile(disk.getLockFileName(), true, disk.log())
+		if err != nil {
+			return nil, err
+		}
+		defer unlockFile(writerLock)
+		disk.lockFile, err = lockFile(disk.getReadLockFileName(), true, disk.log())
+		if err != nil {
+			return nil, err
+		}
+		defer disk.unlock()
+	}
+
+	if err := disk.loadLayout(); err != nil {
+		return nil, err
+	}
+
+	plan, err := disk.planRepair()
+	if err != nil || opts.ReadOnly {
+		return plan, err
+	}
+
+	return plan, disk.applyRepair(plan)
+}
+
+func (this *diskIo) planRepair() (*RepairPlan, error) {
+	plan := &RepairPlan{Dir: this.path, Header: this.header}
+	quarantines := make([]RepairAction, 0)
+	cuts := make([]RepairAction, 0)
+	restitches := make([]RepairAction, 0)
+	rebuilds := make([]RepairAction, 0)
+	quarantine := func(fileName string, reason string) {
+		quarantines = append(quarantines, RepairAction{Kind: RepairQuarantine, File: fileName, Reason: reason})
+	}
+
+	// the truncation committed is finished first, the data files are read as it is done
+	journalFileName := this.getJournalFileName()
+	buff, err := ioutil.ReadFile(journalFileName)
+	if err == nil {
+		plan.journal, err = decodeJournal(buff, journalFileName)
+		if err != nil {
+			quarantine(journalFileName, corruptReason(err))
+		} else {
+			plan.Actions = append(plan.Actions, RepairAction{Kind: RepairReplayJournal, File: journalFileName,
+				Reason: fmt.Sprintf("finish the truncation of op %d at %d", plan.journal.op, plan.journal.id)})
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// sort out the files of the store, sources tells where the content of a data file is now
+	names, err := filepath.Glob(filepath.Join(this.path, this.header+"_*"))
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]string)
+	indexFiles := make(map[string]bool)
+	tmpFiles := make([]string, 0)
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, TMP_FILE_SUFFIX):
+			tmpFiles = append(tmpFiles, name)
+		case strings.HasSuffix(name, ".data"):
+			if _, ok := this.parseDataFileName(name); !ok {
+				quarantine(name, "illegal data filename")
+				continue
+			}
+			sources[name] = name
+		case strings.HasSuffix(name, ".idx"):
+			indexFiles[name] = true
+		}
+	}
+	renamed := make(map[string]bool)
+	if plan.journal != nil {
+		for _, rename := range plan.journal.renames {
+			from := filepath.Join(this.path, rename.from)
+			to := filepath.Join(this.path, rename.to)
+			if _, err := os.Stat(from); err == nil {
+				sources[to] = from
+				renamed[from] = true
+			}
+			// the index is rebuilt by the replay
+			delete(indexFiles, dataFileNameToIdxFileName(to))
+		}
+		for _, name := range plan.journal.removes {
+			fileName := filepath.Join(this.path, name)
+			delete(sources, fileName)
+			delete(indexFiles, dataFileNameToIdxFileName(fileName))
+		}
+	}
+	otherTmpFiles, err := filepath.Glob(filepath.Join(this.path, this.header+".*"+TMP_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(tmpFiles, otherTmpFiles...) {
+		if !renamed[name] {
+			quarantine(name, "temp file left by a write not committed")
+		}
+	}
+
+	dataFiles := make([]string, 0, len(sources))
+	for name := range sources {
+		dataFiles = append(dataFiles, name)
+	}
+	sort.Slice(dataFiles, func(i, j int) bool {
+		startIdi, _ := this.parseDataFileName(dataFiles[i])
+		startIdj, _ := this.parseDataFileName(dataFiles[j])
+		return startIdi < startIdj
+	})
+
+	// the good records of each data file, a data file is kept if it has any and follows the ones kept before it
+	segments := make([]*repairSegment, 0)
+	for _, name := range dataFiles {
+		startId, _ := this.parseDataFileName(name)
+		segment := &repairSegment{fileName: name, startId: startId}
+		buff, err := ioutil.ReadFile(sources[name])
+		if err != nil {
+			return nil, err
+		}
+
+		validSize := uint64(0)
+		reason := ""
+		for validSize < uint64(len(buff)) {
+			elem, recordSize, err := this.formatOf(name).parseRecord(buff, validSize, name, 0)
+			if err != nil {
+				reason = corruptReason(err)
+				break
+			}
+			if len(segment.records) > 0 && elem.startId <= segment.records[len(segment.records)-1].startId {
+				reason = fmt.Sprintf("startId %d is not larger than the one before", elem.startId)
+				break
+			}
+			segment.records = append(segment.records, verifyRecord{startId: elem.startId, endId: elem.endId, pos: validSize})
+			validSize += recordSize
+		}
+
+		// a data file which can't be placed in the store is moved away with its index
+		indexFileName := dataFileNameToIdxFileName(name)
+		dropReason := ""
+		if len(segment.records) == 0 {
+			if reason == "" {
+				reason = "no record in the data file"
+			}
+			dropReason = "no valid record: " + reason
+		} else if first := segment.records[0].startId; first != startId {
+			dropReason = fmt.Sprintf("the first record starts from %d, not the one in the filename", first)
+		} else if len(segments) > 0 {
+			last := segments[len(segments)-1]
+			if lastId := last.records[len(last.records)-1].startId; first <= lastId {
+				dropReason = fmt.Sprintf("the first record starts from %d, not after %d of %s", first, lastId, filepath.Base(last.fileName))
+			}
+		}
+		if dropReason != "" {
+			quarantine(name, dropReason)
+			if indexFiles[indexFileName] {
+				quarantine(indexFileName, "index of a data file quarantined")
+				delete(indexFiles, indexFileName)
+			}
+			continue
+		}
+
+		if validSize < uint64(len(buff)) {
+			cuts = append(cuts, RepairAction{Kind: RepairCut, File: name, Offset: validSize,
+				Reason: fmt.Sprintf("drop %d bytes after the last good record: %s", uint64(len(buff)) - validSize, reason)})
+		}
+		delete(indexFiles, indexFileName)
+		segments = append(segments, segment)
+		rebuilds = append(rebuilds, RepairAction{Kind: RepairRebuildIndex, File: name, Reason: "built from the data file"})
+	}
+
+	// each record covers till the next one, in the data file and across them
+	for i, segment := range segments {
+		for j, record := range segment.records {
+			endId := uint64(0)
+			if j + 1 < len(segment.records) {
+				endId = segment.records[j+1].startId - 1
+			} else if i + 1 < len(segments) {
+				endId = segments[i+1].records[0].startId - 1
+			}
+			if record.endId != endId {
+				restitches = append(restitches, RepairAction{Kind: RepairRestitch, File: segment.fileName, Offset: record.pos,
+					EndId: endId, Reason: fmt.Sprintf("endId of the record from %d is %d", record.startId, record.endId)})
+			}
+		}
+	}
+
+	orphans := make([]string, 0, len(indexFiles))
+	for name := range indexFiles {
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		quarantine(name, "index file without its data file")
+	}
+
+	plan.Actions = append(plan.Actions, quarantines...)
+	plan.Actions = append(plan.Actions, cuts...)
+	plan.Actions = append(plan.Actions, restitches...)
+	plan.Actions = append(plan.Actions, rebuilds...)
+	return plan, nil
+}
+
+func (this *diskIo) applyRepair(plan *RepairPlan) error {
+	for _, action := range plan.Actions {
+		this.log().warn("repair", string(action.Kind), LOG_KEY_FILE, action.File, "offset", action.Offset, "reason", action.Reason)
+
+		var err error
+		switch action.Kind {
+		case RepairReplayJournal:
+			if err = this.applyJournal(plan.journal); err == nil {
+				err = this.removeJournal()
+			}
+		case RepairQuarantine:
+			err = this.quarantine(action.File)
+		case RepairCut:
+			err = this.repairFile(action.File, func(file *os.File) error {
+				return file.Truncate(int64(action.Offset))
+			})
+		case RepairRestitch:
+			err = this.repairFile(action.File, func(file *os.File) error {
+				idBuff := make([]byte, ID_LEN)
+				binary.BigEndian.PutUint64(idBuff, action.EndId)
+				_, err := file.WriteAt(idBuff, int64(action.Offset + DATA_ENDID_POS))
+				return err
+			})
+		case RepairRebuildIndex:
+			err = this.buildIndexByFile(action.File)
+			if indexInfo, ok := this.idxMgr.mapIndex[action.File]; ok {
+				if err == nil && this.needSync() {
+					err = indexInfo.filePtr.Sync()
+				}
+				indexInfo.filePtr.Close()
+				delete(this.idxMgr.mapIndex, action.File)
+			}
+		}
+		if err != nil {
+			this.log().error("repair", "repair failed", LOG_KEY_FILE, action.File, LOG_KEY_ERROR, err)
+			return err
+		}
+	}
+
+	if this.needSync() {
+		if err := syncDir(this.path); err != nil {
+			return err
+		}
+	}
+	plan.Applied = true
+
+	return nil
+}
+
+// change the file in place and flush it
+func (this *diskIo) repairFile(fileName string, fn func(file *os.File) error) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := fn(file); err != nil {
+		return err
+	}
+	if this.needSync() {
+		return file.Sync()
+	}
+
+	return nil
+}
+
+// move the file to the quarantine directory, a number is added to its name if there is one of the same name
+func (this *diskIo) quarantine(fileName string) error {
+	quarantineDir := filepath.Join(this.path, QUARANTINE_DIR)
+	if err := os.MkdirAll(quarantineDir, 0777); err != nil {
+		return err
+	}
+
+	target := filepath.Join(quarantineDir, filepath.Base(fileName))
+	for i := 1; ; i++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		target = filepath.Join(quarantineDir, filepath.Base(fileName) + "." + strconv.Itoa(i))
+	}
+
+	if err := os.Rename(fileName, target); err != nil {
+		return errors.New(fmt.Sprintf("quarantine %s failed:%s", fileName, err.Error()))
+	}
+	if this.needSync() {
+		return syncDir(quarantineDir)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package conf
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the damages of Test_verifyProblems made at once, so that every kind of action is planned
+func damageForRepair(t *testing.T) []string {
+	cm, err := getVerifyStore(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Close()
+	os.RemoveAll(filepath.Join(VERIFY_DATA_PATH, QUARANTINE_DIR))
+	files := verifyDataFiles(t)
+
+	// a broken record in the middle of files[2], it is cut there
+	buff, _ := ioutil.ReadFile(dataFileNameToIdxFileName(files[2]))
+	info, err := decodeIndex(buff, files[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, files[2], []byte{0xff}, info.meta.lastRecordPos + DATA_HEAD_SIZE)
+
+	// endId of the last record of files[0] doesn't link to files[1]
+	buff, _ = ioutil.ReadFile(dataFileNameToIdxFileName(files[0]))
+	info, err = decodeIndex(buff, files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	idBuff := make([]byte, ID_LEN)
+	binary.BigEndian.PutUint64(idBuff, uint64(START_ID * 1000))
+	writeAt(t, files[0], idBuff, info.meta.lastRecordPos + DATA_ENDID_POS)
+
+	// no index for files[1], an index and a temp file without data file, and a data file without a valid record
+	os.Remove(dataFileNameToIdxFileName(files[1]))
+	ioutil.WriteFile(filepath.Join(VERIFY_DATA_PATH, VERIFY_DATA_HEADER + "_0000000001.idx"), make([]byte, IDX_HEADER_SIZE), 0666)
+	ioutil.WriteFile(files[1] + TMP_FILE_SUFFIX, nil, 0666)
+	ioutil.WriteFile(filepath.Join(VERIFY_DATA_PATH, VERIFY_DATA_HEADER + "_9999999999.data"), make([]byte, DATA_BLOCK_SIZE), 0666)
+
+	return files
+}
+
+func repairOptions(dryRun bool) Options {
+	opts := DefaultOptions()
+	opts.SyncPolicy = SyncNever
+	opts.ReadOnly = dryRun
+	return opts
+}
+
+func Test_repair(t *testing.T) {
+	files := damageForRepair(t)
+	count := func(plan *RepairPlan, kind RepairActionKind) int {
+		n := 0
+		for _, action := range plan.Actions {
+			if action.Kind == kind {
+				n++
+			}
+		}
+		return n
+	}
+
+	// dry run changes nothing
+	plan, err := Repair(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, repairOptions(true))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if plan.Applied || count(plan, RepairCut) != 1 || count(plan, RepairRestitch) < 2 || count(plan, RepairQuarantine) != 3 ||
+		count(plan, RepairRebuildIndex) != len(files) {
+		t.Errorf("unexpected plan: %s\n", plan.String())
+	}
+	if _, err := os.Stat(filepath.Join(VERIFY_DATA_PATH, QUARANTINE_DIR)); !os.IsNotExist(err) {
+		t.Error("dry run must change nothing")
+	}
+	if report, err := VerifyDir(VERIFY_DATA_PATH, VERIFY_DATA_HEADER); err != nil || report.OK() {
+		t.Errorf("the store must be broken still, but get %v, %v\n", report, err)
+	}
+
+	// the same plan is applied
+	applied, err := Repair(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, repairOptions(false))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !applied.Applied || len(applied.Actions) != len(plan.Actions) {
+		t.Errorf("expected the plan applied, but get %s\n", applied.String())
+	}
+	if report, err := VerifyDir(VERIFY_DATA_PATH, VERIFY_DATA_HEADER); err != nil || !report.OK() {
+		t.Errorf("the store must be repaired, but get %v, %v\n", report, err)
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(VERIFY_DATA_PATH, QUARANTINE_DIR, "*"))
+	if len(quarantined) != 3 {
+		t.Errorf("expected 3 files quarantined, but get %v\n", quarantined)
+	}
+
+	// nothing left to do, and the store can be opened
+	if plan, err = Repair(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, repairOptions(false)); err != nil || len(plan.Actions) != len(files) {
+		t.Errorf("expected the indexes rebuilt only, but get %v, %v\n", plan, err)
+	}
+	cm, err := GetConfManager(VERIFY_DATA_PATH, VERIFY_DATA_HEADER)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	metas, err := cm.ListAfter(0)
+	if err != nil || len(metas) == 0 || metas[len(metas)-1].ToLogIndex != UINT64_MAX {
+		t.Errorf("the configs must be read, but get %d, %v\n", len(metas), err)
+		return
+	}
+	for i := 1; i < len(metas); i++ {
+		if metas[i].FromLogIndex != metas[i-1].ToLogIndex + 1 {
+			t.Errorf("config %d from %d doesn't follow the one before till %d\n", i, metas[i].FromLogIndex, metas[i-1].ToLogIndex)
+			return
+		}
+	}
+
+	// an opened store can't be repaired
+	if _, err = Repair(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, repairOptions(false)); lockSupported && !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked, but get %v\n", err)
+	}
+}
+
+// a committed truncation is finished, the temp files it renames are not quarantined
+func Test_repairJournal(t *testing.T) {
+	cm, err := getVerifyStore(200)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cm.Close()
+	os.RemoveAll(filepath.Join(VERIFY_DATA_PATH, QUARANTINE_DIR))
+	files := verifyDataFiles(t)
+
+	// files[0] is removed, and files[1] is replaced by its copy
+	disk, err := getToolDiskIO(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, &Options{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buff, _ := ioutil.ReadFile(files[1])
+	ioutil.WriteFile(files[1] + TMP_FILE_SUFFIX, buff, 0666)
+	journal := &truncateJournal{
+		op: JOURNAL_OP_BEFORE,
+		renames: []journalRename{{from: filepath.Base(files[1] + TMP_FILE_SUFFIX), to: filepath.Base(files[1])}},
+		removes: []string{filepath.Base(files[0])},
+	}
+	if err = ioutil.WriteFile(disk.getJournalFileName(), journal.encode(), 0666); err != nil {
+		t.Error(err)
+		return
+	}
+
+	plan, err := Repair(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, repairOptions(false))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(plan.Actions) == 0 || plan.Actions[0].Kind != RepairReplayJournal {
+		t.Errorf("expected the journal replayed first, but get %s\n", plan.String())
+	}
+	if _, err := os.Stat(filepath.Join(VERIFY_DATA_PATH, QUARANTINE_DIR)); !os.IsNotExist(err) {
+		t.Errorf("nothing must be quarantined, but get %s\n", plan.String())
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("%s must be removed by the journal\n", files[0])
+	}
+	if report, err := VerifyDir(VERIFY_DATA_PATH, VERIFY_DATA_HEADER); err != nil || !report.OK() {
+		t.Errorf("the store must be repaired, but get %v, %v\n", report, err)
+	}
+}
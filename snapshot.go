@@ -0,0 +1,494 @@
+package conf
+
+/*
+	snapshot carries the config history of a store to another one, e.g. when raft installs a snapshot on a follower
+	lagging behind, whose history is replaced wholesale.
+
+	WriteSnapshot writes the configs covering [0, upTo], RestoreSnapshot replaces all the configs of the store with the
+	ones of a snapshot. both of them stream the records, only one of them is kept in memory at a time. the new segments
+	are written to temp files as the snapshot is read, and replace the old ones by the journal (see journal.go) after
+	it is read and checked completely, so the store is either restored or left as it was, even after a crash.
+
+	snapshot content fmt:
+	[magic(8 byte)][version(8 byte)][codec_id(8 byte)][up_to(8 byte)][record_num(8 byte)][record]...[crc(4 byte)]
+	[record] = start_id(8 byte)term(8 byte)buff_len(8 byte)buff(buff_len byte)
+	crc is the crc32(castagnoli) of all above. buff is encoded by the codec of codec_id, and decoded and encoded again
+	if the store restored uses another one.
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	SNAPSHOT_MAGIC  uint64   = 0x434f4e46534e4150 // "CONFSNAP"
+	SNAPSHOT_VERSION  uint64 = 1
+	SNAPSHOT_HEAD_SIZE uint64 = 5 * NUM_LEN
+	SNAPSHOT_RECORD_HEAD_SIZE uint64 = 3 * NUM_LEN
+)
+
+// writes a snapshot record by record, the crc is written by close
+type snapshotWriter struct {
+	w         *bufio.Writer
+	crc       hash.Hash32
+	recordNum uint64 // told by the head
+	written   uint64
+}
+
+func newSnapshotWriter(w io.Writer, codecId uint64, upTo uint64, recordNum uint64) (*snapshotWriter, error) {
+	this := &snapshotWriter{
+		w: bufio.NewWriter(w),
+		crc: crc32.New(CRC_TABLE),
+		recordNum: recordNum,
+	}
+
+	head := make([]byte, 0, SNAPSHOT_HEAD_SIZE)
+	head = appendUint64(head, SNAPSHOT_MAGIC)
+	head = appendUint64(head, SNAPSHOT_VERSION)
+	head = appendUint64(head, codecId)
+	head = appendUint64(head, upTo)
+	head = appendUint64(head, recordNum)
+	if err := this.write(head); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *snapshotWriter) write(buff []byte) error {
+	this.crc.Write(buff)
+	_, err := this.w.Write(buff)
+	return err
+}
+
+func (this *snapshotWriter) writeRecord(elem *myElem) error {
+	head := make([]byte, 0, SNAPSHOT_RECORD_HEAD_SIZE)
+	head = appendUint64(head, elem.startId)
+	head = appendUint64(head, elem.term)
+	head = appendUint64(head, uint64(len(elem.data)))
+	if err := this.write(head); err != nil {
+		return err
+	}
+	if err := this.write(elem.data); err != nil {
+		return err
+	}
+
+	this.written++
+	return nil
+}
+
+// write the crc and flush
+func (this *snapshotWriter) close() error {
+	if this.written != this.recordNum {
+		return errors.New(fmt.Sprintf("snapshot of %d records is told to have %d", this.written, this.recordNum))
+	}
+
+	crc := make([]byte, CRC_LEN)
+	binary.BigEndian.PutUint32(crc, this.crc.Sum32())
+	if _, err := this.w.Write(crc); err != nil {
+		return err
+	}
+	return this.w.Flush()
+}
+
+// reads a snapshot record by record, the crc is checked after the last one
+type snapshotReader struct {
+	r          *bufio.Reader
+	crc        hash.Hash32
+	offset     uint64 // of what is read next
+	maxBuffLen uint64 // a record larger than this can't be restored
+	codecId    uint64
+	upTo       uint64
+	recordNum  uint64
+	read       uint64
+	lastId     uint64
+}
+
+func snapshotCorrupt(offset uint64, reason string) error {
+	return &CorruptError{File: "snapshot", Offset: offset, Reason: "illegal snapshot: " + reason}
+}
+
+// read the head of the snapshot
+func newSnapshotReader(r io.Reader, maxBuffLen uint64) (*snapshotReader, error) {
+	this := &snapshotReader{
+		r: bufio.NewReader(r),
+		crc: crc32.New(CRC_TABLE),
+		maxBuffLen: maxBuffLen,
+	}
+
+	head := make([]byte, SNAPSHOT_HEAD_SIZE)
+	if err := this.readFull(head, "incomplete head"); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(head[0 : NUM_LEN]) != SNAPSHOT_MAGIC {
+		return nil, snapshotCorrupt(0, "bad magic")
+	}
+	if version := binary.BigEndian.Uint64(head[NUM_LEN : 2*NUM_LEN]); version != SNAPSHOT_VERSION {
+		return nil, snapshotCorrupt(NUM_LEN, fmt.Sprintf("unsupported version %d", version))
+	}
+	this.codecId = binary.BigEndian.Uint64(head[2*NUM_LEN : 3*NUM_LEN])
+	this.upTo = binary.BigEndian.Uint64(head[3*NUM_LEN : 4*NUM_LEN])
+	this.recordNum = binary.BigEndian.Uint64(head[4*NUM_LEN : 5*NUM_LEN])
+
+	return this, nil
+}
+
+// fill buff from the snapshot, a snapshot ending before is broken
+func (this *snapshotReader) readFull(buff []byte, reason string) error {
+	n, err := io.ReadFull(this.r, buff)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return snapshotCorrupt(this.offset + uint64(n), reason)
+		}
+		return fmt.Errorf("read snapshot at offset %d: %w", this.offset + uint64(n), err)
+	}
+
+	this.crc.Write(buff)
+	this.offset += uint64(len(buff))
+	return nil
+}
+
+/*
+	the next record of the snapshot, endId is not set
+	@return *diskElem: nil after the last one, the crc is checked and nothing must be left then
+ */
+func (this *snapshotReader) next() (*diskElem, error) {
+	if this.read == this.recordNum {
+		return nil, this.checkEnd()
+	}
+
+	pos := this.offset
+	head := make([]byte, SNAPSHOT_RECORD_HEAD_SIZE)
+	if err := this.readFull(head, fmt.Sprintf("incomplete record %d of %d", this.read, this.recordNum)); err != nil {
+		return nil, err
+	}
+	elem := &diskElem{
+		startId: binary.BigEndian.Uint64(head[0 : NUM_LEN]),
+		term: binary.BigEndian.Uint64(head[NUM_LEN : 2*NUM_LEN]),
+	}
+	elemBuffLen := binary.BigEndian.Uint64(head[2*NUM_LEN : 3*NUM_LEN])
+	if this.read > 0 && elem.startId <= this.lastId {
+		return nil, snapshotCorrupt(pos, fmt.Sprintf("start_id %d of record %d is out of order", elem.startId, this.read))
+	}
+	if elem.startId > this.upTo {
+		return nil, snapshotCorrupt(pos, fmt.Sprintf("start_id %d of record %d is after %d", elem.startId, this.read, this.upTo))
+	}
+	// checked before it is allocated, buff_len is not trusted
+	if elemBuffLen > this.maxBuffLen {
+		return nil, &TooLargeError{
+			What: fmt.Sprintf("record %d of the snapshot of %d bytes", elem.startId, elemBuffLen),
+			Limit: this.maxBuffLen,
+		}
+	}
+
+	elem.buff = make([]byte, elemBuffLen)
+	if err := this.readFull(elem.buff, fmt.Sprintf("buff_len %d of record %d exceeds the end", elemBuffLen, this.read)); err != nil {
+		return nil, err
+	}
+
+	this.read++
+	this.lastId = elem.startId
+	return elem, nil
+}
+
+func (this *snapshotReader) checkEnd() error {
+	crc := make([]byte, CRC_LEN)
+	n, err := io.ReadFull(this.r, crc)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return snapshotCorrupt(this.offset + uint64(n), "incomplete crc")
+		}
+		return fmt.Errorf("read snapshot at offset %d: %w", this.offset + uint64(n), err)
+	}
+	if binary.BigEndian.Uint32(crc) != this.crc.Sum32() {
+		return snapshotCorrupt(this.offset, "checksum mismatch")
+	}
+
+	if _, err = this.r.ReadByte(); err != io.EOF {
+		if err != nil {
+			return fmt.Errorf("read snapshot at offset %d: %w", this.offset + CRC_LEN, err)
+		}
+		return snapshotCorrupt(this.offset + CRC_LEN, fmt.Sprintf("bytes left after %d records", this.recordNum))
+	}
+
+	return nil
+}
+
+/*
+	write the configs covering the log indexes in [0, upTo] to w, use UINT64_MAX as upTo for all of them.
+	the writes to the store wait till it is done.
+ */
+func (this *ConfManager) WriteSnapshot(w io.Writer, upTo uint64) error {
+	return this.store.writeSnapshot(w, upTo)
+}
+
+/*
+	replace all the configs of the store with the ones written by WriteSnapshot, the last one of the snapshot becomes
+	the last config. r is read to the end and checked before the store is changed, ErrCorrupt is returned for a
+	malformed snapshot and ErrTooLarge for a record which can't be put in a data file, and the store is kept as it
+	was. the writes to the store wait till it is done.
+ */
+func (this *ConfManager) RestoreSnapshot(r io.Reader) error {
+	snap, err := newSnapshotReader(r, this.store.opts.DataMaxFileSize)
+	if err != nil {
+		return err
+	}
+
+	// the configs are kept by the codec of the store
+	var codec Codec = nil
+	if snap.codecId != this.codec.ID() {
+		if codec, err = getCodecById(snap.codecId, this.store.opts.Codec); err != nil {
+			return err
+		}
+	}
+
+	return this.store.restore(func() (*diskElem, error) {
+		elem, err := snap.next()
+		if elem == nil || err != nil {
+			return nil, err
+		}
+		if codec != nil {
+			conf, err := diskElemToConfig(codec, elem)
+			if err != nil {
+				return nil, err
+			}
+			if elem.buff, err = this.codec.Marshal(conf); err != nil {
+				return nil, err
+			}
+		}
+		return elem, nil
+	})
+}
+
+// the records covering [0, upTo] as WriteSnapshot writes them, with the read lock held all the time
+func (this *RangeStore) writeSnapshot(w io.Writer, upTo uint64) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return ErrClosed
+	}
+
+	// the number of records is written before them, they are counted first, and read again as the store is locked
+	recordNum := uint64(0)
+	err := this.scanLocked(this.Iterator(0, upTo), func(elem *myElem) error {
+		recordNum++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sw, err := newSnapshotWriter(w, this.disk.codec.ID(), upTo, recordNum)
+	if err != nil {
+		return err
+	}
+	if err = this.scanLocked(this.Iterator(0, upTo), sw.writeRecord); err != nil {
+		return err
+	}
+	return sw.close()
+}
+
+// replace all the records by the ones given by next, the store is kept as it was if next fails
+func (this *RangeStore) restore(next func() (*diskElem, error)) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return ErrClosed
+	}
+
+	return this.restoreLocked(next)
+}
+
+// load the records given by next to the store, which must be empty, nothing is loaded if next fails
+func (this *RangeStore) load(next func() (*diskElem, error)) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return ErrClosed
+	}
+	if _, err := this.lastElem(); err == nil {
+		return errors.New(fmt.Sprintf("store %s is not empty, records are only loaded to an empty store", this.dir))
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	return this.restoreLocked(next)
+}
+
+// called with the write lock held
+func (this *RangeStore) restoreLocked(next func() (*diskElem, error)) error {
+	if err := this.checkStale(); err != nil {
+		return err
+	}
+	// the batch pushed before is flushed or rolled back first
+	if err := this.syncer.settleLocked(); err != nil {
+		return err
+	}
+
+	var last *diskElem = nil
+	committed, err := this.disk.restore(func() (*diskElem, error) {
+		elem, err := next()
+		if elem != nil {
+			last = elem
+		}
+		return elem, err
+	})
+	if err != nil {
+		if !committed {
+			return err
+		}
+		this.log().error("restore", "restore failed, reload the disk", LOG_KEY_ERROR, err)
+		// the journal is written, it is finished by reloading
+		if err = this.reload(); err != nil {
+			return err
+		}
+	} else if err = this.rebuildMem(); err != nil {
+		this.log().error("restore", "rebuild memory failed, read from disk till the next write", LOG_KEY_ERROR, err)
+	}
+
+	if this.observer != nil {
+		var lastElem *myElem = nil
+		if last != nil {
+			lastElem = &myElem{startId: last.startId, endId: UINT64_MAX, term: last.term, data: last.buff}
+		}
+		this.observer.restored(lastElem)
+	}
+
+	return nil
+}
+
+/*
+	replace all the segments by the records given by next one by one till it returns nil, their endIds are set here.
+	nothing is changed if next returns an error.
+	@return bool: the journal is written, the store is restored after reloading even if an error is returned
+ */
+func (this *diskIo) restore(next func() (*diskElem, error)) (bool, error) {
+	if this.opts.ReadOnly {
+		return false, ErrReadOnly
+	}
+
+	journal := &truncateJournal{op: JOURNAL_OP_RESTORE}
+	dropTmpFiles := func() {
+		for _, rename := range journal.renames {
+			os.Remove(filepath.Join(this.path, rename.from))
+		}
+	}
+
+	// write the new segments to temp files, split as they are appended
+	var file *os.File
+	var fileSize uint64
+	closeFile := func() error {
+		if file == nil {
+			return nil
+		}
+		var err error
+		if this.needSync() {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		file = nil
+		return err
+	}
+	elem, err := next()
+	var lastId uint64 = 0
+	for elem != nil && err == nil {
+		// the endId is told by the one after it
+		var following *diskElem
+		if following, err = next(); err != nil {
+			break
+		}
+
+		elem.endId = 0
+		if following != nil {
+			elem.endId = following.startId - 1
+		}
+
+		record := this.format.encode(elem.startId, elem.endId, elem.term, elem.buff)
+		recordSize := uint64(len(record))
+		if recordSize > this.opts.DataMaxFileSize {
+			err = &TooLargeError{
+				What: fmt.Sprintf("record %d of %d bytes", elem.startId, recordSize),
+				Limit: this.opts.DataMaxFileSize,
+			}
+			break
+		}
+
+		if file == nil || fileSize + recordSize > this.opts.DataMaxFileSize {
+			if err = closeFile(); err != nil {
+				break
+			}
+			fileName := this.getFileNameByStartId(elem.startId)
+			if file, err = os.Create(fileName + TMP_FILE_SUFFIX); err != nil {
+				break
+			}
+			fileSize = 0
+			journal.id = elem.startId
+			journal.renames = append(journal.renames, journalRename{
+				from: filepath.Base(fileName + TMP_FILE_SUFFIX),
+				to: filepath.Base(fileName),
+			})
+		}
+
+		if _, err = file.Write(record); err != nil {
+			break
+		}
+		fileSize += recordSize
+		lastId = elem.startId
+		elem = following
+	}
+	if err != nil {
+		closeFile()
+		dropTmpFiles()
+		return false, err
+	}
+	if err := closeFile(); err != nil {
+		dropTmpFiles()
+		return false, err
+	}
+
+	// the old segments not overwritten by the new ones are removed
+	targets := make(map[string]bool)
+	for _, rename := range journal.renames {
+		targets[rename.to] = true
+	}
+	for fileName := range this.idxMgr.mapIndex {
+		if !targets[filepath.Base(fileName)] {
+			journal.removes = append(journal.removes, filepath.Base(fileName))
+		}
+	}
+
+	if err := this.opts.injectFault(FAULT_RESTORE_COMMIT); err != nil {
+		dropTmpFiles()
+		return false, err
+	}
+	if err := this.writeJournal(journal); err != nil {
+		dropTmpFiles()
+		return false, err
+	}
+
+	// the journal is applied as after a crash, and the store is loaded again
+	if err := this.opts.injectFault(FAULT_RESTORE_APPLY); err != nil {
+		return true, err
+	}
+	if err := this.reload(); err != nil {
+		return true, err
+	}
+	if len(journal.renames) > 0 && !this.isPushed(lastId) {
+		return true, errors.New(fmt.Sprintf("restore %s failed, the last record isn't %d", this.path, lastId))
+	}
+
+	return true, nil
+}
@@ -0,0 +1,236 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	. "rafted/persist"
+)
+
+var (
+	SNAPSHOT_DATA_PATH = "./snapshot_data"
+	SNAPSHOT_SOURCE_HEADER = "source"
+	SNAPSHOT_TARGET_HEADER = "target"
+)
+
+func getSnapshotStore(header string, codec Codec) (*ConfManager, error) {
+	opts := getTestOptions(func(opts *Options) {
+		opts.Codec = codec
+	})
+	return GetConfManagerWithOptions(filepath.Join(SNAPSHOT_DATA_PATH, header), header, opts)
+}
+
+// a snapshot of configs [0, count) of the source store, pushed with terms, and a target store of other configs
+func getSnapshotStores(count int) (*bytes.Buffer, *ConfManager, error) {
+	removeAll(filepath.Join(SNAPSHOT_DATA_PATH, SNAPSHOT_SOURCE_HEADER))
+	removeAll(filepath.Join(SNAPSHOT_DATA_PATH, SNAPSHOT_TARGET_HEADER))
+	source, err := getSnapshotStore(SNAPSHOT_SOURCE_HEADER, JSONCodec)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer source.Close()
+	if err = pushConfWithTerm(source, 100); err != nil {
+		return nil, nil, err
+	}
+	snap := &bytes.Buffer{}
+	if err = source.WriteSnapshot(snap, uint64(START_ID + (count - 1) * ID_RANGE + 5)); err != nil {
+		return nil, nil, err
+	}
+
+	target, err := getSnapshotStore(SNAPSHOT_TARGET_HEADER, MsgpackCodec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = pushConf(target, START_ID + 1000 * ID_RANGE, ID_RANGE, 50); err != nil {
+		target.Close()
+		return nil, nil, err
+	}
+
+	return snap, target, nil
+}
+
+// the target store has configs [0, count) of the source store only
+func checkRestored(t *testing.T, cm *ConfManager, count int, step string) {
+	metas, err := cm.ListAfter(0)
+	if err != nil || len(metas) != count {
+		t.Errorf("%s: expected %d configs, but get %d, %v\n", step, count, len(metas), err)
+		return
+	}
+	for i, meta := range metas {
+		id := START_ID + i * ID_RANGE
+		if meta.FromLogIndex != uint64(id) || !MultiAddrSliceEqual(meta.Conf.Servers, getConf(id).Servers) {
+			t.Errorf("%s: config %d must be from %d, but get %d\n", step, i, id, meta.FromLogIndex)
+			return
+		}
+		if term, err := cm.GetConfigTerm(uint64(id)); err != nil || term != uint64(i / 10 + 1) {
+			t.Errorf("%s: config %d must be of term %d, but get %d, %v\n", step, i, i / 10 + 1, term, err)
+			return
+		}
+	}
+	if metas[count-1].ToLogIndex != UINT64_MAX {
+		t.Errorf("%s: the last config must cover all after it, but get %d\n", step, metas[count-1].ToLogIndex)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(SNAPSHOT_DATA_PATH, SNAPSHOT_TARGET_HEADER, "*" + TMP_FILE_SUFFIX))
+	if len(files) > 0 {
+		t.Errorf("%s: temp files are left: %v\n", step, files)
+	}
+}
+
+func Test_snapshotRestore(t *testing.T) {
+	count := 61
+	snap, cm, err := getSnapshotStores(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	events := cm.Watch(context.Background())
+	if err = cm.RestoreSnapshot(snap); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+	select {
+	case e := <-events:
+		if restored, ok := e.(Restored); !ok || restored.Last == nil || restored.Last.FromLogIndex != uint64(START_ID + (count - 1) * ID_RANGE) {
+			t.Errorf("expected Restored, but get %v\n", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("no event for the restore")
+	}
+	checkRestored(t, cm, count, "restored")
+
+	// writes go on
+	id := START_ID + count * ID_RANGE
+	if err = cm.PushConfigWithTerm(uint64(id), 100, getConf(id)); err != nil {
+		t.Error(err)
+	}
+	cm.Close()
+
+	cm, err = getSnapshotStore(SNAPSHOT_TARGET_HEADER, MsgpackCodec)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if cm.codec.ID() != MsgpackCodec.ID() {
+		t.Errorf("the store must keep its codec, but get %s\n", cm.codec.Name())
+	}
+	if err = cm.TruncateAfter(uint64(id - 1)); err != nil {
+		t.Error(err)
+		return
+	}
+	checkRestored(t, cm, count, "reopened")
+
+	// an empty snapshot empties the store
+	empty := &bytes.Buffer{}
+	if err = cm.WriteSnapshot(empty, uint64(START_ID - 1)); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = cm.RestoreSnapshot(empty); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = cm.LastConfig(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("the store must be empty, but get %v\n", err)
+	}
+}
+
+// the store is kept as it was if the snapshot is malformed
+func Test_snapshotMalformed(t *testing.T) {
+	count := 61
+	snap, cm, err := getSnapshotStores(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	buff := snap.Bytes()
+
+	flipped := append([]byte(nil), buff...)
+	flipped[len(flipped) / 2] ^= 0x01
+	cases := map[string][]byte{
+		"empty": {},
+		"truncated": buff[0 : len(buff) - 100],
+		"flipped": flipped,
+		"trailing": append(append([]byte(nil), buff...), 0),
+	}
+	for name, c := range cases {
+		if err = cm.RestoreSnapshot(bytes.NewReader(c)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected ErrCorrupt, but get %v\n", name, err)
+		}
+		metas, err := cm.ListAfter(0)
+		if err != nil || len(metas) != 50 || metas[0].FromLogIndex != uint64(START_ID + 1000 * ID_RANGE) {
+			t.Errorf("%s: the store must be kept, but get %d configs, %v\n", name, len(metas), err)
+		}
+		files, _ := filepath.Glob(filepath.Join(SNAPSHOT_DATA_PATH, SNAPSHOT_TARGET_HEADER, "*" + TMP_FILE_SUFFIX))
+		if len(files) > 0 {
+			t.Errorf("%s: temp files are left: %v\n", name, files)
+		}
+	}
+}
+
+// buff_len of a record is checked before the buff is allocated
+func Test_snapshotTooLarge(t *testing.T) {
+	snap, cm, err := getSnapshotStores(61)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	buff := snap.Bytes()
+
+	// buff_len of the second record
+	pos := SNAPSHOT_HEAD_SIZE
+	pos += SNAPSHOT_RECORD_HEAD_SIZE + binary.BigEndian.Uint64(buff[pos+2*NUM_LEN : pos+3*NUM_LEN])
+	binary.BigEndian.PutUint64(buff[pos+2*NUM_LEN : pos+3*NUM_LEN], 1 << 62)
+
+	err = cm.RestoreSnapshot(bytes.NewReader(buff))
+	var tooLarge *TooLargeError
+	if !errors.Is(err, ErrTooLarge) || !errors.As(err, &tooLarge) || tooLarge.Limit != cm.store.opts.DataMaxFileSize {
+		t.Errorf("expected a TooLargeError of DataMaxFileSize, but get %v\n", err)
+	}
+	metas, err := cm.ListAfter(0)
+	if err != nil || len(metas) != 50 || metas[0].FromLogIndex != uint64(START_ID + 1000 * ID_RANGE) {
+		t.Errorf("the store must be kept, but get %d configs, %v\n", len(metas), err)
+	}
+}
+
+// a restore failed before the journal is written is rolled back, and finished after it
+func Test_snapshotFaults(t *testing.T) {
+	count := 61
+	snap, cm, err := getSnapshotStores(count)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	buff := snap.Bytes()
+
+	failOnce(cm, FAULT_RESTORE_COMMIT)
+	if err = cm.RestoreSnapshot(bytes.NewReader(buff)); err == nil {
+		t.Error("restore must fail before the journal is written")
+	}
+	setFaultHook(cm, nil)
+	metas, err := cm.ListAfter(0)
+	if err != nil || len(metas) != 50 || metas[0].FromLogIndex != uint64(START_ID + 1000 * ID_RANGE) {
+		t.Errorf("the store must be kept, but get %d configs, %v\n", len(metas), err)
+	}
+	files, _ := filepath.Glob(filepath.Join(SNAPSHOT_DATA_PATH, SNAPSHOT_TARGET_HEADER, "*" + TMP_FILE_SUFFIX))
+	if len(files) > 0 {
+		t.Errorf("temp files are left: %v\n", files)
+	}
+
+	failOnce(cm, FAULT_RESTORE_APPLY)
+	if err = cm.RestoreSnapshot(bytes.NewReader(buff)); err != nil {
+		t.Error("restore must be finished after the journal is written:", err)
+	}
+	setFaultHook(cm, nil)
+	checkRestored(t, cm, count, "fault")
+}
@@ -0,0 +1,310 @@
+package conf
+
+/*
+	sync policy decides when the written data is flushed to disk (fsync), which is a trade-off between safety and speed.
+
+	SyncAlways:      data file and index file are flushed before PushConfig returns
+	SyncBatch:       same as SyncAlways, but concurrent pushers share one flush (group commit)
+	SyncInterval(d): flushed by a background goroutine every d, PushConfig doesn't wait for it
+	SyncNever:       left to the OS
+
+	whatever the policy is (except SyncNever), a data file is flushed before it is closed when it is full, and the
+	directory is flushed after data files are created or deleted.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type syncMode int
+
+const (
+	syncModeNever syncMode = iota
+	syncModeAlways
+	syncModeBatch
+	syncModeInterval
+)
+
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration // only for SyncInterval
+}
+
+var (
+	SyncNever  = SyncPolicy{mode: syncModeNever}
+	SyncAlways = SyncPolicy{mode: syncModeAlways}
+	SyncBatch  = SyncPolicy{mode: syncModeBatch}
+
+	SYNC_POLICY = SyncAlways // default of Options.SyncPolicy
+)
+
+// flush every d in the background
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncModeInterval, interval: d}
+}
+
+func (this SyncPolicy) String() string {
+	switch this.mode {
+	case syncModeNever:
+		return "SyncNever"
+	case syncModeAlways:
+		return "SyncAlways"
+	case syncModeBatch:
+		return "SyncBatch"
+	case syncModeInterval:
+		return fmt.Sprintf("SyncInterval(%s)", this.interval)
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", this.mode)
+}
+
+func (this SyncPolicy) validate() error {
+	if this.mode < syncModeNever || this.mode > syncModeInterval {
+		return errors.New(fmt.Sprintf("invalid options: unknown SyncPolicy %d", this.mode))
+	}
+	if this.mode == syncModeInterval && this.interval <= 0 {
+		return errors.New(fmt.Sprintf("invalid options: interval of SyncInterval must be positive, got %s", this.interval))
+	}
+	return nil
+}
+
+/*
+	syncer flushes the writes of a ConfManager by its policy.
+	writes are counted by seq, synced is the seq of the last write flushed. the writes of SyncBatch are pending till
+	they are flushed, the observer is told of them then. a batch which can't be flushed is rolled back.
+ */
+type syncer struct {
+	disk       *diskIo
+	policy     SyncPolicy
+	writeMutex *sync.RWMutex // mutex of the ConfManager, files must not be changed while flushing
+
+	pushed   func(elem *myElem)     // tells the observer of a write flushed
+	rollback func(logIndex uint64) // drops the writes from logIndex, called with the write mutex held
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	written uint64          // seq of the last write
+	synced  uint64          // seq of the last write flushed or rolled back
+	syncing bool            // someone is flushing for the batch
+	pending []*pendingWrite // writes of SyncBatch not flushed yet, in the order of seq
+
+	stop chan struct{} // for SyncInterval
+	done chan struct{}
+}
+
+// a write of SyncBatch waiting for the flush
+type pendingWrite struct {
+	seq  uint64
+	elem *myElem
+	err  error // set if it is rolled back
+}
+
+func newSyncer(disk *diskIo, writeMutex *sync.RWMutex, policy SyncPolicy) *syncer {
+	s := &syncer{
+		disk: disk,
+		policy: policy,
+		writeMutex: writeMutex,
+		pushed: func(elem *myElem) {},
+		rollback: func(logIndex uint64) {},
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	if policy.mode == syncModeInterval {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.loop()
+	}
+
+	return s
+}
+
+/*
+	called after each write of elem with the write mutex held
+	@return *pendingWrite: the write of SyncBatch, wait for it with wait(). nil for the other policies, the observer is
+	told by the caller then
+ */
+func (this *syncer) afterWrite(elem *myElem) (*pendingWrite, error) {
+	if this.policy.mode == syncModeAlways {
+		return nil, this.disk.sync()
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.written++
+	if this.policy.mode != syncModeBatch {
+		return nil, nil
+	}
+
+	w := &pendingWrite{seq: this.written, elem: elem}
+	this.pending = append(this.pending, w)
+	return w, nil
+}
+
+// the last write not flushed yet, waiting for it makes sure all the writes before are flushed. nil if none
+func (this *syncer) lastWrite() *pendingWrite {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if len(this.pending) == 0 {
+		return nil
+	}
+	return this.pending[len(this.pending)-1]
+}
+
+/*
+	wait till w is flushed, only SyncBatch waits. must be called without the write mutex held.
+	the first waiter flushes for all the writes done till then, the others wait for it.
+	@return error: w is rolled back as it can't be flushed
+ */
+func (this *syncer) wait(w *pendingWrite) error {
+	if w == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for this.synced < w.seq && w.err == nil {
+		if this.syncing {
+			this.cond.Wait()
+			continue
+		}
+
+		this.syncing = true
+		this.mutex.Unlock()
+		this.flush()
+		this.mutex.Lock()
+		this.syncing = false
+		this.cond.Broadcast()
+	}
+
+	return w.err
+}
+
+// flush the writes not flushed yet, the pending ones which can't be flushed are rolled back
+func (this *syncer) flush() error {
+	err := this.syncWritten()
+	if err == nil {
+		return nil
+	}
+
+	this.disk.log().error("sync", "sync the batch failed, retry with the write lock", LOG_KEY_ERROR, err)
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+	return this.settleLocked()
+}
+
+// flush the writes not flushed yet
+func (this *syncer) syncWritten() error {
+	// flushing doesn't change anything, readers can go on
+	this.writeMutex.RLock()
+	defer this.writeMutex.RUnlock()
+
+	this.mutex.Lock()
+	target := this.written
+	synced := this.synced
+	this.mutex.Unlock()
+	if target == synced {
+		return nil
+	}
+
+	if err := this.disk.sync(); err != nil {
+		return err
+	}
+
+	// close() may flush along with the one for a batch
+	this.mutex.Lock()
+	if target > this.synced {
+		this.synced = target
+	}
+	flushed := this.takePending(target)
+	this.mutex.Unlock()
+
+	for _, w := range flushed {
+		this.pushed(w.elem)
+	}
+	return nil
+}
+
+// remove the pending writes till seq, called with mutex held
+func (this *syncer) takePending(seq uint64) []*pendingWrite {
+	n := 0
+	for n < len(this.pending) && this.pending[n].seq <= seq {
+		n++
+	}
+	taken := this.pending[0 : n]
+	this.pending = this.pending[n : ]
+	return taken
+}
+
+/*
+	flush the pending writes before the files are changed by others, or roll them back if they can't be flushed.
+	called with the write mutex held, so nothing is written meanwhile.
+ */
+func (this *syncer) settleLocked() error {
+	this.mutex.Lock()
+	target := this.written
+	synced := this.synced
+	this.mutex.Unlock()
+	if target == synced {
+		return nil
+	}
+
+	err := this.disk.sync()
+
+	this.mutex.Lock()
+	// the batch is gone if it is rolled back
+	if err == nil || this.policy.mode == syncModeBatch {
+		this.synced = target
+	}
+	pending := this.takePending(target)
+	if err != nil {
+		for _, w := range pending {
+			w.err = err
+		}
+	}
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+
+	if err != nil {
+		if len(pending) > 0 {
+			this.disk.log().error("sync", "sync the batch failed, roll it back", LOG_KEY_INDEX, pending[0].elem.startId,
+				LOG_KEY_ERROR, err)
+			this.rollback(pending[0].elem.startId)
+		}
+		return err
+	}
+
+	for _, w := range pending {
+		this.pushed(w.elem)
+	}
+	return nil
+}
+
+func (this *syncer) loop() {
+	defer close(this.done)
+
+	ticker := time.NewTicker(this.policy.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			if err := this.syncWritten(); err != nil {
+				this.disk.log().error("sync", "sync in background failed", LOG_KEY_ERROR, err)
+			}
+		}
+	}
+}
+
+// stop the background flusher and flush what is left, must be called without the write mutex held
+func (this *syncer) close() error {
+	if this.policy.mode == syncModeInterval {
+		close(this.stop)
+		<-this.done
+	}
+
+	return this.flush()
+}
@@ -0,0 +1,199 @@
+package conf
+
+import (
+	"context"
+	"modules/msgpack"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	SYNC_DATA_PATH = "./sync_data"
+	SYNC_DATA_HEADER = "sync"
+)
+
+func Test_syncPolicyValidate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SyncPolicy = SyncInterval(0)
+	if err := opts.validate(); err == nil {
+		t.Error("SyncInterval(0) must be invalid")
+	}
+
+	for _, policy := range []SyncPolicy{SyncNever, SyncAlways, SyncBatch, SyncInterval(time.Millisecond)} {
+		opts.SyncPolicy = policy
+		if err := opts.validate(); err != nil {
+			t.Errorf("%s must be valid: %s\n", policy, err.Error())
+		}
+	}
+}
+
+// each policy keeps all configs pushed after reopen
+func Test_SyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncNever, SyncAlways, SyncBatch, SyncInterval(time.Millisecond)} {
+		removeAll(SYNC_DATA_PATH)
+		opts := DefaultOptions()
+		opts.SyncPolicy = policy
+		opts.DataMaxFileSize = 16 * 1024 // roll over to new data files
+		cm, err := GetConfManagerWithOptions(SYNC_DATA_PATH, SYNC_DATA_HEADER, opts)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		count := 100
+		if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+			t.Error(policy, err)
+			return
+		}
+		if err = cm.TruncateBefore(uint64(START_ID + 10 * ID_RANGE)); err != nil {
+			t.Error(policy, err)
+			return
+		}
+		if policy.mode == syncModeInterval {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cm.Close()
+
+		if cm.store.syncer.synced != cm.store.syncer.written {
+			t.Errorf("%s: %d writes, but only %d synced after close\n", policy, cm.store.syncer.written, cm.store.syncer.synced)
+		}
+
+		cm, err = GetConfManagerWithOptions(SYNC_DATA_PATH, SYNC_DATA_HEADER, opts)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		last, err := cm.LastConfig()
+		if err != nil {
+			t.Error(policy, err)
+			cm.Close()
+			return
+		}
+		if last.FromLogIndex != uint64(START_ID + (count - 1) * ID_RANGE) {
+			t.Errorf("%s: last config is %d\n", policy, last.FromLogIndex)
+		}
+		cm.Close()
+	}
+}
+
+// concurrent pushers share flushes with SyncBatch
+func Test_SyncBatchConcurrent(t *testing.T) {
+	removeAll(SYNC_DATA_PATH)
+	opts := DefaultOptions()
+	opts.SyncPolicy = SyncBatch
+	cm, err := GetConfManagerWithOptions(SYNC_DATA_PATH, SYNC_DATA_HEADER, opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	// ids must be pushed in order, so take the id and push under idMutex, and wait for the flush out of it as PushConfig does
+	var idMutex sync.Mutex
+	nextId := START_ID
+	pushers := 8
+	count := 50
+	errs := make(chan error, pushers * count)
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				idMutex.Lock()
+				id := nextId
+				nextId += ID_RANGE
+				buff, err := msgpack.Marshal(getConf(id))
+				if err != nil {
+					idMutex.Unlock()
+					errs <- err
+					return
+				}
+				w, err := cm.store.push(uint64(id), 0, buff)
+				idMutex.Unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if err := cm.store.syncer.wait(w); err != nil {
+					errs <- err
+					return
+				}
+				cm.store.syncer.mutex.Lock()
+				synced := cm.store.syncer.synced
+				cm.store.syncer.mutex.Unlock()
+				if synced < w.seq {
+					t.Errorf("push %d returned before it is synced\n", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+		return
+	}
+
+	if cm.store.syncer.written != uint64(pushers * count) || cm.store.syncer.synced != cm.store.syncer.written {
+		t.Errorf("written %d, synced %d, expected %d\n", cm.store.syncer.written, cm.store.syncer.synced, pushers * count)
+	}
+
+	last, err := cm.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != uint64(START_ID + (pushers * count - 1) * ID_RANGE) {
+		t.Errorf("last config is %d\n", last.FromLogIndex)
+	}
+}
+
+// a batch which can't be flushed is rolled back, and watchers are not told of it
+func Test_SyncBatchRollback(t *testing.T) {
+	cm, err := getTestStore(SYNC_DATA_PATH, SYNC_DATA_HEADER, 2, func(opts *Options) {
+		opts.SyncPolicy = SyncBatch
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := cm.Watch(ctx)
+
+	// fails the flush of the batch and the retry of it
+	failOnce(cm, FAULT_SYNC, FAULT_SYNC)
+	defer setFaultHook(cm, nil)
+	id := START_ID + 2 * ID_RANGE
+	if err = cm.PushConfig(uint64(id), getConf(id)); err == nil {
+		t.Error("push must fail as it can't be flushed")
+		return
+	}
+
+	last, err := cm.LastConfig()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if last.FromLogIndex != uint64(START_ID + ID_RANGE) {
+		t.Errorf("the push must be rolled back, but the last config is %d\n", last.FromLogIndex)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("no event for the push rolled back, but get %#v\n", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err = cm.PushConfig(uint64(id), getConf(id)); err != nil {
+		t.Error(err)
+		return
+	}
+	if event, ok := receive(t, events).(Pushed); !ok || event.Meta.FromLogIndex != uint64(id) {
+		t.Errorf("Pushed of %d expected, get %#v\n", id, event)
+	}
+}
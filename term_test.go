@@ -0,0 +1,269 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	TERM_DATA_PATH = "./term_data"
+	TERM_DATA_HEADER = "term"
+)
+
+// opened again by the tests, it isn't emptied
+func getTermStore() (*ConfManager, error) {
+	return GetConfManagerWithOptions(TERM_DATA_PATH, TERM_DATA_HEADER, getTestOptions(nil))
+}
+
+// config i is pushed in term i / 10 + 1
+func pushConfWithTerm(cm *ConfManager, count int) error {
+	for i := 0; i < count; i++ {
+		id := START_ID + i * ID_RANGE
+		if err := cm.PushConfigWithTerm(uint64(id), uint64(i / 10 + 1), getConf(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Test_termRoundTrip(t *testing.T) {
+	removeAll(TERM_DATA_PATH)
+	cm, err := getTermStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	count := 100
+	if err = pushConfWithTerm(cm, count); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+	cm.Close()
+
+	// most of them are only on disk after reopening
+	cm, err = getTermStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	for i := 0; i < count; i++ {
+		term, err := cm.GetConfigTerm(uint64(START_ID + i * ID_RANGE + 1))
+		if err != nil || term != uint64(i / 10 + 1) {
+			t.Errorf("config %d must be of term %d, but get %d, %v\n", i, i / 10 + 1, term, err)
+			return
+		}
+	}
+
+	it := cm.ReverseIterator(UINT64_MAX)
+	for i := count - 1; it.Next(); i-- {
+		if it.Term() != uint64(i / 10 + 1) {
+			t.Errorf("iterator: config %d must be of term %d, but get %d\n", i, i / 10 + 1, it.Term())
+			return
+		}
+	}
+	if it.Err() != nil {
+		t.Error(it.Err())
+	}
+
+	// a replay of another term is not a no-op
+	last := START_ID + (count - 1) * ID_RANGE
+	if err = cm.PushConfigWithTerm(uint64(last), uint64(count / 10 + 1), getConf(last)); !errors.Is(err, ErrConflict) {
+		t.Errorf("replay of another term must return ErrConflict, but get %v\n", err)
+	}
+	if err = cm.PushConfigWithTerm(uint64(last), uint64((count - 1) / 10 + 1), getConf(last)); err != nil {
+		t.Errorf("replay of the same term must be a no-op, but get %v\n", err)
+	}
+}
+
+func Test_TruncateAfterTermMismatch(t *testing.T) {
+	removeAll(TERM_DATA_PATH)
+	cm, err := getTermStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	count := 100
+	if err = pushConfWithTerm(cm, count); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the same term, or no config starts from it
+	id := uint64(START_ID + 50 * ID_RANGE)
+	if truncated, err := cm.TruncateAfterTermMismatch(id, 6); truncated || err != nil {
+		t.Errorf("the same term must not be truncated, but get %v, %v\n", truncated, err)
+	}
+	if truncated, err := cm.TruncateAfterTermMismatch(id + 1, 7); truncated || err != nil {
+		t.Errorf("no config starts from %d, but get %v, %v\n", id + 1, truncated, err)
+	}
+	if truncated, err := cm.TruncateAfterTermMismatch(uint64(START_ID + count * ID_RANGE), 7); truncated || err != nil {
+		t.Errorf("no config after the last one, but get %v, %v\n", truncated, err)
+	}
+
+	events := cm.Watch(context.Background())
+	truncated, err := cm.TruncateAfterTermMismatch(id, 7)
+	if !truncated || err != nil {
+		t.Errorf("config of another term must be truncated, but get %v, %v\n", truncated, err)
+		return
+	}
+	select {
+	case e := <-events:
+		if truncatedAfter, ok := e.(TruncatedAfter); !ok || truncatedAfter.LogIndex != id - 1 {
+			t.Errorf("expected TruncatedAfter %d, but get %v\n", id - 1, e)
+		}
+	case <-time.After(time.Second):
+		t.Error("no event for the truncation")
+	}
+
+	last, err := cm.LastConfig()
+	if err != nil || last.FromLogIndex != id - uint64(ID_RANGE) {
+		t.Errorf("last config must be from %d, but get %v, %v\n", id - uint64(ID_RANGE), last, err)
+		return
+	}
+
+	// the leader's config goes on
+	if err = cm.PushConfigWithTerm(id, 7, getConf(int(id))); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case e := <-events:
+		if pushed, ok := e.(Pushed); !ok || pushed.Term != 7 || pushed.Meta.FromLogIndex != id {
+			t.Errorf("expected Pushed %d of term 7, but get %v\n", id, e)
+		}
+	case <-time.After(time.Second):
+		t.Error("no event for the push")
+	}
+	if term, err := cm.GetConfigTerm(id); term != 7 || err != nil {
+		t.Errorf("config %d must be of term 7, but get %d, %v\n", id, term, err)
+	}
+}
+
+// the data files written before terms were recorded keep their format and are read with term 0, the new ones record
+// the terms
+func Test_termOldFormat(t *testing.T) {
+	removeAll(TERM_DATA_PATH)
+	cm, err := getTermStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	metaFileName := cm.store.disk.getMetaFileName()
+
+	// write the data files as a v2 store does, and turn the meta file to v2
+	cm.store.disk.format = getRecordFormat(2, cm.store.disk.format.blockSize)
+	if err = pushConf(cm, START_ID, ID_RANGE, 50); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+	cm.Close()
+	file, err := os.OpenFile(metaFileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	version := make([]byte, NUM_LEN)
+	binary.BigEndian.PutUint64(version, 2)
+	_, err = file.WriteAt(version, int64(META_VERSION_POS))
+	file.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cm, err = getTermStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cm.store.disk.oldFormat == nil || cm.store.disk.oldFormat.headSize != DATA_HEAD_SIZE_V2 {
+		t.Errorf("the data files of v2 must keep their format, but get %+v\n", cm.store.disk.oldFormat)
+	}
+	if term, err := cm.GetConfigTerm(uint64(START_ID)); term != 0 || err != nil {
+		t.Errorf("configs of v2 must be of term 0, but get %d, %v\n", term, err)
+	}
+
+	// term 0 is unknown, it matches any term
+	if err = cm.PushConfigWithTerm(uint64(START_ID), 3, getConf(START_ID)); err != nil {
+		t.Errorf("replay of a config of term 0 must be a no-op, but get %v\n", err)
+	}
+	if truncated, err := cm.TruncateAfterTermMismatch(uint64(START_ID + 10 * ID_RANGE), 5); truncated || err != nil {
+		t.Errorf("a config of term 0 must not be truncated, but get %v, %v\n", truncated, err)
+	}
+
+	// pushed to a new data file of the latest format
+	id := START_ID + 50 * ID_RANGE
+	if err = cm.PushConfigWithTerm(uint64(id), 1, getConf(id)); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+	if cm.store.disk.upgradeFrom != uint64(id) {
+		t.Errorf("the data files of the latest format must start from %d, but get %d\n", id, cm.store.disk.upgradeFrom)
+	}
+
+	// truncated back to the old ones, the new data file starts before the one truncated
+	if err = cm.TruncateAfter(uint64(START_ID + 45 * ID_RANGE)); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+	id = START_ID + 46 * ID_RANGE
+	if err = cm.PushConfigWithTerm(uint64(id), 2, getConf(id)); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+	cm.Close()
+
+	cm, err = getTermStore()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+	if cm.store.disk.upgradeFrom != uint64(id) {
+		t.Errorf("the data files of the latest format must start from %d, but get %d\n", id, cm.store.disk.upgradeFrom)
+	}
+	metas, err := cm.ListAfter(0)
+	if err != nil || len(metas) != 47 {
+		t.Errorf("expected 47 configs, but get %d, %v\n", len(metas), err)
+		return
+	}
+	if term, err := cm.GetConfigTerm(uint64(id)); term != 2 || err != nil {
+		t.Errorf("config %d must be of term 2, but get %d, %v\n", id, term, err)
+	}
+	if term, err := cm.GetConfigTerm(uint64(id) - 1); term != 0 || err != nil {
+		t.Errorf("config %d must be of term 0, but get %d, %v\n", id - ID_RANGE, term, err)
+	}
+	if report, err := cm.Verify(); err != nil || len(report.Problems) > 0 {
+		t.Errorf("the store must be good, but get %+v, %v\n", report, err)
+	}
+
+	// all the data files are of the latest format after a restore
+	var snap bytes.Buffer
+	if err = cm.WriteSnapshot(&snap, UINT64_MAX); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = cm.RestoreSnapshot(&snap); err != nil {
+		t.Error(err)
+		return
+	}
+	meta, err := readStoreMeta(metaFileName, nil, cm.store.log())
+	if err != nil || cm.store.disk.oldFormat != nil || meta.upgradeFrom != 0 {
+		t.Errorf("the old format must be dropped, but get %+v, %v\n", meta, err)
+	}
+	if term, err := cm.GetConfigTerm(uint64(id)); term != 2 || err != nil {
+		t.Errorf("config %d must be of term 2, but get %d, %v\n", id, term, err)
+	}
+}
@@ -31,6 +31,17 @@ func readFileAll (file *os.File) ([]byte, error) {
 	return s, nil
 }
 
+// flush the directory, so that files created or removed in it survive a power loss
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
 func removeFiles(path string) error {
 	pattern := filepath.Join(path, "*.data")
 	files, err := filepath.Glob(pattern)
@@ -57,9 +68,23 @@ func removeIndexs(path string) error {
 	return nil
 }
 
+func removeMetas(path string) error {
+	pattern := filepath.Join(path, "*.meta")
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+
+	return nil
+}
+
 func removeAll(path string) {
 	removeFiles(path)
 	removeIndexs(path)
+	removeMetas(path)
 }
 
 
@@ -0,0 +1,411 @@
+package conf
+
+/*
+	verify checks the files of a store like fsck, nothing is changed:
+
+	records: framing, checksum and padding of each record in the data files
+	ranges:  startIds increase, and each record covers till the one after it, in a data file and across them. endId of
+	         a record is the startId of the next one - 1, and 0 for the last record of the store. the first record of a
+	         data file starts from the id in its filename
+	indexes: each data file has an index file, whose meta and sections match the data file
+	files:   no index file without its data file, no data file of an illegal name, no temp file or journal left
+
+	all the problems found are collected in a VerifyReport instead of stopping at the first one, the ones after a
+	broken record of a data file are unknown, as the records can't be told apart after it.
+
+		report, err := VerifyDir(dir, header)
+		if err != nil {
+			return err // the store can't be read at all
+		}
+		if !report.OK() {
+			fmt.Println(report)
+		}
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ProblemKind string
+
+const (
+	ProblemRecord ProblemKind = "record" // a record can't be parsed, or its padding isn't 0
+	ProblemRange  ProblemKind = "range"  // startId/endId are out of order or not contiguous
+	ProblemIndex  ProblemKind = "index"  // an index file is missing, broken or doesn't match its data file
+	ProblemFile   ProblemKind = "file"   // a file which doesn't belong to the store, or left by a write not finished
+	ProblemMeta   ProblemKind = "meta"   // the meta file of the store is broken
+)
+
+// a problem found by Verify
+type Problem struct {
+	Kind   ProblemKind
+	File   string // the file it is in
+	Offset uint64 // where it is in File, 0 if it is about the whole file
+	Reason string
+}
+
+func (this Problem) String() string {
+	return fmt.Sprintf("%s: %s at offset %d: %s", this.Kind, this.File, this.Offset, this.Reason)
+}
+
+// what Verify has checked and found
+type VerifyReport struct {
+	Dir      string
+	Header   string
+	Files    int    // data files checked
+	Records  uint64 // records read
+	Problems []Problem
+}
+
+// no problem found
+func (this *VerifyReport) OK() bool {
+	return len(this.Problems) == 0
+}
+
+func (this *VerifyReport) String() string {
+	s := fmt.Sprintf("verified %s/%s: %d data files, %d records, %d problems", this.Dir, this.Header, this.Files, this.Records, len(this.Problems))
+	for _, problem := range this.Problems {
+		s += "\n\t" + problem.String()
+	}
+	return s
+}
+
+func (this *VerifyReport) add(kind ProblemKind, file string, offset uint64, format string, args ...interface{}) {
+	this.Problems = append(this.Problems, Problem{Kind: kind, File: file, Offset: offset, Reason: fmt.Sprintf(format, args...)})
+}
+
+// a record read by verify
+type verifyRecord struct {
+	startId uint64
+	endId   uint64
+	pos     uint64
+}
+
+// what verify has read from a data file
+type verifySegment struct {
+	fileName string
+	startId  uint64 // in the filename
+	size     uint64
+	records  []verifyRecord
+	broken   bool // a record can't be parsed, the ones after it are unknown
+}
+
+/*
+	check the files of the store in dir, which is not opened. it should not be written meanwhile, or what is being
+	written may be reported. an error is returned only if the store can't be checked at all.
+ */
+func VerifyDir(dir, header string) (*VerifyReport, error) {
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	disk, err := getToolDiskIO(dir, header, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := disk.loadLayout(); err != nil {
+		report := &VerifyReport{Dir: disk.path, Header: header}
+		report.add(ProblemMeta, disk.getMetaFileName(), 0, "%s", corruptReason(err))
+		return report, nil
+	}
+
+	return disk.verify()
+}
+
+/*
+	a diskIo of the store in dir, for the tools working on its files without opening it. nothing is loaded, and the
+	lock is not taken
+ */
+func getToolDiskIO(dir, header string, opts *Options) (*diskIo, error) {
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		return nil, errors.New(fmt.Sprintf("store %s is not a directory", absPath))
+	}
+
+	return &diskIo{
+		path: absPath,
+		header: header,
+		opts: opts,
+		idxMgr: &indexMgr{
+			mapIndex: make(map[string]*indexInfo),
+		},
+		validSizes: make(map[string]uint64),
+	}, nil
+}
+
+// take the layout from the meta file, the one of opts is kept for a new store. the codec is not needed by the tools
+func (this *diskIo) loadLayout() error {
+	dataFiles, err := filepath.Glob(filepath.Join(this.path, this.header+"_*.data"))
+	if err != nil {
+		return err
+	}
+	meta, err := readStoreMeta(this.getMetaFileName(), dataFiles, this.log())
+	if err != nil {
+		return err
+	}
+
+	if meta == nil {
+		this.setLayout(&storeMeta{version: META_FORMAT_VERSION, blockSize: this.opts.DataBlockSize})
+		return nil
+	}
+
+	this.opts.DataBlockSize = meta.blockSize
+	this.opts.FileNameNumLen = meta.nameNumLen
+	this.setLayout(meta)
+	return nil
+}
+
+/*
+	check the files of the store, writes wait till it is done. the store of a reader (Options.ReadOnly) may be
+	written by another process meanwhile, what is being written may be reported.
+ */
+func (this *ConfManager) Verify() (*VerifyReport, error) {
+	return this.store.Verify()
+}
+
+func (this *RangeStore) Verify() (*VerifyReport, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if this.closed {
+		return nil, ErrClosed
+	}
+
+	return this.disk.verify()
+}
+
+func (this *diskIo) verify() (*VerifyReport, error) {
+	report := &VerifyReport{Dir: this.path, Header: this.header}
+
+	// sort out the files of the store
+	names, err := filepath.Glob(filepath.Join(this.path, this.header+"_*"))
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]*verifySegment, 0)
+	indexFiles := make(map[string]bool)
+	for _, name := range names {
+		switch {
+		case strings.HasSuffix(name, TMP_FILE_SUFFIX):
+			report.add(ProblemFile, name, 0, "temp file left by a write not finished")
+		case strings.HasSuffix(name, ".data"):
+			startId, ok := this.parseDataFileName(name)
+			if !ok {
+				report.add(ProblemFile, name, 0, "illegal data filename, %d digits of startId are expected", this.opts.FileNameNumLen)
+				continue
+			}
+			segments = append(segments, &verifySegment{fileName: name, startId: startId})
+		case strings.HasSuffix(name, ".idx"):
+			indexFiles[name] = true
+		}
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(this.path, this.header+".*"+TMP_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range tmpFiles {
+		report.add(ProblemFile, name, 0, "temp file left by a write not finished")
+	}
+	if _, err := os.Stat(this.getJournalFileName()); err == nil {
+		report.add(ProblemFile, this.getJournalFileName(), 0, "journal of a truncation not finished, it is applied when the store is opened")
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].startId < segments[j].startId
+	})
+
+	for _, segment := range segments {
+		indexFileName := dataFileNameToIdxFileName(segment.fileName)
+		delete(indexFiles, indexFileName)
+
+		if err := this.verifyData(segment, report); err != nil {
+			return nil, err
+		}
+		if err := this.verifyIndex(segment, indexFileName, report); err != nil {
+			return nil, err
+		}
+		report.Files++
+		report.Records += uint64(len(segment.records))
+	}
+
+	// endId of the last record of a data file links to the next data file
+	for i, segment := range segments {
+		if segment.broken || len(segment.records) == 0 {
+			continue
+		}
+		last := segment.records[len(segment.records)-1]
+		if i + 1 == len(segments) {
+			if last.endId != 0 {
+				report.add(ProblemRange, segment.fileName, last.pos, "endId of the last record of the store is %d, not 0", last.endId)
+			}
+			continue
+		}
+		if next := segments[i+1]; len(next.records) > 0 && last.endId != next.records[0].startId - 1 {
+			report.add(ProblemRange, segment.fileName, last.pos, "endId %d of the last record doesn't link to startId %d of %s",
+				last.endId, next.records[0].startId, filepath.Base(next.fileName))
+		}
+	}
+
+	orphans := make([]string, 0, len(indexFiles))
+	for name := range indexFiles {
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		report.add(ProblemFile, name, 0, "index file without its data file")
+	}
+
+	return report, nil
+}
+
+// startId in the name of a data file, false if the name isn't the one the store gives
+func (this *diskIo) parseDataFileName(fileName string) (uint64, bool) {
+	base := filepath.Base(fileName)
+	num := strings.TrimSuffix(strings.TrimPrefix(base, this.header+"_"), ".data")
+	startId, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || filepath.Base(this.getFileNameByStartId(startId)) != base {
+		return 0, false
+	}
+
+	return startId, true
+}
+
+// check the records of a data file and the ranges they cover
+func (this *diskIo) verifyData(segment *verifySegment, report *VerifyReport) error {
+	buff, err := ioutil.ReadFile(segment.fileName)
+	if err != nil {
+		return err
+	}
+	segment.size = uint64(len(buff))
+	if segment.size == 0 {
+		report.add(ProblemRecord, segment.fileName, 0, "no record in the data file")
+		return nil
+	}
+
+	var last *diskElem = nil
+	for pos := uint64(0); pos < segment.size; {
+		elem, recordSize, err := this.formatOf(segment.fileName).parseRecord(buff, pos, segment.fileName, 0)
+		if err != nil {
+			report.add(ProblemRecord, segment.fileName, pos, "%s", corruptReason(err))
+			segment.broken = true
+			return nil
+		}
+
+		for padPos := pos + this.formatOf(segment.fileName).headSize + uint64(len(elem.buff)); padPos < pos + recordSize; padPos++ {
+			if buff[padPos] != 0 {
+				report.add(ProblemRecord, segment.fileName, padPos, "padding of the record at %d isn't 0", pos)
+				break
+			}
+		}
+
+		if last == nil {
+			if elem.startId != segment.startId {
+				report.add(ProblemRange, segment.fileName, pos, "the first record starts from %d, not the one in the filename", elem.startId)
+			}
+		} else {
+			if elem.startId <= last.startId {
+				report.add(ProblemRange, segment.fileName, pos, "startId %d is not larger than %d of the record before", elem.startId, last.startId)
+			} else if last.endId != elem.startId - 1 {
+				prev := segment.records[len(segment.records)-1]
+				report.add(ProblemRange, segment.fileName, prev.pos, "endId %d doesn't link to startId %d of the next record", last.endId, elem.startId)
+			}
+		}
+
+		segment.records = append(segment.records, verifyRecord{startId: elem.startId, endId: elem.endId, pos: pos})
+		last = elem
+		pos += recordSize
+	}
+
+	return nil
+}
+
+// check the index file against the records read from its data file
+func (this *diskIo) verifyIndex(segment *verifySegment, indexFileName string, report *VerifyReport) error {
+	buff, err := ioutil.ReadFile(indexFileName)
+	if os.IsNotExist(err) {
+		report.add(ProblemIndex, indexFileName, 0, "no index file, it is rebuilt when the store is opened")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	info, err := decodeIndex(buff, indexFileName)
+	if err != nil {
+		report.add(ProblemIndex, indexFileName, 0, "%s", corruptReason(err))
+		return nil
+	}
+	if tail := (uint64(len(buff)) - IDX_HEADER_SIZE) % SI_SIZE; tail != 0 {
+		report.add(ProblemIndex, indexFileName, uint64(len(buff)) - tail, "torn section index of %d bytes at the end", tail)
+	}
+
+	meta := info.meta
+	if meta.dataFileSize != segment.size {
+		report.add(ProblemIndex, indexFileName, 0, "dataFileSize is %d, but the data file has %d bytes", meta.dataFileSize, segment.size)
+	}
+	// the rest can't be told if the records are unknown
+	if segment.broken || len(segment.records) == 0 {
+		return nil
+	}
+
+	first := segment.records[0]
+	last := segment.records[len(segment.records)-1]
+	if meta.recordNum != uint64(len(segment.records)) {
+		report.add(ProblemIndex, indexFileName, 0, "recordNum is %d, but the data file has %d records", meta.recordNum, len(segment.records))
+	}
+	if meta.lastRecordPos != last.pos {
+		report.add(ProblemIndex, indexFileName, 0, "lastRecordPos is %d, but the last record is at %d", meta.lastRecordPos, last.pos)
+	}
+	if meta.minId != first.startId {
+		report.add(ProblemIndex, indexFileName, 0, "minId is %d, but the first record starts from %d", meta.minId, first.startId)
+	}
+	// maxId is the startId of the last record when it is appended, and its endId when the index is built after
+	// the file is full
+	if meta.maxId != last.startId && (last.endId == 0 || meta.maxId != last.endId) {
+		report.add(ProblemIndex, indexFileName, 0, "maxId is %d, but the last record covers [%d, %d]", meta.maxId, last.startId, last.endId)
+	}
+
+	// each section points to a record, in order, and the first one to the first record
+	records := make(map[uint64]uint64, len(segment.records)) // pos ==> startId
+	for _, record := range segment.records {
+		records[record.pos] = record.startId
+	}
+	if len(info.indexs) == 0 || info.indexs[0].pos != 0 {
+		report.add(ProblemIndex, indexFileName, IDX_HEADER_SIZE, "the first section doesn't start from the first record")
+	}
+	for i, idx := range info.indexs {
+		offset := IDX_HEADER_SIZE + uint64(i) * SI_SIZE
+		if i > 0 && (idx.pos <= info.indexs[i-1].pos || idx.startId <= info.indexs[i-1].startId) {
+			report.add(ProblemIndex, indexFileName, offset, "section %d is out of order", i)
+			continue
+		}
+		startId, ok := records[idx.pos]
+		if !ok {
+			report.add(ProblemIndex, indexFileName, offset, "section %d points to %d, where no record starts", i, idx.pos)
+		} else if startId != idx.startId {
+			report.add(ProblemIndex, indexFileName, offset, "section %d says startId %d at %d, but the record has %d", i, idx.startId, idx.pos, startId)
+		}
+	}
+
+	return nil
+}
+
+// the reason of a CorruptError, the file and offset are in the problem already
+func corruptReason(err error) string {
+	var corruptErr *CorruptError
+	if errors.As(err, &corruptErr) {
+		return corruptErr.Reason
+	}
+	return err.Error()
+}
@@ -0,0 +1,175 @@
+package conf
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+var (
+	VERIFY_DATA_PATH = "./verify_data"
+	VERIFY_DATA_HEADER = "verify"
+)
+
+// a store of count configs in several data files, truncated at both ends
+func getVerifyStore(count int) (*ConfManager, error) {
+	cm, err := getTestStore(VERIFY_DATA_PATH, VERIFY_DATA_HEADER, count, func(opts *Options) {
+		opts.IdxMaxRecordPerSection = 4
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cm.TruncateBefore(uint64(START_ID + 3 * ID_RANGE + 50)); err != nil {
+		cm.Close()
+		return nil, err
+	}
+	if err = cm.TruncateAfter(uint64(START_ID + (count - 3) * ID_RANGE + 50)); err != nil {
+		cm.Close()
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// the data files of the store, sorted by startId
+func verifyDataFiles(t *testing.T) []string {
+	files, err := filepath.Glob(filepath.Join(VERIFY_DATA_PATH, VERIFY_DATA_HEADER + "_*.data"))
+	if err != nil || len(files) < 3 {
+		t.Fatalf("expected 3 data files at least, but get %v, %v\n", files, err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func writeAt(t *testing.T, fileName string, buff []byte, pos uint64) {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteAt(buff, int64(pos)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_verifyHealthy(t *testing.T) {
+	cm, err := getVerifyStore(200)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	report, err := cm.Verify()
+	if err != nil || !report.OK() {
+		t.Errorf("a healthy store must pass, but get %v, %v\n", report, err)
+	}
+	if report != nil && (report.Files < 3 || report.Records != 200 - 3 - 2) {
+		t.Errorf("expected %d records in 3 data files at least, but get %s\n", 200 - 3 - 2, report.String())
+	}
+	cm.Close()
+
+	report, err = VerifyDir(VERIFY_DATA_PATH, VERIFY_DATA_HEADER)
+	if err != nil || !report.OK() {
+		t.Errorf("a healthy store must pass when closed, but get %v, %v\n", report, err)
+	}
+
+	if _, err = cm.Verify(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, but get %v\n", err)
+	}
+	if _, err = VerifyDir(filepath.Join(VERIFY_DATA_PATH, "missing"), VERIFY_DATA_HEADER); err == nil {
+		t.Error("a missing store must fail")
+	}
+}
+
+// each kind of damage is reported, in the file it is made to
+func Test_verifyProblems(t *testing.T) {
+	format := getRecordFormat(META_FORMAT_VERSION, DATA_BLOCK_SIZE)
+	recordSize := format.recordSize(uint64(len(getBuff(START_ID))))
+	idBuff := func(id uint64) []byte {
+		buff := make([]byte, ID_LEN)
+		binary.BigEndian.PutUint64(buff, id)
+		return buff
+	}
+
+	cases := []struct {
+		name   string
+		kind   ProblemKind
+		damage func(t *testing.T, files []string) string // returns the file expected in the problem
+	}{
+		{"checksum", ProblemRecord, func(t *testing.T, files []string) string {
+			writeAt(t, files[1], []byte{0xff}, recordSize + format.headSize)
+			return files[1]
+		}},
+		{"padding", ProblemRecord, func(t *testing.T, files []string) string {
+			writeAt(t, files[1], []byte{0xff}, recordSize - 1)
+			return files[1]
+		}},
+		{"endIdInFile", ProblemRange, func(t *testing.T, files []string) string {
+			writeAt(t, files[1], idBuff(uint64(START_ID * 1000)), DATA_ENDID_POS)
+			return files[1]
+		}},
+		{"endIdAcrossFiles", ProblemRange, func(t *testing.T, files []string) string {
+			buff, _ := ioutil.ReadFile(dataFileNameToIdxFileName(files[0]))
+			info, err := decodeIndex(buff, files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeAt(t, files[0], idBuff(uint64(START_ID * 1000)), info.meta.lastRecordPos + DATA_ENDID_POS)
+			return files[0]
+		}},
+		{"missingIndex", ProblemIndex, func(t *testing.T, files []string) string {
+			os.Remove(dataFileNameToIdxFileName(files[1]))
+			return dataFileNameToIdxFileName(files[1])
+		}},
+		{"staleIndex", ProblemIndex, func(t *testing.T, files []string) string {
+			// a section points to the middle of a record
+			writeAt(t, dataFileNameToIdxFileName(files[1]), idBuff(recordSize + 8), IDX_HEADER_SIZE + SI_SIZE + SI_POS_POS)
+			return dataFileNameToIdxFileName(files[1])
+		}},
+		{"orphanIndex", ProblemFile, func(t *testing.T, files []string) string {
+			orphan := filepath.Join(filepath.Dir(files[0]), VERIFY_DATA_HEADER + "_0000000001.idx")
+			ioutil.WriteFile(orphan, make([]byte, IDX_HEADER_SIZE), 0666)
+			return orphan
+		}},
+		{"illegalName", ProblemFile, func(t *testing.T, files []string) string {
+			illegal := filepath.Join(filepath.Dir(files[0]), VERIFY_DATA_HEADER + "_1.data")
+			ioutil.WriteFile(illegal, nil, 0666)
+			return illegal
+		}},
+		{"tempFile", ProblemFile, func(t *testing.T, files []string) string {
+			ioutil.WriteFile(files[1] + TMP_FILE_SUFFIX, nil, 0666)
+			return files[1] + TMP_FILE_SUFFIX
+		}},
+	}
+
+	for _, c := range cases {
+		cm, err := getVerifyStore(200)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		cm.Close()
+		files := verifyDataFiles(t)
+		expected, _ := filepath.Abs(c.damage(t, files))
+
+		report, err := VerifyDir(VERIFY_DATA_PATH, VERIFY_DATA_HEADER)
+		if err != nil {
+			t.Errorf("%s: %v\n", c.name, err)
+			continue
+		}
+		found := false
+		for _, problem := range report.Problems {
+			if problem.Kind == c.kind && problem.File == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: expected a %s problem in %s, but get %s\n", c.name, c.kind, expected, report.String())
+		}
+		os.Remove(expected)
+	}
+}
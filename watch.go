@@ -0,0 +1,252 @@
+package conf
+
+/*
+	watch delivers the changes of a ConfManager to the ones who want to know, instead of polling LastConfig.
+
+	events are queued when PushConfig, TruncateBefore, TruncateAfter or RestoreSnapshot has changed both memory and
+	disk, with the write lock held, so they are in the order the changes are committed. a watcher queues
+	Options.WatchBufferSize events at most, when a slow watcher has its queue full, the events after are dropped till
+	the queue is drained, and then a Dropped event tells how many are lost, after which the events go on.
+
+		events := cm.Watch(ctx)
+		for event := range events {
+			switch e := event.(type) {
+			case Pushed:
+			case TruncatedBefore:
+			case TruncatedAfter:
+			case Restored:
+			case Dropped:
+				// reload the state by LastConfig or ListAfter
+			}
+		}
+
+	the channel is closed when ctx is done or the ConfManager is closed.
+ */
+
+import (
+	"context"
+	"sync"
+	. "rafted/persist"
+)
+
+var (
+	WATCH_BUFFER_SIZE int = 64 // default of Options.WatchBufferSize
+)
+
+type Event interface {
+	event()
+}
+
+// a config is pushed, it is the last one
+type Pushed struct {
+	Meta *ConfigMeta
+	Term uint64 // raft term it was pushed in, 0 if not told
+}
+
+// the configs before LogIndex are truncated, the one covering it starts from it
+type TruncatedBefore struct {
+	LogIndex uint64
+}
+
+// the configs after LogIndex are truncated, the one covering it is the last one
+type TruncatedAfter struct {
+	LogIndex uint64
+}
+
+// all the configs are replaced by a snapshot, Last is the last one, nil if the snapshot is empty
+type Restored struct {
+	Last *ConfigMeta
+}
+
+// Count events after the one received before are lost, because the watcher was too slow
+type Dropped struct {
+	Count uint64
+}
+
+func (Pushed) event()          {}
+func (TruncatedBefore) event() {}
+func (TruncatedAfter) event()  {}
+func (Restored) event()        {}
+func (Dropped) event()         {}
+
+type watcher struct {
+	ch   chan Event    // to the consumer
+	done chan struct{} // closed by close()
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   []Event
+	size    int
+	dropped uint64 // events dropped since the queue got full
+	closed  bool
+}
+
+/*
+	watch the changes of the ConfManager, the events after this call are delivered by the channel returned
+ */
+func (this *ConfManager) Watch(ctx context.Context) <-chan Event {
+	w := &watcher{
+		ch: make(chan Event),
+		done: make(chan struct{}),
+		queue: make([]Event, 0, this.store.opts.WatchBufferSize),
+		size: this.store.opts.WatchBufferSize,
+	}
+	w.cond = sync.NewCond(&w.mutex)
+
+	this.watchMutex.Lock()
+	if this.watchers == nil {
+		// closed already
+		this.watchMutex.Unlock()
+		close(w.ch)
+		return w.ch
+	}
+	this.watchers[w] = struct{}{}
+	this.watchMutex.Unlock()
+
+	go w.pump()
+	go func() {
+		select {
+		case <-ctx.Done():
+			this.unwatch(w)
+		case <-w.done:
+		}
+	}()
+
+	return w.ch
+}
+
+func (this *ConfManager) unwatch(w *watcher) {
+	this.watchMutex.Lock()
+	delete(this.watchers, w)
+	this.watchMutex.Unlock()
+
+	w.close()
+}
+
+// called with the write lock held, after both memory and disk are changed
+func (this *ConfManager) notify(event Event) {
+	this.watchMutex.Lock()
+	defer this.watchMutex.Unlock()
+
+	for w := range this.watchers {
+		w.push(event)
+	}
+}
+
+func (this *ConfManager) hasWatchers() bool {
+	this.watchMutex.Lock()
+	defer this.watchMutex.Unlock()
+
+	return len(this.watchers) > 0
+}
+
+// a config is pushed, see rangeObserver
+func (this *ConfManager) pushed(elem *myElem) {
+	if !this.hasWatchers() {
+		return
+	}
+
+	// decoded again, the config of the caller may be changed after PushConfig returns
+	meta, err := memElemToConfigMeta(this.codec, elem)
+	if err != nil {
+		this.store.log().error("push", "decode config for watchers failed", LOG_KEY_INDEX, elem.startId, LOG_KEY_ERROR, err)
+		return
+	}
+	this.notify(Pushed{Meta: meta, Term: elem.term})
+}
+
+func (this *ConfManager) truncatedBefore(logIndex uint64) {
+	this.notify(TruncatedBefore{LogIndex: logIndex})
+}
+
+func (this *ConfManager) truncatedAfter(logIndex uint64) {
+	this.notify(TruncatedAfter{LogIndex: logIndex})
+}
+
+func (this *ConfManager) restored(last *myElem) {
+	restored := Restored{}
+	if last != nil {
+		meta, err := memElemToConfigMeta(this.codec, last)
+		if err != nil {
+			this.store.log().error("restore", "decode config for watchers failed", LOG_KEY_INDEX, last.startId, LOG_KEY_ERROR, err)
+		}
+		restored.Last = meta
+	}
+	this.notify(restored)
+}
+
+// stop all watchers, called by Close()
+func (this *ConfManager) closing() {
+	this.watchMutex.Lock()
+	watchers := this.watchers
+	this.watchers = nil
+	this.watchMutex.Unlock()
+
+	for w := range watchers {
+		w.close()
+	}
+}
+
+// queue the event, never blocks
+func (this *watcher) push(event Event) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return
+	}
+
+	// once dropping, keep dropping till the queue is drained and Dropped is taken, so that no event is out of order
+	if this.dropped > 0 || len(this.queue) >= this.size {
+		this.dropped++
+	} else {
+		this.queue = append(this.queue, event)
+	}
+	this.cond.Signal()
+}
+
+// deliver the queued events to the consumer, Dropped is delivered after the queue is drained
+func (this *watcher) pump() {
+	defer close(this.ch)
+
+	for {
+		this.mutex.Lock()
+		for len(this.queue) == 0 && this.dropped == 0 && !this.closed {
+			this.cond.Wait()
+		}
+		if this.closed {
+			this.mutex.Unlock()
+			return
+		}
+
+		var event Event
+		if len(this.queue) > 0 {
+			event = this.queue[0]
+			this.queue[0] = nil
+			this.queue = this.queue[1:]
+		} else {
+			// the events queued from now on are delivered after it
+			event = Dropped{Count: this.dropped}
+			this.dropped = 0
+		}
+		this.mutex.Unlock()
+
+		select {
+		case this.ch <- event:
+		case <-this.done:
+			return
+		}
+	}
+}
+
+func (this *watcher) close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return
+	}
+	this.closed = true
+	close(this.done)
+	this.cond.Broadcast()
+}
@@ -0,0 +1,157 @@
+package conf
+
+import (
+	"context"
+	"testing"
+	"time"
+	. "rafted/persist"
+)
+
+var (
+	WATCH_DATA_PATH = "./watch_data"
+	WATCH_DATA_HEADER = "watch"
+)
+
+func getWatchStore(bufferSize int) (*ConfManager, error) {
+	return getTestStore(WATCH_DATA_PATH, WATCH_DATA_HEADER, 0, func(opts *Options) {
+		opts.WatchBufferSize = bufferSize
+	})
+}
+
+func receive(t *testing.T, events <-chan Event) Event {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Error("events closed")
+			return nil
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Error("no event received")
+		return nil
+	}
+}
+
+// events are delivered in the order of the changes, a failed change fires nothing
+func Test_watch(t *testing.T) {
+	cm, err := getWatchStore(WATCH_BUFFER_SIZE)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cm.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := cm.Watch(ctx)
+
+	if err = pushConf(cm, START_ID, ID_RANGE, 5); err != nil {
+		t.Error(err)
+		return
+	}
+	// out of order
+	if err = cm.PushConfig(uint64(START_ID), getConf(START_ID + 1)); err == nil {
+		t.Error("push out of order must fail")
+	}
+	if err = cm.TruncateBefore(uint64(START_ID + ID_RANGE)); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = cm.TruncateAfter(uint64(START_ID + 3 * ID_RANGE)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		event := receive(t, events)
+		pushed, ok := event.(Pushed)
+		if !ok {
+			t.Errorf("event %d must be Pushed, but get %#v\n", i, event)
+			return
+		}
+		startId := uint64(START_ID + i * ID_RANGE)
+		if pushed.Meta.FromLogIndex != startId || pushed.Meta.ToLogIndex != UINT64_MAX {
+			t.Errorf("event %d must be config [%d, max], but get [%d, %d]\n", i, startId, pushed.Meta.FromLogIndex, pushed.Meta.ToLogIndex)
+		}
+		if !MultiAddrSliceEqual(pushed.Meta.Conf.Servers, getConf(int(startId)).Servers) {
+			t.Errorf("event %d has a wrong config\n", i)
+		}
+	}
+	if event, ok := receive(t, events).(TruncatedBefore); !ok || event.LogIndex != uint64(START_ID + ID_RANGE) {
+		t.Errorf("expected TruncatedBefore %d, but get %#v\n", START_ID + ID_RANGE, event)
+	}
+	if event, ok := receive(t, events).(TruncatedAfter); !ok || event.LogIndex != uint64(START_ID + 3 * ID_RANGE) {
+		t.Errorf("expected TruncatedAfter %d, but get %#v\n", START_ID + 3 * ID_RANGE, event)
+	}
+
+	// channel is closed when ctx is done
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("no more event expected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("events must be closed when ctx is done")
+	}
+}
+
+// a slow watcher gets Dropped instead of blocking the writer
+func Test_watchDropped(t *testing.T) {
+	bufferSize := 4
+	cm, err := getWatchStore(bufferSize)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	events := cm.Watch(context.Background())
+
+	count := 20
+	if err = pushConf(cm, START_ID, ID_RANGE, count); err != nil {
+		t.Error(err)
+		cm.Close()
+		return
+	}
+
+	// the queued ones, maybe one more taken by the pump already, then Dropped
+	received := 0
+	var dropped uint64 = 0
+	for dropped == 0 {
+		event := receive(t, events)
+		switch e := event.(type) {
+		case Pushed:
+			if e.Meta.FromLogIndex != uint64(START_ID + received * ID_RANGE) {
+				t.Errorf("event %d is config %d\n", received, e.Meta.FromLogIndex)
+			}
+			received++
+		case Dropped:
+			dropped = e.Count
+		default:
+			t.Errorf("unexpected event %#v\n", event)
+			cm.Close()
+			return
+		}
+	}
+	if received > bufferSize + 1 || uint64(received) + dropped != uint64(count) {
+		t.Errorf("received %d and dropped %d, expected %d in all\n", received, dropped, count)
+	}
+
+	// events go on after Dropped
+	if err = pushConf(cm, START_ID + count * ID_RANGE, ID_RANGE, 1); err != nil {
+		t.Error(err)
+	}
+	if event, ok := receive(t, events).(Pushed); !ok || event.Meta.FromLogIndex != uint64(START_ID + count * ID_RANGE) {
+		t.Errorf("expected the config pushed, but get %#v\n", event)
+	}
+
+	// channel is closed when the ConfManager is closed
+	cm.Close()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("no more event expected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("events must be closed when the ConfManager is closed")
+	}
+}